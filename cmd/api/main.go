@@ -1,15 +1,26 @@
 package main
 
 import (
+    "context"
+    "errors"
     "log"
+    "net/http"
     "os"
+    "os/signal"
+    "strings"
+    "syscall"
+    "time"
 
     "github.com/gin-gonic/gin"
     "github.com/mohammadshaad/zocket/config"
     "github.com/mohammadshaad/zocket/internal/api"
+    "github.com/mohammadshaad/zocket/internal/auth"
     "github.com/mohammadshaad/zocket/internal/db"
     "github.com/mohammadshaad/zocket/internal/queue"
     "github.com/mohammadshaad/zocket/internal/cache"
+    "github.com/mohammadshaad/zocket/pkg/money"
+    "github.com/mohammadshaad/zocket/pkg/storage"
+    "github.com/mohammadshaad/zocket/pkg/util"
 )
 
 func main() {
@@ -21,7 +32,11 @@ func main() {
 
     // Initialize Database
     db.InitDatabase()
-    db.Migrate()
+
+    // Migrations are applied with cmd/migrate, never by the API itself
+    if err := db.CheckSchema(); err != nil {
+        log.Fatalf("Refusing to start: %v. Run `go run cmd/migrate/main.go up` first.", err)
+    }
 
     // Initialize Kafka Producer
     brokers := os.Getenv("KAFKA_BROKERS")
@@ -30,20 +45,96 @@ func main() {
         log.Fatal("KAFKA_TOPIC environment variable is not set")
     }
     queue.InitProducerWithTopic([]string{brokers}, topic)
-    defer queue.CloseProducer()
 
     // Initialize Redis (optional)
     REDIS_ADDR := os.Getenv("REDIS_ADDR")
     REDIS_PASSWORD := os.Getenv("REDIS_PASSWORD")
     USERNAME := os.Getenv("REDIS_USERNAME")
     cache.InitRedis(REDIS_ADDR, USERNAME, REDIS_PASSWORD)
+
+    // Initialize Blob Storage for direct image uploads
+    storeConfig := storage.ConfigFromEnv()
+    store, err := storage.New(context.Background(), storeConfig)
+    if err != nil {
+        log.Fatalf("Failed to initialize %s blob store: %v", storeConfig.Backend, err)
+    }
+    api.InitImageUploads(store, util.DownloadConfigFromEnv())
+
+    // Initialize the exchange rates of the supported currencies, whose base
+    // is the currency of amounts given without one
+    baseCurrency := strings.ToUpper(config.GetEnv("DEFAULT_CURRENCY", "USD"))
+    rates, err := money.ParseRates(baseCurrency, config.GetEnv("EXCHANGE_RATES", ""))
+    if err != nil {
+        log.Fatalf("Invalid exchange rates: %v", err)
+    }
+    if err := money.SetDefaultCurrency(baseCurrency); err != nil {
+        log.Fatalf("Invalid default currency: %v", err)
+    }
+    api.InitExchangeRates(rates)
+
+    // Initialize the verifier of bearer tokens, without JWT keys only API
+    // keys are accepted
+    if authConfig := auth.ConfigFromEnv(); authConfig.Configured() {
+        verifier, err := auth.NewVerifier(authConfig)
+        if err != nil {
+            log.Fatalf("Invalid JWT configuration: %v", err)
+        }
+        api.InitAuth(verifier)
+    } else {
+        log.Println("No JWT keys configured, bearer tokens are rejected")
+    }
+
+    // Initialize the per client rate limits
+    limits, err := api.RateLimitsFromEnv()
+    if err != nil {
+        log.Fatalf("Invalid rate limits: %v", err)
+    }
+    api.InitRateLimits(limits)
+    api.InitIdempotency(config.GetEnvDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour))
  
     router := gin.Default()
+    // Rate limits key anonymous clients on their IP, only proxies listed in
+    // TRUSTED_PROXIES may set it with X-Forwarded-For
+    var proxies []string
+    if v := config.GetEnv("TRUSTED_PROXIES", ""); v != "" {
+        proxies = strings.Split(v, ",")
+    }
+    if err := router.SetTrustedProxies(proxies); err != nil {
+        log.Fatalf("Invalid trusted proxies: %v", err)
+    }
 
     api.SetupRoutes(router)
 
-    log.Println("API server running on port 8080")
-    log.Fatal(router.Run(":8080"))
+    // Stop on SIGINT/SIGTERM so rolling deploys drain in-flight requests
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+    defer stop()
+
+    server := &http.Server{
+        Addr:    ":8080",
+        Handler: router,
+    }
+
+    go func() {
+        log.Println("API server running on port 8080")
+        if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+            log.Fatalf("API server failed: %v", err)
+        }
+    }()
+
+    <-ctx.Done()
+    stop()
+    log.Println("Shutting down API server...")
+
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), config.GetEnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second))
+    defer cancel()
+    if err := server.Shutdown(shutdownCtx); err != nil {
+        log.Printf("Error draining HTTP connections: %v", err)
+    }
+
+    queue.CloseProducer()
+    cache.CloseRedis()
+    db.CloseDatabase()
+    log.Println("API server stopped")
 }
 
 func printEnvVariables() {
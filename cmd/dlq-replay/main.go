@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/mohammadshaad/zocket/config"
+	"github.com/mohammadshaad/zocket/internal/queue"
+)
+
+func main() {
+	limit := flag.Int("limit", 0, "maximum number of records to replay, 0 replays the whole dead-letter topic")
+	flag.Parse()
+
+	// Load configuration
+	config.LoadConfig()
+
+	topic := os.Getenv("KAFKA_TOPIC")
+	if topic == "" {
+		log.Fatal("KAFKA_TOPIC environment variable is not set")
+	}
+
+	// Replayed records are produced back onto their original topic
+	brokers := []string{os.Getenv("KAFKA_BROKERS")}
+	queue.InitProducerWithTopic(brokers, topic)
+	defer queue.CloseProducer()
+
+	policy := queue.RetryPolicyFromEnv()
+	queue.InitRetryPolicy(policy)
+
+	groupID := config.GetEnv("KAFKA_DLQ_REPLAY_GROUP_ID", os.Getenv("KAFKA_GROUP_ID")+"-dlq-replay")
+	log.Printf("Replaying dead-letter records from %s", policy.DeadLetterTopic)
+
+	replayed, err := queue.ReplayDeadLetters(context.Background(), brokers, groupID, *limit)
+	if err != nil {
+		log.Fatalf("Error replaying dead-letter records after %d records: %v", replayed, err)
+	}
+	log.Printf("Replayed %d dead-letter records", replayed)
+}
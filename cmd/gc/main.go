@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mohammadshaad/zocket/config"
+	"github.com/mohammadshaad/zocket/internal/db"
+	"github.com/mohammadshaad/zocket/internal/gc"
+	"github.com/mohammadshaad/zocket/pkg/storage"
+)
+
+func main() {
+	// Load configuration first, flag defaults come from it
+	config.LoadConfig()
+
+	dryRun := flag.Bool("dry-run", false, "only report the objects that would be deleted")
+	grace := flag.Duration("grace", config.GetEnvDuration("BLOB_GC_GRACE_PERIOD", 24*time.Hour), "keep unreferenced objects modified more recently than this")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	db.InitDatabase()
+	defer db.CloseDatabase()
+
+	storeConfig := storage.ConfigFromEnv()
+	store, err := storage.New(ctx, storeConfig)
+	if err != nil {
+		log.Fatalf("Failed to initialize %s blob store: %v", storeConfig.Backend, err)
+	}
+
+	// Take the cutoff before loading references, so objects written while
+	// they load are too recent to be collected
+	cutoff := time.Now().Add(-*grace)
+	referenced, err := gc.ReferencedKeys(ctx, store)
+	if err != nil {
+		log.Fatalf("Error loading referenced objects: %v", err)
+	}
+
+	collector := &gc.Collector{
+		Store:      store,
+		Referenced: referenced,
+		Cutoff:     cutoff,
+		DryRun:     *dryRun,
+		InUse:      gc.KeyInUse(store),
+		Lock:       db.LockBlobKey,
+	}
+	report, err := collector.Run(ctx)
+
+	verb := "Deleted"
+	if *dryRun {
+		verb = "Would delete"
+	}
+	for _, key := range report.DeletedKeys {
+		log.Printf("%s %s", verb, key)
+	}
+	log.Printf("Scanned %d objects: %d referenced, %d newer than %s. %s %d unreferenced objects (%d bytes).",
+		report.Scanned, report.Referenced, report.Recent, *grace, verb, report.Deleted, report.DeletedBytes)
+	if err != nil {
+		log.Printf("Garbage collection stopped early: %v", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mohammadshaad/zocket/config"
+	"github.com/mohammadshaad/zocket/internal/db"
+	"github.com/mohammadshaad/zocket/pkg/money"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: migrate [-steps n] up|down|status\n\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  up      apply every pending migration\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  down    revert the latest -steps migrations\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  status  list migrations and when they were applied\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	steps := flag.Int("steps", 1, "number of migrations reverted by down")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	// Load configuration
+	config.LoadConfig()
+
+	db.InitDatabase()
+	defer db.CloseDatabase()
+
+	switch flag.Arg(0) {
+	case "up":
+		// Prices stored before products had a currency are taken to be in it
+		legacyCurrency := strings.ToUpper(config.GetEnv("LEGACY_CURRENCY", config.GetEnv("DEFAULT_CURRENCY", "USD")))
+		if _, ok := money.Exponent(legacyCurrency); !ok {
+			log.Fatalf("Unknown LEGACY_CURRENCY %q", legacyCurrency)
+		}
+		db.InitMigrationParams(map[string]string{"legacy_currency": legacyCurrency})
+
+		applied, err := db.MigrateUp()
+		if err != nil {
+			log.Fatalf("Migration failed after applying %d migrations: %v", applied, err)
+		}
+		log.Printf("Applied %d migrations", applied)
+	case "down":
+		if *steps < 1 {
+			log.Fatal("-steps must be at least 1")
+		}
+		reverted, err := db.MigrateDown(*steps)
+		if err != nil {
+			log.Fatalf("Migration failed after reverting %d migrations: %v", reverted, err)
+		}
+		log.Printf("Reverted %d migrations", reverted)
+	case "status":
+		states, err := db.MigrationStatus()
+		if err != nil {
+			log.Fatalf("Error reading migration status: %v", err)
+		}
+		for _, state := range states {
+			applied := "pending"
+			if state.AppliedAt != nil {
+				applied = "applied " + state.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Printf("%04d_%-40s %s\n", state.Version, state.Name, applied)
+		}
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
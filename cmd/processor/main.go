@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/mohammadshaad/zocket/config"
 	"github.com/mohammadshaad/zocket/internal/queue"
     "github.com/mohammadshaad/zocket/internal/db"
 	"github.com/mohammadshaad/zocket/internal/cache"
+	"github.com/mohammadshaad/zocket/pkg/storage"
+	"github.com/mohammadshaad/zocket/pkg/util"
 )
 
 func main() {
@@ -23,16 +31,79 @@ func main() {
     REDIS_PASSWORD := os.Getenv("REDIS_PASSWORD")
     cache.InitRedis(REDIS_ADDR, REDIS_USERNAME, REDIS_PASSWORD)
 
-	// Initialize Kafka Consumer
+	// Initialize Kafka Producer for the retry and dead-letter topics
 	brokers := os.Getenv("KAFKA_BROKERS")
+	queue.InitProducerWithTopic([]string{brokers}, os.Getenv("KAFKA_TOPIC"))
+
+	// Initialize Kafka Consumer
 	groupID := os.Getenv("KAFKA_GROUP_ID")
-	queue.InitConsumer([]string{brokers}, groupID)
+	queue.InitRetryPolicy(queue.RetryPolicyFromEnv())
+	workers := config.GetEnvInt("KAFKA_CONSUMER_WORKERS", 8)
+	queue.InitConsumer([]string{brokers}, groupID, workers)
+
+	// Stop on SIGINT/SIGTERM, finishing and committing in-flight images first
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Initialize Blob Storage
+	storeConfig := storage.ConfigFromEnv()
+	store, err := storage.New(ctx, storeConfig)
+	if err != nil {
+		log.Fatalf("Failed to initialize %s blob store: %v", storeConfig.Backend, err)
+	}
+	queue.InitBlobStore(store)
 
-	// Initialize S3 Storage
-	bucketName := os.Getenv("S3_BUCKET")
-	queue.InitS3Storage(bucketName)
+	// Rendition profiles generated for every image
+	if spec := os.Getenv("IMAGE_RENDITIONS"); spec != "" {
+		profiles, err := util.ParseRenditionProfiles(spec)
+		if err != nil {
+			log.Fatalf("Invalid IMAGE_RENDITIONS: %v", err)
+		}
+		queue.InitRenditionProfiles(profiles)
+	}
+
+	// Metadata is always stripped, ICC profiles can be kept or applied
+	colorPolicy, err := util.ParseColorProfilePolicy(config.GetEnv("IMAGE_ICC_PROFILE", string(util.ColorProfileStrip)))
+	if err != nil {
+		log.Fatalf("Invalid IMAGE_ICC_PROFILE: %v", err)
+	}
+	queue.InitColorProfilePolicy(colorPolicy)
+	queue.InitDownloader(util.DownloadConfigFromEnv())
+
+	// Exact duplicates within a seller's catalog can be flagged or rejected
+	if err := queue.InitDuplicatePolicy(config.GetEnv("DUPLICATE_IMAGE_POLICY", queue.DuplicatePolicyOff)); err != nil {
+		log.Fatalf("Invalid DUPLICATE_IMAGE_POLICY: %v", err)
+	}
+
+	// The local backend needs something to serve the stored images
+	var fileServer *http.Server
+	if local, ok := store.(*storage.LocalStore); ok {
+		fileServer = &http.Server{
+			Addr:    config.GetEnv("LOCAL_STORAGE_ADDR", ":8081"),
+			Handler: local.Handler(),
+		}
+		go func() {
+			log.Printf("Serving local blob store on %s", fileServer.Addr)
+			if err := fileServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Local blob store server failed: %v", err)
+			}
+		}()
+	}
 
 	// Start consuming messages
 	log.Println("Starting Kafka consumer...")
-	queue.ConsumeMessages(queue.ProcessImageMessage)
+	queue.ConsumeMessages(ctx, queue.ProcessImageMessage)
+
+	log.Println("Shutting down processor...")
+	if fileServer != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), config.GetEnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second))
+		if err := fileServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error draining local blob store connections: %v", err)
+		}
+		cancel()
+	}
+	queue.CloseProducer()
+	cache.CloseRedis()
+	db.CloseDatabase()
+	log.Println("Processor stopped")
 }
@@ -3,6 +3,8 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -21,3 +23,33 @@ func GetEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+// GetEnvInt returns the environment variable as an integer, falling back to
+// the default when it is unset or not a number
+func GetEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s: %q, using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// GetEnvDuration returns the environment variable parsed with
+// time.ParseDuration, falling back to the default when it is unset or invalid
+func GetEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s: %q, using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
@@ -6,7 +6,9 @@ while ! nc -z kafka 9092; do
   sleep 2
 done
 
-# Create the Kafka topic
+# Create the Kafka topics
 kafka-topics.sh --create --topic image_processing --bootstrap-server kafka:9092 --partitions 1 --replication-factor 1
+kafka-topics.sh --create --topic image_processing.retry --bootstrap-server kafka:9092 --partitions 1 --replication-factor 1
+kafka-topics.sh --create --topic image_processing.dlq --bootstrap-server kafka:9092 --partitions 1 --replication-factor 1
 
-echo "Kafka topic 'image_processing' created."
\ No newline at end of file
+echo "Kafka topics 'image_processing', 'image_processing.retry' and 'image_processing.dlq' created."
\ No newline at end of file
@@ -0,0 +1,269 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/auth"
+	"github.com/mohammadshaad/zocket/internal/db"
+	"gorm.io/gorm"
+)
+
+const (
+	maxAPIKeyNameLength = 100
+	// defaultAPIKeyLifetime applies to keys created without expires_at
+	defaultAPIKeyLifetime = 90 * 24 * time.Hour
+	maxAPIKeyLifetime     = 365 * 24 * time.Hour
+	// defaultRotationGrace is how long a rotated key keeps working
+	defaultRotationGrace = 24 * time.Hour
+	maxRotationGrace     = 7 * 24 * time.Hour
+)
+
+// createAPIKeyRequest describes a new API key. UserID defaults to the
+// caller, only admins may create keys for other users.
+type createAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	UserID    uint       `json:"user_id"`
+}
+
+// CreateAPIKeyHandler issues an API key. The key itself is only part of
+// this response, the server keeps its hash.
+func CreateAPIKeyHandler(c *gin.Context) {
+	var req createAPIKeyRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	principal := principalOf(c)
+	if req.UserID == 0 {
+		req.UserID = principal.UserID
+	}
+	if req.UserID != principal.UserID && !principal.IsAdmin() {
+		writeProblem(c, http.StatusForbidden, codeForbidden, "Only admins may create API keys for other users")
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(defaultAPIKeyLifetime)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+	if errs := validateAPIKey(principal, req, expiresAt, now); len(errs) > 0 {
+		writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "API key is invalid", errs...)
+		return
+	}
+
+	key := db.APIKey{
+		UserID:    req.UserID,
+		Name:      strings.TrimSpace(req.Name),
+		Scopes:    req.Scopes,
+		ExpiresAt: expiresAt,
+	}
+	secret, err := issueAPIKey(&key)
+	if err == nil {
+		err = db.CreateAPIKey(&key)
+	}
+	if errors.Is(err, gorm.ErrForeignKeyViolated) {
+		writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "API key is invalid", FieldError{
+			Field:   "user_id",
+			Code:    "unknown_user",
+			Message: "must be an existing user",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating API key for user %d: %v", req.UserID, err)
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to create API key")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "API key created, it is not shown again",
+		"api_key": key,
+		"key":     secret,
+	})
+}
+
+// ListAPIKeysHandler lists the keys of the caller, or of user_id for admins
+func ListAPIKeysHandler(c *gin.Context) {
+	principal := principalOf(c)
+	userID := principal.UserID
+	if v := c.Query("user_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || id == 0 {
+			writeProblem(c, http.StatusBadRequest, codeInvalidQuery, "Query parameters are invalid", FieldError{
+				Field:   "user_id",
+				Code:    "invalid_id",
+				Message: "must be a positive integer",
+			})
+			return
+		}
+		userID = uint(id)
+	}
+	if userID != principal.UserID && !principal.IsAdmin() {
+		writeProblem(c, http.StatusForbidden, codeForbidden, "Only admins may list the API keys of other users")
+		return
+	}
+
+	keys, err := db.ListAPIKeys(userID)
+	if err != nil {
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve API keys")
+		return
+	}
+	if keys == nil {
+		keys = []db.APIKey{}
+	}
+	c.JSON(http.StatusOK, gin.H{"items": keys})
+}
+
+// RevokeAPIKeyHandler revokes a key immediately
+func RevokeAPIKeyHandler(c *gin.Context) {
+	key, ok := authorizeAPIKey(c)
+	if !ok {
+		return
+	}
+
+	if err := db.RevokeAPIKey(key.ID, time.Now()); err != nil {
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to revoke API key")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+// RotateAPIKeyHandler replaces a key by a new one with the same name, scopes
+// and lifetime. The old key keeps working for the grace period given as a
+// duration in the grace query parameter.
+func RotateAPIKeyHandler(c *gin.Context) {
+	grace := defaultRotationGrace
+	if v := c.Query("grace"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed < 0 || parsed > maxRotationGrace {
+			writeProblem(c, http.StatusBadRequest, codeInvalidQuery, "Query parameters are invalid", FieldError{
+				Field:   "grace",
+				Code:    "out_of_range",
+				Message: fmt.Sprintf("must be a duration between 0s and %s", maxRotationGrace),
+			})
+			return
+		}
+		grace = parsed
+	}
+
+	old, ok := authorizeAPIKey(c)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	lifetime := old.ExpiresAt.Sub(old.CreatedAt)
+	if lifetime <= 0 || lifetime > maxAPIKeyLifetime {
+		lifetime = defaultAPIKeyLifetime
+	}
+	key := db.APIKey{
+		UserID:    old.UserID,
+		Name:      old.Name,
+		Scopes:    old.Scopes,
+		ExpiresAt: now.Add(lifetime),
+	}
+	secret, err := issueAPIKey(&key)
+	if err == nil {
+		err = db.RotateAPIKey(old.ID, &key, now.Add(grace))
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(c, http.StatusConflict, codeConflict, "Only active API keys can be rotated")
+		return
+	}
+	if err != nil {
+		log.Printf("Error rotating API key %d: %v", old.ID, err)
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to rotate API key")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "API key rotated, it is not shown again",
+		"api_key": key,
+		"key":     secret,
+	})
+}
+
+// validateAPIKey checks a new key. Callers cannot grant scopes they do not
+// have, so an API key can never create a more powerful one.
+func validateAPIKey(principal *auth.Principal, req createAPIKeyRequest, expiresAt, now time.Time) []FieldError {
+	var errs []FieldError
+
+	name := strings.TrimSpace(req.Name)
+	switch {
+	case name == "":
+		errs = append(errs, FieldError{Field: "name", Code: "required", Message: "must not be empty"})
+	case len(name) > maxAPIKeyNameLength:
+		errs = append(errs, FieldError{Field: "name", Code: "too_long", Message: fmt.Sprintf("must be at most %d characters", maxAPIKeyNameLength)})
+	}
+
+	if len(req.Scopes) == 0 {
+		errs = append(errs, FieldError{Field: "scopes", Code: "required", Message: "must contain at least one scope"})
+	}
+	for i, scope := range req.Scopes {
+		field := fmt.Sprintf("scopes[%d]", i)
+		switch {
+		case !slices.Contains(auth.Scopes, scope):
+			errs = append(errs, FieldError{Field: field, Code: "invalid_value", Message: "must be one of " + strings.Join(auth.Scopes, ", ")})
+		case slices.Contains(req.Scopes[:i], scope):
+			errs = append(errs, FieldError{Field: field, Code: "duplicate", Message: "is listed twice"})
+		case !principal.HasScope(scope):
+			errs = append(errs, FieldError{Field: field, Code: "not_granted", Message: "is not granted to the caller"})
+		}
+	}
+
+	if !expiresAt.After(now) || expiresAt.After(now.Add(maxAPIKeyLifetime)) {
+		errs = append(errs, FieldError{Field: "expires_at", Code: "out_of_range", Message: "must be in the future and within a year"})
+	}
+
+	return errs
+}
+
+// issueAPIKey generates the secret of a key and stores its hash on it
+func issueAPIKey(key *db.APIKey) (string, error) {
+	secret, keyID, hash, err := auth.NewAPIKey()
+	if err != nil {
+		return "", err
+	}
+	key.KeyID = keyID
+	key.KeyHash = hash
+	return secret, nil
+}
+
+// authorizeAPIKey loads the key of the :id path parameter and writes a
+// problem response when it does not exist or belongs to another user
+func authorizeAPIKey(c *gin.Context) (db.APIKey, bool) {
+	id, ok := parseID(c)
+	if !ok {
+		return db.APIKey{}, false
+	}
+
+	key, err := db.GetAPIKey(id)
+	principal := principalOf(c)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		writeProblem(c, http.StatusNotFound, codeNotFound, "API key not found")
+		return key, false
+	case err != nil:
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve API key")
+		return key, false
+	case key.UserID != principal.UserID && !principal.IsAdmin():
+		writeProblem(c, http.StatusForbidden, codeForbidden, "Only the owner of the API key or an admin may change it")
+		return key, false
+	case principal.APIKeyID != 0 && slices.ContainsFunc(key.Scopes, func(scope string) bool { return !principal.HasScope(scope) }):
+		// Otherwise a key could rotate a stronger one and receive its secret
+		writeProblem(c, http.StatusForbidden, codeForbidden, "API keys may only change keys with no more scopes than their own")
+		return key, false
+	}
+	return key, true
+}
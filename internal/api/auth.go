@@ -0,0 +1,176 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/auth"
+	"github.com/mohammadshaad/zocket/internal/db"
+	"gorm.io/gorm"
+)
+
+// principalKey is the gin context key of the authenticated caller
+const principalKey = "principal"
+
+// apiKeyTouchInterval is how often the last use of an API key is recorded
+const apiKeyTouchInterval = time.Minute
+
+var tokenVerifier *auth.Verifier
+
+var (
+	// errForbidden is returned from transactions when the caller may not
+	// modify the product
+	errForbidden = errors.New("caller does not own the product")
+	// errInvalidAPIKey is returned for unknown, expired and revoked keys
+	errInvalidAPIKey = errors.New("invalid API key")
+)
+
+// InitAuth sets the verifier of bearer tokens. Without one bearer tokens are
+// rejected, API keys keep working.
+func InitAuth(verifier *auth.Verifier) {
+	tokenVerifier = verifier
+}
+
+// RequireAuth rejects requests without a valid bearer token or API key and
+// stores the caller for the handlers
+func RequireAuth(c *gin.Context) {
+	if c.GetHeader("Authorization") == "" {
+		c.Header("WWW-Authenticate", "Bearer, ApiKey")
+		writeProblem(c, http.StatusUnauthorized, codeUnauthorized, "A bearer token or API key is required")
+		return
+	}
+	if authenticate(c) {
+		c.Next()
+	}
+}
+
+// OptionalAuth lets anonymous requests through, but callers that send
+// credentials must send valid ones with the products:read scope
+func OptionalAuth(c *gin.Context) {
+	if c.GetHeader("Authorization") == "" {
+		c.Next()
+		return
+	}
+	if authenticate(c) && requireScope(c, auth.ScopeProductsRead) {
+		c.Next()
+	}
+}
+
+// RequireScope rejects callers that were not granted the scope. It must run
+// after RequireAuth.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if requireScope(c, scope) {
+			c.Next()
+		}
+	}
+}
+
+func requireScope(c *gin.Context, scope string) bool {
+	if principalOf(c).HasScope(scope) {
+		return true
+	}
+	writeProblem(c, http.StatusForbidden, codeForbidden, "The credentials lack the "+scope+" scope")
+	return false
+}
+
+// authenticate verifies the Authorization header and stores the caller, or
+// writes a problem response
+func authenticate(c *gin.Context) bool {
+	scheme, credentials, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+	credentials = strings.TrimSpace(credentials)
+
+	var principal *auth.Principal
+	var err error
+	switch {
+	case strings.EqualFold(scheme, "Bearer") && credentials != "":
+		if tokenVerifier == nil {
+			c.Header("WWW-Authenticate", "ApiKey")
+			writeProblem(c, http.StatusUnauthorized, codeUnauthorized, "Bearer tokens are not accepted, use an API key")
+			return false
+		}
+		principal, err = tokenVerifier.Verify(credentials)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeProblem(c, http.StatusUnauthorized, codeUnauthorized, "The bearer token is invalid or expired")
+			return false
+		}
+	case strings.EqualFold(scheme, "ApiKey") && credentials != "":
+		principal, err = verifyAPIKey(credentials)
+		if errors.Is(err, errInvalidAPIKey) {
+			c.Header("WWW-Authenticate", "ApiKey")
+			writeProblem(c, http.StatusUnauthorized, codeUnauthorized, "The API key is invalid, expired or revoked")
+			return false
+		}
+		if err != nil {
+			log.Printf("Error verifying API key: %v", err)
+			writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to verify API key")
+			return false
+		}
+	default:
+		c.Header("WWW-Authenticate", "Bearer, ApiKey")
+		writeProblem(c, http.StatusUnauthorized, codeUnauthorized, "Authorization must be a bearer token or an API key")
+		return false
+	}
+
+	c.Set(principalKey, principal)
+	return true
+}
+
+// verifyAPIKey looks the key up by its hash and returns the caller it was
+// issued to
+func verifyAPIKey(value string) (*auth.Principal, error) {
+	if !auth.LooksLikeAPIKey(value) {
+		return nil, errInvalidAPIKey
+	}
+	key, err := db.FindAPIKeyByHash(auth.HashAPIKey(value))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !key.Active(now) {
+		return nil, errInvalidAPIKey
+	}
+
+	if err := db.TouchAPIKey(key.ID, now, apiKeyTouchInterval); err != nil {
+		log.Printf("Error recording use of API key %d: %v", key.ID, err)
+	}
+	return &auth.Principal{UserID: key.UserID, Scopes: key.Scopes, APIKeyID: key.ID}, nil
+}
+
+// principalOf returns the caller authenticated by RequireAuth
+func principalOf(c *gin.Context) *auth.Principal {
+	principal, _ := c.MustGet(principalKey).(*auth.Principal)
+	return principal
+}
+
+// writeForbidden answers requests on products of another seller
+func writeForbidden(c *gin.Context) {
+	writeProblem(c, http.StatusForbidden, codeForbidden, "Only the seller of the product or an admin may modify it")
+}
+
+// authorizeProduct writes a problem response when the product does not
+// exist or the caller may not modify it
+func authorizeProduct(c *gin.Context, productID uint) bool {
+	var product db.Product
+	err := db.DB.Select("id", "user_id").Take(&product, productID).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		writeProblem(c, http.StatusNotFound, codeNotFound, "Product not found")
+		return false
+	case err != nil:
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve product")
+		return false
+	case !principalOf(c).CanModify(product.UserID):
+		writeForbidden(c)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mohammadshaad/zocket/internal/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const secret = "0123456789abcdef0123456789abcdef"
+	verifier, err := auth.NewVerifier(auth.Config{Algorithm: auth.AlgorithmHS256, Secret: secret})
+	require.NoError(t, err)
+	previous := tokenVerifier
+	InitAuth(verifier)
+	defer InitAuth(previous)
+
+	router := gin.New()
+	router.POST("/", RequireAuth, func(c *gin.Context) {
+		c.String(http.StatusOK, strconv.FormatUint(uint64(principalOf(c).UserID), 10))
+	})
+	send := func(authorization string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer, ApiKey", w.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, problemContentType, w.Header().Get("Content-Type"))
+
+	w = send("Basic dXNlcjpwYXNz")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = send("Bearer not-a-token")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "invalid_token")
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   "5",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}).SignedString([]byte(secret))
+	w = send("Bearer " + token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "5", w.Body.String())
+
+	// Without JWT keys only API keys are accepted
+	InitAuth(nil)
+	w = send("Bearer " + token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "ApiKey", w.Header().Get("WWW-Authenticate"))
+}
+
+func TestRequireScopeAndValidateAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	reader := &auth.Principal{UserID: 3, Scopes: []string{auth.ScopeProductsRead}}
+
+	router := gin.New()
+	router.POST("/", func(c *gin.Context) { c.Set(principalKey, reader) }, RequireScope(auth.ScopeProductsWrite), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	now := time.Now()
+	valid := createAPIKeyRequest{Name: "catalog sync", Scopes: []string{auth.ScopeProductsRead}}
+	assert.Empty(t, validateAPIKey(reader, valid, now.Add(time.Hour), now))
+
+	invalid := createAPIKeyRequest{Scopes: []string{auth.ScopeProductsRead, "products:delete", auth.ScopeProductsRead, auth.ScopeAdmin}}
+	errs := validateAPIKey(reader, invalid, now.Add(2*maxAPIKeyLifetime), now)
+	assert.Equal(t, []string{"name", "scopes[1]", "scopes[2]", "scopes[3]", "expires_at"}, fieldsOf(errs))
+	assert.Equal(t, "not_granted", errs[3].Code)
+}
@@ -2,18 +2,28 @@ package api
 
 import (
     "encoding/json"
+    "errors"
+    "fmt"
     "log"
     "net/http"
     "strconv"
+    "time"
 
     "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
     "github.com/mohammadshaad/zocket/internal/cache"
     "github.com/mohammadshaad/zocket/internal/db"
     "github.com/mohammadshaad/zocket/internal/queue"
+    "github.com/mohammadshaad/zocket/pkg/money"
 )
 
 func GetProductByIDHandler(c *gin.Context) {
-    id := c.Param("id")
+    productID, ok := parseID(c)
+    if !ok {
+        return
+    }
+    id := strconv.FormatUint(uint64(productID), 10)
 
     // Try to get from cache first
     cachedProduct, err := cache.GetProductFromCache(id)
@@ -23,14 +33,19 @@ func GetProductByIDHandler(c *gin.Context) {
 
     if cachedProduct != nil {
         log.Printf("Cache hit for product %s", id)
+        negotiateImages(c, cachedProduct)
         c.JSON(http.StatusOK, cachedProduct)
         return
     }
 
     // If not in cache, get from database
     var product db.Product
-    if err := db.DB.First(&product, id).Error; err != nil {
-        c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+    if err := db.DB.First(&product, productID).Error; err != nil {
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            writeProblem(c, http.StatusNotFound, codeNotFound, "Product not found")
+        } else {
+            writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve product")
+        }
         return
     }
 
@@ -39,22 +54,52 @@ func GetProductByIDHandler(c *gin.Context) {
         log.Printf("Error setting cache: %v", err)
     }
 
+    negotiateImages(c, &product)
     c.JSON(http.StatusOK, product)
 }
 
 func AddProductHandler(c *gin.Context) {
     var product db.Product
 
-    if err := c.ShouldBindJSON(&product); err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+    if !bindJSON(c, &product) {
+        return
+    }
+
+    // Clients cannot choose server managed fields
+    product.ID = 0
+    product.CreatedAt = time.Time{}
+
+    // Products belong to the caller, only admins may create them for another
+    // seller
+    principal := principalOf(c)
+    if !principal.IsAdmin() || product.UserID == 0 {
+        product.UserID = principal.UserID
+    }
+
+    if errs := validateProduct(&product); len(errs) > 0 {
+        writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "Product is invalid", errs...)
         return
     }
 
     // Initialize CompressedProductImages array
     product.CompressedProductImages = make([]string, len(product.ProductImages))
 
-    if err := db.DB.Create(&product).Error; err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save product"})
+    err := db.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Create(&product).Error; err != nil {
+            return err
+        }
+        return db.CreatePendingImageStatuses(tx, product.ID, product.ProductImages)
+    })
+    if errors.Is(err, gorm.ErrForeignKeyViolated) {
+        writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "Product is invalid", FieldError{
+            Field:   "UserID",
+            Code:    "unknown_user",
+            Message: "must be an existing user",
+        })
+        return
+    }
+    if err != nil {
+        writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to save product")
         return
     }
 
@@ -64,56 +109,340 @@ func AddProductHandler(c *gin.Context) {
     }
 
     // Publish each image to Kafka for processing
-    for _, url := range product.ProductImages {
-        msg := queue.ImageMessage{
-            ProductID: int(product.ID),
-            ImageURL:  url,
+    publishImageMessages(product.ID, product.ProductImages)
+
+    c.JSON(http.StatusOK, gin.H{
+        "message": "Product added successfully",
+        "product": product,
+    })
+}
+
+func GetAllProductsHandler(c *gin.Context) {
+    filter, errs := parseProductFilter(c)
+    if len(errs) > 0 {
+        writeProblem(c, http.StatusBadRequest, codeInvalidQuery, "Query parameters are invalid", errs...)
+        return
+    }
+
+    listProducts(c, filter)
+}
+
+// listProducts writes the page of products selected by the filter
+func listProducts(c *gin.Context, filter productFilter) {
+    query := db.DB.Model(&db.Product{})
+
+    if filter.UserID != 0 {
+        query = query.Where("user_id = ?", filter.UserID)
+    }
+
+    query = applyPriceFilter(query, filter)
+
+    // Share the filters between the estimate and the page query
+    query = query.Session(&gorm.Session{})
+
+    total, err := estimateRows(query)
+    if err != nil {
+        log.Printf("Error estimating product count: %v", err)
+        writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve products")
+        return
+    }
+
+    // Fetch one extra row to know whether there is a next page
+    var products []db.Product
+    if err := applyKeyset(query, filter).Limit(filter.Limit + 1).Find(&products).Error; err != nil {
+        writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve products")
+        return
+    }
+
+    page := ProductPage{Items: products, TotalEstimate: total}
+    if len(products) > filter.Limit {
+        page.Items = products[:filter.Limit]
+        page.NextCursor = encodeCursor(cursorFor(page.Items[filter.Limit-1], filter.Sort, filter.Order))
+    }
+    if page.Items == nil {
+        page.Items = []db.Product{}
+    }
+
+    items := make([]*db.Product, len(page.Items))
+    for i := range page.Items {
+        items[i] = &page.Items[i]
+    }
+    negotiateImages(c, items...)
+    convertPrices(filter.Currency, items...)
+
+    c.JSON(http.StatusOK, page)
+}
+
+// productUpdate holds the fields a client may change on an existing product.
+// PATCH leaves nil fields untouched, PUT resets them to their zero value.
+type productUpdate struct {
+    ProductName        *string
+    ProductDescription *string
+    ProductImages      *[]string
+    ProductPrice       *money.Money
+}
+
+func UpdateProductHandler(c *gin.Context) {
+    productID, ok := parseID(c)
+    if !ok {
+        return
+    }
+    replace := c.Request.Method == http.MethodPut
+    principal := principalOf(c)
+
+    var update productUpdate
+    if !bindJSON(c, &update) {
+        return
+    }
+
+    var product db.Product
+    var added, removed []string
+    err := db.DB.Transaction(func(tx *gorm.DB) error {
+        // Lock the row so the image processor cannot write a stale
+        // CompressedProductImages array over this update
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&product, productID).Error; err != nil {
+            return err
         }
-        
-        msgBytes, err := json.Marshal(msg)
-        if err != nil {
-            log.Printf("Error marshaling image message: %v", err)
-            continue
+        if !principal.CanModify(product.UserID) {
+            return errForbidden
         }
 
-        if err := queue.PublishMessage([]byte(strconv.Itoa(int(product.ID))), msgBytes); err != nil {
-            log.Printf("Failed to enqueue image: %v", err)
-            continue
+        if update.ProductName != nil || replace {
+            product.ProductName = valueOrZero(update.ProductName)
         }
+        if update.ProductDescription != nil || replace {
+            product.ProductDescription = valueOrZero(update.ProductDescription)
+        }
+        if update.ProductPrice != nil || replace {
+            product.ProductPrice = valueOrZero(update.ProductPrice)
+        }
+        if update.ProductImages != nil || replace {
+            added, removed = reconcileImages(&product, valueOrZero(update.ProductImages))
+        }
+
+        if errs := validateProduct(&product); len(errs) > 0 {
+            return &validationError{errs: errs}
+        }
+
+        if err := tx.Save(&product).Error; err != nil {
+            return err
+        }
+        if err := db.DeleteImageStatuses(tx, product.ID, removed); err != nil {
+            return err
+        }
+        if err := db.DeleteImageHashes(tx, product.ID, removed); err != nil {
+            return err
+        }
+        if err := db.DeleteBlobReferences(tx, product.ID, removed); err != nil {
+            return err
+        }
+        return db.CreatePendingImageStatuses(tx, product.ID, added)
+    })
+    var invalid *validationError
+    switch {
+    case errors.Is(err, gorm.ErrRecordNotFound):
+        writeProblem(c, http.StatusNotFound, codeNotFound, "Product not found")
+        return
+    case errors.Is(err, errForbidden):
+        writeForbidden(c)
+        return
+    case errors.As(err, &invalid):
+        writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "Product is invalid", invalid.errs...)
+        return
+    case err != nil:
+        writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to update product")
+        return
+    }
+
+    if err := cache.InvalidateProductCache(strconv.FormatUint(uint64(productID), 10)); err != nil {
+        log.Printf("Error invalidating cache for product %d: %v", productID, err)
     }
 
+    // Only images that were not part of the product before need processing
+    publishImageMessages(product.ID, added)
+
     c.JSON(http.StatusOK, gin.H{
-        "message": "Product added successfully",
+        "message": "Product updated successfully",
         "product": product,
     })
 }
 
-func GetAllProductsHandler(c *gin.Context) {
-    userID := c.Query("user_id")
-    minPrice := c.Query("min_price")
-    maxPrice := c.Query("max_price")
+func DeleteProductHandler(c *gin.Context) {
+    productID, ok := parseID(c)
+    if !ok {
+        return
+    }
 
-    var products []db.Product
-    query := db.DB
+    principal := principalOf(c)
+    err := db.DB.Transaction(func(tx *gorm.DB) error {
+        var product db.Product
+        if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "user_id").First(&product, productID).Error; err != nil {
+            return err
+        }
+        if !principal.CanModify(product.UserID) {
+            return errForbidden
+        }
 
-    if userID != "" {
-        query = query.Where("user_id = ?", userID)
+        if err := tx.Delete(&db.Product{}, productID).Error; err != nil {
+            return err
+        }
+        if err := db.DeleteImageStatuses(tx, productID, nil); err != nil {
+            return err
+        }
+        if err := db.DeleteImageHashes(tx, productID, nil); err != nil {
+            return err
+        }
+        return db.DeleteBlobReferences(tx, productID, nil)
+    })
+    if errors.Is(err, gorm.ErrRecordNotFound) {
+        writeProblem(c, http.StatusNotFound, codeNotFound, "Product not found")
+        return
+    }
+    if errors.Is(err, errForbidden) {
+        writeForbidden(c)
+        return
+    }
+    if err != nil {
+        writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to delete product")
+        return
     }
 
-    if minPrice != "" {
-        min, _ := strconv.ParseFloat(minPrice, 64)
-        query = query.Where("product_price >= ?", min)
+    if err := cache.InvalidateProductCache(strconv.FormatUint(uint64(productID), 10)); err != nil {
+        log.Printf("Error invalidating cache for product %d: %v", productID, err)
     }
 
-    if maxPrice != "" {
-        max, _ := strconv.ParseFloat(maxPrice, 64)
-        query = query.Where("product_price <= ?", max)
+    c.JSON(http.StatusOK, gin.H{"message": "Product deleted successfully"})
+}
+
+// reconcileImages replaces the product images with the given list. Compressed
+// URLs of images that are kept stay aligned with their original, compressed
+// URLs and renditions of removed images are dropped, and the added and
+// removed URLs are returned.
+func reconcileImages(product *db.Product, images []string) (added, removed []string) {
+    compressed := make(map[string]string, len(product.ProductImages))
+    for i, url := range product.ProductImages {
+        if i < len(product.CompressedProductImages) {
+            compressed[url] = product.CompressedProductImages[i]
+        } else {
+            compressed[url] = ""
+        }
+    }
+
+    seen := make(map[string]bool, len(images))
+    newCompressed := make([]string, len(images))
+    for i, url := range images {
+        existing, ok := compressed[url]
+        newCompressed[i] = existing
+        if !ok && !seen[url] {
+            added = append(added, url)
+        }
+        seen[url] = true
+    }
+
+    for url := range compressed {
+        if !seen[url] {
+            removed = append(removed, url)
+        }
+    }
+
+    renditions := db.RenditionList{}
+    for _, entry := range product.ImageRenditions {
+        if seen[entry.SourceURL] {
+            renditions = append(renditions, entry)
+        }
     }
 
-    if err := query.Find(&products).Error; err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve products"})
+    product.ProductImages = images
+    product.CompressedProductImages = newCompressed
+    product.ImageRenditions = renditions
+    return added, removed
+}
+
+// publishImageMessages enqueues one image processing message per URL
+func publishImageMessages(productID uint, urls []string) {
+    for _, url := range urls {
+        publishImageMessage(queue.ImageMessage{
+            ProductID: int(productID),
+            ImageURL:  url,
+        })
+    }
+}
+
+// publishImageMessage enqueues a single image, marking it as failed when
+// Kafka rejects the message
+func publishImageMessage(msg queue.ImageMessage) {
+    productID := uint(msg.ProductID)
+    msgBytes, err := json.Marshal(msg)
+    if err != nil {
+        log.Printf("Error marshaling image message: %v", err)
+        return
+    }
+
+    // Key by image so the images of one product are processed in parallel
+    key := fmt.Sprintf("%d:%s", productID, msg.ImageURL)
+    if err := queue.PublishMessage([]byte(key), msgBytes); err != nil {
+        log.Printf("Failed to enqueue image: %v", err)
+        if err := db.MarkImageFailed(productID, msg.ImageURL, fmt.Errorf("failed to enqueue image: %w", err)); err != nil {
+            log.Printf("Error updating image status: %v", err)
+        }
+    }
+}
+
+func valueOrZero[T any](v *T) T {
+    var zero T
+    if v == nil {
+        return zero
+    }
+    return *v
+}
+
+// ProductImagesResponse reports the processing state of every product image
+type ProductImagesResponse struct {
+    ProductID uint             `json:"product_id"`
+    Images    []db.ImageStatus `json:"images"`
+}
+
+func GetProductImagesHandler(c *gin.Context) {
+    productID, ok := parseID(c)
+    if !ok {
         return
     }
 
-    c.JSON(http.StatusOK, products)
-}
\ No newline at end of file
+    var product db.Product
+    if err := db.DB.First(&product, productID).Error; err != nil {
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            writeProblem(c, http.StatusNotFound, codeNotFound, "Product not found")
+        } else {
+            writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve product")
+        }
+        return
+    }
+
+    statuses, err := db.GetImageStatuses(productID)
+    if err != nil {
+        writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve image statuses")
+        return
+    }
+
+    byURL := make(map[string]db.ImageStatus, len(statuses))
+    for _, status := range statuses {
+        byURL[status.ImageURL] = status
+    }
+
+    // Report images in product order. Images enqueued before status tracking
+    // existed have no record, so derive their state from the compressed URL.
+    images := make([]db.ImageStatus, 0, len(product.ProductImages))
+    for i, url := range product.ProductImages {
+        status, ok := byURL[url]
+        if !ok {
+            status = db.ImageStatus{ProductID: productID, ImageURL: url, Status: db.ImageStatusPending}
+            if i < len(product.CompressedProductImages) && product.CompressedProductImages[i] != "" {
+                status.Status = db.ImageStatusDone
+                status.CompressedURL = product.CompressedProductImages[i]
+            }
+        }
+        images = append(images, status)
+    }
+
+    c.JSON(http.StatusOK, ProductImagesResponse{ProductID: productID, Images: images})
+}
@@ -2,20 +2,29 @@ package api_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
 	"net/http"
 	"strconv"
 	"net/http/httptest"
 	"os"
 	"testing"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/mohammadshaad/zocket/tests/testutils"
+	"github.com/mohammadshaad/zocket/internal/api"
 	"github.com/mohammadshaad/zocket/internal/db"
 	"github.com/mohammadshaad/zocket/internal/cache"
 	"github.com/mohammadshaad/zocket/internal/queue"
 	"github.com/mohammadshaad/zocket/config"
+	"github.com/mohammadshaad/zocket/pkg/storage"
+	"github.com/mohammadshaad/zocket/pkg/util"
 	"github.com/joho/godotenv"
 )
 
@@ -23,7 +32,7 @@ func setup() {
 	loadEnv()
 	config.LoadConfig()
 	db.InitDatabase()
-	initSchema()
+	testutils.InitTestSchema()
 	initCache()
 	initQueue()
 }
@@ -46,20 +55,6 @@ func printEnvVariables() {
 	log.Printf("REDIS_USERNAME: %s", os.Getenv("REDIS_USERNAME"))
 }
 
-func initSchema() {
-	// Create the products table
-	db.DB.Exec(`CREATE TABLE IF NOT EXISTS products (
-		id SERIAL PRIMARY KEY,
-		user_id INT,
-		product_name TEXT,
-		product_description TEXT,
-		product_images TEXT[],
-		compressed_product_images TEXT[],
-		product_price FLOAT,
-		created_at TIMESTAMP
-	)`)
-}
-
 func initCache() {
 	REDIS_ADDR := os.Getenv("REDIS_ADDR")
 	REDIS_PASSWORD := os.Getenv("REDIS_PASSWORD")
@@ -84,6 +79,7 @@ func TestAddProduct(t *testing.T) {
 	
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/api/v1/products", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", testutils.AuthHeader(testutils.TestProduct.UserID))
 	req.Header.Set("Content-Type", "application/json")
 	
 	router.ServeHTTP(w, req)
@@ -101,7 +97,8 @@ func TestAddProduct(t *testing.T) {
 		log.Printf("Key: %s, Value: %v", key, product[key])
 	}
 	assert.Equal(t, testutils.TestProduct.ProductName, product["ProductName"].(string))
-	assert.Equal(t, testutils.TestProduct.ProductPrice, product["ProductPrice"].(float64))
+	assert.Equal(t, map[string]interface{}{"amount": "69.69", "currency": "USD"}, product["ProductPrice"])
+	assert.Equal(t, float64(testutils.TestProduct.UserID), product["UserID"])
 }
 
 func TestGetProductByID(t *testing.T) {
@@ -122,4 +119,384 @@ func TestGetProductByID(t *testing.T) {
 	err := json.Unmarshal(w.Body.Bytes(), &response)
 	assert.NoError(t, err)
 	assert.Equal(t, testutils.TestProduct.ProductName, response.ProductName)
-}
\ No newline at end of file
+}
+func TestUpdateProduct(t *testing.T) {
+	setup()
+	router := testutils.SetupTestRouter()
+
+	product := testutils.TestProduct
+	product.ID = 0
+	product.CompressedProductImages = []string{"https://example.com/compressed.jpeg"}
+	db.DB.Create(&product)
+
+	newImage := "https://example.com/new-image.jpeg"
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"ProductName":   "Updated Product",
+		"ProductImages": []string{product.ProductImages[0], newImage},
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PATCH", "/api/v1/products/"+strconv.Itoa(int(product.ID)), bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", testutils.AuthHeader(testutils.TestProduct.UserID))
+	req.Header.Set("Content-Type", "application/json")
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var updated db.Product
+	err := db.DB.First(&updated, product.ID).Error
+	assert.NoError(t, err)
+	assert.Equal(t, "Updated Product", updated.ProductName)
+	assert.Equal(t, product.ProductDescription, updated.ProductDescription)
+	assert.Equal(t, []string{product.ProductImages[0], newImage}, []string(updated.ProductImages))
+	assert.Equal(t, []string{"https://example.com/compressed.jpeg", ""}, []string(updated.CompressedProductImages))
+}
+
+func TestDeleteProduct(t *testing.T) {
+	setup()
+	router := testutils.SetupTestRouter()
+
+	product := testutils.TestProduct
+	product.ID = 0
+	db.DB.Create(&product)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/api/v1/products/"+strconv.Itoa(int(product.ID)), nil)
+	req.Header.Set("Authorization", testutils.AuthHeader(testutils.TestProduct.UserID))
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/products/"+strconv.Itoa(int(product.ID)), nil)
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestProductOwnership(t *testing.T) {
+	setup()
+	router := testutils.SetupTestRouter()
+
+	product := testutils.TestProduct
+	product.ID = 0
+	db.DB.Create(&product)
+	path := "/api/v1/products/" + strconv.Itoa(int(product.ID))
+
+	renamed := map[string]interface{}{"ProductName": "Renamed"}
+
+	assert.Equal(t, http.StatusUnauthorized, testutils.DoRequest(t, router, "PATCH", path, "", renamed).Code)
+	assert.Equal(t, http.StatusUnauthorized, testutils.DoRequest(t, router, "PATCH", path, "Bearer not-a-token", renamed).Code)
+	assert.Equal(t, http.StatusForbidden, testutils.DoRequest(t, router, "PATCH", path, testutils.AuthHeader(product.UserID+1), renamed).Code)
+	assert.Equal(t, http.StatusForbidden, testutils.DoRequest(t, router, "DELETE", path, testutils.AuthHeader(product.UserID+1), nil).Code)
+	assert.Equal(t, http.StatusOK, testutils.DoRequest(t, router, "PATCH", path, testutils.AuthHeader(product.UserID+1, "admin"), renamed).Code)
+	assert.Equal(t, http.StatusOK, testutils.DoRequest(t, router, "DELETE", path, testutils.AuthHeader(product.UserID), nil).Code)
+}
+
+func TestAPIKeys(t *testing.T) {
+	setup()
+	router := testutils.SetupTestRouter()
+
+	user := db.User{Name: "Sync", Email: "sync-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "@example.com"}
+	db.DB.Create(&user)
+
+	w := testutils.DoRequest(t, router, "POST", "/api/v1/api-keys", testutils.AuthHeader(user.ID), map[string]interface{}{
+		"name":   "catalog sync",
+		"scopes": []string{"products:read", "products:write"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var created struct {
+		APIKey db.APIKey `json:"api_key"`
+		Key    string    `json:"key"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.NotContains(t, w.Body.String(), created.APIKey.KeyHash)
+
+	// The key acts as its user
+	product := testutils.TestProduct
+	w = testutils.DoRequest(t, router, "POST", "/api/v1/products", "ApiKey "+created.Key, product)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Rotation issues a new key, the old one works during the grace period
+	w = testutils.DoRequest(t, router, "POST", "/api/v1/api-keys/"+strconv.Itoa(int(created.APIKey.ID))+"/rotate?grace=0s", testutils.AuthHeader(user.ID), nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var rotated struct {
+		APIKey db.APIKey `json:"api_key"`
+		Key    string    `json:"key"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &rotated))
+	assert.Equal(t, http.StatusUnauthorized, testutils.DoRequest(t, router, "GET", "/api/v1/products", "ApiKey "+created.Key, nil).Code)
+	assert.Equal(t, http.StatusOK, testutils.DoRequest(t, router, "GET", "/api/v1/products", "ApiKey "+rotated.Key, nil).Code)
+
+	w = testutils.DoRequest(t, router, "DELETE", "/api/v1/api-keys/"+strconv.Itoa(int(rotated.APIKey.ID)), testutils.AuthHeader(user.ID+1), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// A read-only key can neither take over nor revoke a key with write access
+	w = testutils.DoRequest(t, router, "POST", "/api/v1/api-keys", testutils.AuthHeader(user.ID), map[string]interface{}{
+		"name":   "catalog reader",
+		"scopes": []string{"products:read"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reader struct {
+		Key string `json:"key"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &reader))
+	w = testutils.DoRequest(t, router, "POST", "/api/v1/api-keys/"+strconv.Itoa(int(rotated.APIKey.ID))+"/rotate", "ApiKey "+reader.Key, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.NotContains(t, w.Body.String(), `"key"`)
+	w = testutils.DoRequest(t, router, "DELETE", "/api/v1/api-keys/"+strconv.Itoa(int(rotated.APIKey.ID)), "ApiKey "+reader.Key, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, http.StatusOK, testutils.DoRequest(t, router, "GET", "/api/v1/products", "ApiKey "+rotated.Key, nil).Code)
+
+	w = testutils.DoRequest(t, router, "DELETE", "/api/v1/api-keys/"+strconv.Itoa(int(rotated.APIKey.ID)), "ApiKey "+rotated.Key, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, testutils.DoRequest(t, router, "GET", "/api/v1/products", "ApiKey "+rotated.Key, nil).Code)
+
+	var keys []db.APIKey
+	db.DB.Where("user_id = ?", user.ID).Find(&keys)
+	assert.Len(t, keys, 3)
+}
+
+func TestUsers(t *testing.T) {
+	setup()
+	router := testutils.SetupTestRouter()
+	admin := testutils.AuthHeader(testutils.TestUser.ID, "admin")
+
+	email := "user-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "@example.com"
+	assert.Equal(t, http.StatusForbidden, testutils.DoRequest(t, router, "POST", "/api/v1/users", testutils.AuthHeader(testutils.TestUser.ID), map[string]string{"Name": "Ada", "Email": email}).Code)
+
+	w := testutils.DoRequest(t, router, "POST", "/api/v1/users", admin, map[string]string{"Name": "Ada", "Email": email})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var created struct {
+		User db.User `json:"user"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	path := "/api/v1/users/" + strconv.Itoa(int(created.User.ID))
+
+	// Emails are unique regardless of case
+	w = testutils.DoRequest(t, router, "POST", "/api/v1/users", admin, map[string]string{"Name": "Ada again", "Email": strings.ToUpper(email)})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// Users can read and change themselves but not others
+	self := testutils.AuthHeader(created.User.ID)
+	assert.Equal(t, http.StatusOK, testutils.DoRequest(t, router, "GET", path, self, nil).Code)
+	assert.Equal(t, http.StatusForbidden, testutils.DoRequest(t, router, "GET", "/api/v1/users/"+strconv.Itoa(int(testutils.TestUser.ID)), self, nil).Code)
+	assert.Equal(t, http.StatusConflict, testutils.DoRequest(t, router, "PATCH", path, self, map[string]string{"Email": testutils.TestUser.Email}).Code)
+	assert.Equal(t, http.StatusOK, testutils.DoRequest(t, router, "PATCH", path, self, map[string]string{"Name": "Ada L."}).Code)
+
+	// Changing the account needs users:write, which a read-only key lacks
+	w = testutils.DoRequest(t, router, "POST", "/api/v1/api-keys", self, map[string]interface{}{
+		"name":   "catalog reader",
+		"scopes": []string{"products:read"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reader struct {
+		Key string `json:"key"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &reader))
+	assert.Equal(t, http.StatusForbidden, testutils.DoRequest(t, router, "PATCH", path, "ApiKey "+reader.Key, map[string]string{"Email": "taken-over@example.com"}).Code)
+	assert.Equal(t, http.StatusForbidden, testutils.DoRequest(t, router, "PUT", path, "ApiKey "+reader.Key, map[string]string{"Name": "Eve", "Email": "taken-over@example.com"}).Code)
+
+	// Products cannot outlive their seller
+	w = testutils.DoRequest(t, router, "POST", "/api/v1/products", self, testutils.TestProduct)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = testutils.DoRequest(t, router, "GET", path+"/products", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var page api.ProductPage
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Len(t, page.Items, 1)
+	assert.Equal(t, http.StatusConflict, testutils.DoRequest(t, router, "DELETE", path, admin, nil).Code)
+
+	assert.Equal(t, http.StatusOK, testutils.DoRequest(t, router, "DELETE", "/api/v1/products/"+strconv.Itoa(int(page.Items[0].ID)), self, nil).Code)
+	assert.Equal(t, http.StatusOK, testutils.DoRequest(t, router, "DELETE", path, admin, nil).Code)
+	assert.Equal(t, http.StatusNotFound, testutils.DoRequest(t, router, "GET", path+"/products", "", nil).Code)
+
+	// Products of unknown sellers are rejected
+	w = testutils.DoRequest(t, router, "POST", "/api/v1/products", testutils.AuthHeader(created.User.ID), testutils.TestProduct)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestAddProductValidation(t *testing.T) {
+	setup()
+	router := testutils.SetupTestRouter()
+
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"ProductName":   "",
+		"ProductPrice":  0,
+		"ProductImages": []string{"not-a-url"},
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/products", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", testutils.AuthHeader(testutils.TestProduct.UserID))
+	req.Header.Set("Content-Type", "application/json")
+
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+
+	var problem api.Problem
+	err := json.Unmarshal(w.Body.Bytes(), &problem)
+	assert.NoError(t, err)
+	assert.Equal(t, "validation_failed", problem.Code)
+	assert.Len(t, problem.Errors, 3)
+}
+
+func TestGetProductImages(t *testing.T) {
+	setup()
+	router := testutils.SetupTestRouter()
+
+	jsonData, _ := json.Marshal(testutils.TestProduct)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/products", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", testutils.AuthHeader(testutils.TestProduct.UserID))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	var created struct {
+		Product db.Product `json:"product"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &created)
+	assert.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/products/"+strconv.Itoa(int(created.Product.ID))+"/images", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response api.ProductImagesResponse
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Len(t, response.Images, len(testutils.TestProduct.ProductImages))
+	assert.Equal(t, testutils.TestProduct.ProductImages[0], response.Images[0].ImageURL)
+	assert.Contains(t, []string{db.ImageStatusPending, db.ImageStatusProcessing, db.ImageStatusDone}, response.Images[0].Status)
+}
+
+func TestUploadProductImages(t *testing.T) {
+	setup()
+	router := testutils.SetupTestRouter()
+	store := storage.NewMemoryStore("https://cdn.example.com")
+	api.InitImageUploads(store, util.DefaultDownloadConfig())
+
+	product := testutils.TestProduct
+	product.ID = 0
+	db.DB.Create(&product)
+
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)))
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("image", "photo.png")
+	part.Write(img.Bytes())
+	form.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/products/"+strconv.Itoa(int(product.ID))+"/images", &body)
+	req.Header.Set("Authorization", testutils.AuthHeader(testutils.TestProduct.UserID))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var updated db.Product
+	err := db.DB.First(&updated, product.ID).Error
+	assert.NoError(t, err)
+	assert.Len(t, updated.ProductImages, len(product.ProductImages)+1)
+	uploaded := updated.ProductImages[len(updated.ProductImages)-1]
+	key, ok := storage.KeyFromURL(store, uploaded)
+	assert.True(t, ok)
+	exists, _ := store.Exists(context.Background(), key)
+	assert.True(t, exists)
+
+	// Files that are not images are rejected and not stored
+	body.Reset()
+	form = multipart.NewWriter(&body)
+	part, _ = form.CreateFormFile("image", "page.png")
+	part.Write([]byte("<html>not an image</html>"))
+	form.Close()
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/products/"+strconv.Itoa(int(product.ID))+"/images", &body)
+	req.Header.Set("Authorization", testutils.AuthHeader(testutils.TestProduct.UserID))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// The memory store cannot presign uploads
+	jsonData, _ := json.Marshal(map[string]interface{}{"content_type": "image/png", "content_length": 1024})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/products/"+strconv.Itoa(int(product.ID))+"/images/presign", bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", testutils.AuthHeader(testutils.TestProduct.UserID))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestGetSimilarProducts(t *testing.T) {
+	setup()
+	router := testutils.SetupTestRouter()
+
+	original := testutils.TestProduct
+	original.ID = 0
+	db.DB.Create(&original)
+	copied := testutils.TestProduct
+	copied.ID = 0
+	db.DB.Create(&copied)
+	unrelated := testutils.TestProduct
+	unrelated.ID = 0
+	db.DB.Create(&unrelated)
+
+	hash := uint64(0xf0f0f0f0f0f0f0f0)
+	assert.NoError(t, db.SaveImageHash(original.ID, original.ProductImages[0], hash))
+	assert.NoError(t, db.SaveImageHash(copied.ID, copied.ProductImages[0], hash^0b101))
+	assert.NoError(t, db.SaveImageHash(unrelated.ID, unrelated.ProductImages[0], ^hash))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/products/"+strconv.Itoa(int(original.ID))+"/similar?max_distance=4", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response api.SimilarProductsResponse
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	ids := make(map[uint]int)
+	for _, item := range response.Items {
+		ids[item.Product.ID] = item.Distance
+	}
+	assert.Equal(t, 2, ids[copied.ID])
+	assert.NotContains(t, ids, unrelated.ID)
+}
+
+func TestProcessImageOfRemovedImage(t *testing.T) {
+	setup()
+
+	product := testutils.TestProduct
+	product.ID = 0
+	db.DB.Create(&product)
+	message := func(url string) []byte {
+		data, _ := json.Marshal(queue.ImageMessage{ProductID: int(product.ID), ImageURL: url})
+		return data
+	}
+
+	// Images removed from the product are not processed or tracked again
+	err := queue.ProcessImageMessage(context.Background(), nil, message("https://example.com/removed.jpg"))
+	assert.ErrorIs(t, err, db.ErrImageGone)
+
+	db.DB.Delete(&db.Product{}, product.ID)
+	err = queue.ProcessImageMessage(context.Background(), nil, message(product.ProductImages[0]))
+	assert.ErrorIs(t, err, db.ErrImageGone)
+
+	statuses, err := db.GetImageStatuses(product.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, statuses)
+}
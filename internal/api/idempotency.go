@@ -0,0 +1,151 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/cache"
+)
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+	// idempotencyLock bounds how long a crashed request keeps its key busy
+	idempotencyLock = time.Minute
+)
+
+// idempotencyTTL is how long responses are replayed to retries
+var idempotencyTTL = 24 * time.Hour
+
+// Idempotency records, replaced in tests
+var (
+	reserveIdempotencyKey  = cache.ReserveIdempotencyKey
+	saveIdempotentResponse = cache.SaveIdempotentResponse
+	releaseIdempotencyKey  = cache.ReleaseIdempotencyKey
+)
+
+// InitIdempotency sets how long responses are replayed to retries
+func InitIdempotency(ttl time.Duration) {
+	idempotencyTTL = ttl
+}
+
+// Idempotency makes retries of a request sent with an Idempotency-Key header
+// safe. It must run after RequireAuth. The first response is stored in Redis
+// per user and key and replayed to retries with the same body, retries with another body are
+// rejected. Server errors are not stored so the request can be retried.
+func Idempotency(c *gin.Context) {
+	key := c.GetHeader(idempotencyKeyHeader)
+	if key == "" {
+		c.Next()
+		return
+	}
+	if !validIdempotencyKey(key) {
+		writeProblem(c, http.StatusBadRequest, codeInvalidHeader, fmt.Sprintf("%s must be 1 to %d printable ASCII characters", idempotencyKeyHeader, maxIdempotencyKeyLength))
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		writeProblem(c, http.StatusBadRequest, codeMalformedBody, "Request body could not be read")
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", c.Request.Method, c.Request.URL.Path)
+	hash.Write(body)
+	fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+	// Keys belong to the user rather than the API key, so retries sent after
+	// the key was rotated still find the first response
+	key = fmt.Sprintf("user:%d:%s", principalOf(c).UserID, key)
+	previous, err := reserveIdempotencyKey(key, fingerprint, idempotencyLock)
+	if err != nil {
+		// Going on could create the duplicate the client tries to avoid
+		log.Printf("Error reserving idempotency key %s: %v", key, err)
+		writeProblem(c, http.StatusServiceUnavailable, codeInternal, "Idempotency keys are unavailable, retry later")
+		return
+	}
+	switch {
+	case previous == nil:
+	case previous.Fingerprint != fingerprint:
+		writeProblem(c, http.StatusUnprocessableEntity, codeKeyReused, fmt.Sprintf("%s was already used with another request", idempotencyKeyHeader))
+		return
+	case !previous.Completed:
+		c.Header("Retry-After", "1")
+		writeProblem(c, http.StatusConflict, codeConflict, fmt.Sprintf("A request with this %s is still being processed", idempotencyKeyHeader))
+		return
+	default:
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(previous.Status, previous.ContentType, previous.Body)
+		c.Abort()
+		return
+	}
+
+	completed := false
+	defer func() {
+		// Also runs when the handler panics
+		if !completed {
+			if err := releaseIdempotencyKey(key); err != nil {
+				log.Printf("Error releasing idempotency key %s: %v", key, err)
+			}
+		}
+	}()
+
+	recorder := &responseRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	c.Next()
+
+	status := recorder.Status()
+	if status >= http.StatusInternalServerError {
+		return
+	}
+	err = saveIdempotentResponse(key, cache.IdempotentResponse{
+		Fingerprint: fingerprint,
+		Status:      status,
+		ContentType: recorder.Header().Get("Content-Type"),
+		Body:        recorder.body.Bytes(),
+	}, idempotencyTTL)
+	if err != nil {
+		log.Printf("Error saving response of idempotency key %s: %v", key, err)
+		return
+	}
+	completed = true
+}
+
+// validIdempotencyKey accepts the printable ASCII keys clients generate,
+// typically UUIDs
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// responseRecorder keeps a copy of the response body
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
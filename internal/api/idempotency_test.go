@@ -0,0 +1,117 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/auth"
+	"github.com/mohammadshaad/zocket/internal/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	records := map[string]cache.IdempotentResponse{}
+	reserve, save, release := reserveIdempotencyKey, saveIdempotentResponse, releaseIdempotencyKey
+	defer func() {
+		reserveIdempotencyKey, saveIdempotentResponse, releaseIdempotencyKey = reserve, save, release
+	}()
+	reserveIdempotencyKey = func(key, fingerprint string, lock time.Duration) (*cache.IdempotentResponse, error) {
+		if record, ok := records[key]; ok {
+			return &record, nil
+		}
+		records[key] = cache.IdempotentResponse{Fingerprint: fingerprint}
+		return nil, nil
+	}
+	saveIdempotentResponse = func(key string, response cache.IdempotentResponse, ttl time.Duration) error {
+		response.Completed = true
+		records[key] = response
+		return nil
+	}
+	releaseIdempotencyKey = func(key string) error {
+		delete(records, key)
+		return nil
+	}
+
+	created := 0
+	router := gin.New()
+	router.POST("/products", func(c *gin.Context) {
+		// The API key of the caller changes when it is rotated
+		keyID, _ := strconv.ParseUint(c.GetHeader("X-Test-API-Key"), 10, 32)
+		c.Set(principalKey, &auth.Principal{UserID: 1, APIKeyID: uint(keyID)})
+	}, Idempotency, func(c *gin.Context) {
+		var body struct{ Name string }
+		if !bindJSON(c, &body) {
+			return
+		}
+		if body.Name == "fail" {
+			writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to save product")
+			return
+		}
+		created++
+		c.JSON(http.StatusOK, gin.H{"id": created, "name": body.Name})
+	})
+	sendWithAPIKey := func(apiKeyID, key, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/products", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Test-API-Key", apiKeyID)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	send := func(key, body string) *httptest.ResponseRecorder {
+		return sendWithAPIKey("7", key, body)
+	}
+
+	first := send("a", `{"Name":"x"}`)
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.JSONEq(t, `{"id":1,"name":"x"}`, first.Body.String())
+
+	// Retries replay the first response without running the handler again
+	retry := send("a", `{"Name":"x"}`)
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, first.Header().Get("Content-Type"), retry.Header().Get("Content-Type"))
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 1, created)
+
+	// Retries with a rotated API key or a token of the same user too
+	for _, apiKeyID := range []string{"8", ""} {
+		retry = sendWithAPIKey(apiKeyID, "a", `{"Name":"x"}`)
+		assert.Equal(t, first.Body.String(), retry.Body.String())
+		assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	}
+	assert.Equal(t, 1, created)
+
+	w := send("a", `{"Name":"y"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), codeKeyReused)
+	assert.Equal(t, 1, created)
+
+	// Other keys and requests without a key are not replayed
+	assert.JSONEq(t, `{"id":2,"name":"x"}`, send("b", `{"Name":"x"}`).Body.String())
+	assert.JSONEq(t, `{"id":3,"name":"x"}`, send("", `{"Name":"x"}`).Body.String())
+
+	// Server errors release the key for another attempt
+	assert.Equal(t, http.StatusInternalServerError, send("c", `{"Name":"fail"}`).Code)
+	assert.NotContains(t, records, "user:1:c")
+
+	// A request still in flight is not run twice
+	records["user:1:d"] = cache.IdempotentResponse{Fingerprint: records["user:1:a"].Fingerprint}
+	w = send("d", `{"Name":"x"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	w = send(strings.Repeat("k", maxIdempotencyKeyLength+1), `{"Name":"x"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 3, created)
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/db"
+)
+
+// mediaRange is one entry of an Accept header
+type mediaRange struct {
+	mediaType string
+	subtype   string
+	quality   float64
+}
+
+// parseAccept parses an Accept header, skipping malformed entries
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+	for _, entry := range strings.Split(header, ",") {
+		params := strings.Split(entry, ";")
+		mediaType, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if !ok || mediaType == "" || subtype == "" {
+			continue
+		}
+
+		r := mediaRange{mediaType: mediaType, subtype: subtype, quality: 1}
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil && q >= 0 && q <= 1 {
+					r.quality = q
+				}
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality the most specific matching range gives
+// to the content type, 0 when no range matches
+func acceptQuality(ranges []mediaRange, contentType string) float64 {
+	mediaType, subtype, _ := strings.Cut(strings.ToLower(contentType), "/")
+
+	quality, specificity := 0.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.mediaType == mediaType && r.subtype == subtype:
+			s = 2
+		case r.mediaType == mediaType && r.subtype == "*":
+			s = 1
+		case r.mediaType == "*" && r.subtype == "*":
+			s = 0
+		}
+		if s > specificity {
+			quality, specificity = r.quality, s
+		}
+	}
+	return quality
+}
+
+// negotiateImages keeps the best format of every rendition for the
+// request's Accept header and points the compressed image URLs at it.
+// Clients that do not list an image type in Accept, such as plain API
+// clients, get every format.
+func negotiateImages(c *gin.Context, products ...*db.Product) {
+	c.Header("Vary", "Accept")
+
+	ranges := parseAccept(c.GetHeader("Accept"))
+	wantsImages := false
+	for _, r := range ranges {
+		if r.mediaType == "image" {
+			wantsImages = true
+		}
+	}
+	if !wantsImages {
+		return
+	}
+
+	for _, product := range products {
+		*product = negotiateProductImages(*product, ranges)
+	}
+}
+
+func negotiateProductImages(product db.Product, ranges []mediaRange) db.Product {
+	chosen := make(map[string]string)
+	renditions := make(db.RenditionList, 0, len(product.ImageRenditions))
+
+	for _, entry := range product.ImageRenditions {
+		// Variants of a rendition share its name and are stored in order of
+		// preference, the last one being the fallback
+		var names []string
+		variants := make(map[string][]db.ImageRendition)
+		for _, rendition := range entry.Renditions {
+			if _, ok := variants[rendition.Name]; !ok {
+				names = append(names, rendition.Name)
+			}
+			variants[rendition.Name] = append(variants[rendition.Name], rendition)
+		}
+
+		negotiated := db.ImageRenditions{SourceURL: entry.SourceURL, Renditions: make([]db.ImageRendition, 0, len(names))}
+		for _, name := range names {
+			options := variants[name]
+			best, bestQuality := options[len(options)-1], 0.0
+			for _, option := range options {
+				if q := acceptQuality(ranges, option.ContentType); q > bestQuality {
+					best, bestQuality = option, q
+				}
+			}
+			for _, option := range options {
+				chosen[option.URL] = best.URL
+			}
+			negotiated.Renditions = append(negotiated.Renditions, best)
+		}
+		renditions = append(renditions, negotiated)
+	}
+
+	compressed := make(db.GormStringList, len(product.CompressedProductImages))
+	for i, url := range product.CompressedProductImages {
+		if best, ok := chosen[url]; ok {
+			url = best
+		}
+		compressed[i] = url
+	}
+
+	product.ImageRenditions = renditions
+	product.CompressedProductImages = compressed
+	return product
+}
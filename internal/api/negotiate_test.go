@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func negotiationProduct() db.Product {
+	return db.Product{
+		ProductImages:           db.GormStringList{"https://example.com/a.png"},
+		CompressedProductImages: db.GormStringList{"https://cdn.example.com/large/a.png"},
+		ImageRenditions: db.RenditionList{{
+			SourceURL: "https://example.com/a.png",
+			Renditions: []db.ImageRendition{
+				{Name: "thumbnail", URL: "https://cdn.example.com/thumbnail/a.webp", ContentType: "image/webp"},
+				{Name: "thumbnail", URL: "https://cdn.example.com/thumbnail/a.png", ContentType: "image/png"},
+				{Name: "large", URL: "https://cdn.example.com/large/a.avif", ContentType: "image/avif"},
+				{Name: "large", URL: "https://cdn.example.com/large/a.webp", ContentType: "image/webp"},
+				{Name: "large", URL: "https://cdn.example.com/large/a.png", ContentType: "image/png"},
+			},
+		}},
+	}
+}
+
+func negotiate(accept string) (db.Product, http.Header) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	if accept != "" {
+		c.Request.Header.Set("Accept", accept)
+	}
+
+	product := negotiationProduct()
+	negotiateImages(c, &product)
+	return product, w.Header()
+}
+
+func renditionURLs(product db.Product) []string {
+	var urls []string
+	for _, rendition := range product.ImageRenditions[0].Renditions {
+		urls = append(urls, rendition.URL)
+	}
+	return urls
+}
+
+func TestNegotiateImages(t *testing.T) {
+	// Browsers advertise the formats they decode
+	product, header := negotiate("image/avif,image/webp,image/apng,image/*,*/*;q=0.8")
+	assert.Equal(t, "Accept", header.Get("Vary"))
+	assert.Equal(t, []string{"https://cdn.example.com/thumbnail/a.webp", "https://cdn.example.com/large/a.avif"}, renditionURLs(product))
+	assert.Equal(t, db.GormStringList{"https://cdn.example.com/large/a.avif"}, product.CompressedProductImages)
+
+	// Explicit qualities win over the stored order
+	product, _ = negotiate("image/avif;q=0.5, image/webp;q=0.9, image/png")
+	assert.Equal(t, []string{"https://cdn.example.com/thumbnail/a.png", "https://cdn.example.com/large/a.png"}, renditionURLs(product))
+
+	// Clients accepting none of the variants get the fallback
+	product, _ = negotiate("image/gif")
+	assert.Equal(t, []string{"https://cdn.example.com/thumbnail/a.png", "https://cdn.example.com/large/a.png"}, renditionURLs(product))
+
+	// Plain API clients see every variant
+	for _, accept := range []string{"", "application/json", "*/*"} {
+		product, header = negotiate(accept)
+		assert.Equal(t, "Accept", header.Get("Vary"))
+		assert.Equal(t, negotiationProduct(), product, accept)
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/mohammadshaad/zocket/internal/db"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// sortColumns maps the public sort keys to their products column. The price
+// is compared in the base currency, see sortExpression.
+var sortColumns = map[string]string{
+	"created_at": "created_at",
+	"price":      "",
+	"name":       "product_name",
+}
+
+// sortExpression returns the SQL expression a sort key orders by
+func sortExpression(sort string) string {
+	if sort == "price" {
+		return basePriceSQL()
+	}
+	return sortColumns[sort]
+}
+
+// ProductPage is the envelope returned by GetAllProductsHandler
+type ProductPage struct {
+	Items         []db.Product `json:"items"`
+	NextCursor    string       `json:"next_cursor,omitempty"`
+	TotalEstimate int64        `json:"total_estimate"`
+}
+
+// estimateRows returns the planner's estimate of the rows the query matches.
+// An exact count would scan every matching row on every page.
+func estimateRows(query *gorm.DB) (int64, error) {
+	stmt := query.Session(&gorm.Session{DryRun: true}).Find(&[]db.Product{}).Statement
+	sqlDB, err := db.DB.DB()
+	if err != nil {
+		return 0, err
+	}
+
+	var plan []byte
+	if err := sqlDB.QueryRowContext(stmt.Context, "EXPLAIN (FORMAT JSON) "+stmt.SQL.String(), stmt.Vars...).Scan(&plan); err != nil {
+		return 0, err
+	}
+	var explained []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		}
+	}
+	if err := json.Unmarshal(plan, &explained); err != nil || len(explained) == 0 {
+		return 0, fmt.Errorf("unexpected query plan %s", plan)
+	}
+	return int64(explained[0].Plan.Rows), nil
+}
+
+// pageCursor is the keyset position after the last item of a page. It is
+// handed to clients as an opaque base64 token.
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+func encodeCursor(cursor pageCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(token string) (pageCursor, error) {
+	var cursor pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, fmt.Errorf("malformed cursor")
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, fmt.Errorf("malformed cursor")
+	}
+	return cursor, nil
+}
+
+// cursorFor builds the cursor pointing just after the given product
+func cursorFor(product db.Product, sort, order string) pageCursor {
+	cursor := pageCursor{Sort: sort, Order: order, ID: product.ID}
+	switch sort {
+	case "price":
+		// Products listed by price always have a rate, see applyPriceFilter
+		cursor.Value, _ = basePrice(product.ProductPrice)
+	case "name":
+		cursor.Value = product.ProductName
+	default:
+		cursor.Value = product.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return cursor
+}
+
+// cursorValue converts the cursor value back to the type of the sort column
+func cursorValue(cursor pageCursor) (interface{}, error) {
+	switch cursor.Sort {
+	case "price":
+		// An exact decimal, passed on as text so it is not rounded
+		if _, ok := new(big.Rat).SetString(cursor.Value); !ok || strings.ContainsAny(cursor.Value, "/eE") {
+			return nil, fmt.Errorf("malformed cursor")
+		}
+		return cursor.Value, nil
+	case "name":
+		return cursor.Value, nil
+	default:
+		return time.Parse(time.RFC3339Nano, cursor.Value)
+	}
+}
+
+// applyKeyset restricts the query to the rows after the filter cursor and
+// orders it by the sort column with the id as tie breaker. The cursor must
+// have been validated by parseProductFilter.
+func applyKeyset(query *gorm.DB, filter productFilter) *gorm.DB {
+	column := sortExpression(filter.Sort)
+	if filter.Cursor != nil {
+		value, _ := cursorValue(*filter.Cursor)
+		op := ">"
+		if filter.Order == "desc" {
+			op = "<"
+		}
+		query = query.Where(fmt.Sprintf("(%s, id) %s (?, ?)", column, op), value, filter.Cursor.ID)
+	}
+	return query.Order(fmt.Sprintf("%s %s, id %s", column, filter.Order, filter.Order))
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mohammadshaad/zocket/internal/db"
+	"github.com/mohammadshaad/zocket/pkg/money"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	product := db.Product{
+		ID:           42,
+		ProductName:  "Desk, oak",
+		ProductPrice: money.MustParse("69.69", "USD"),
+		CreatedAt:    time.Date(2024, 5, 1, 10, 30, 0, 123456789, time.UTC),
+	}
+
+	for sort := range sortColumns {
+		token := encodeCursor(cursorFor(product, sort, "desc"))
+
+		cursor, err := decodeCursor(token)
+		assert.NoError(t, err)
+		assert.Equal(t, sort, cursor.Sort)
+		assert.Equal(t, "desc", cursor.Order)
+		assert.Equal(t, uint(42), cursor.ID)
+
+		_, err = cursorValue(cursor)
+		assert.NoError(t, err)
+	}
+}
+
+func TestDecodeCursorRejectsGarbage(t *testing.T) {
+	_, err := decodeCursor("not a cursor!")
+	assert.Error(t, err)
+
+	_, err = decodeCursor("bm90IGpzb24")
+	assert.Error(t, err)
+}
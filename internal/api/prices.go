@@ -0,0 +1,80 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/mohammadshaad/zocket/internal/db"
+	"github.com/mohammadshaad/zocket/pkg/money"
+	"gorm.io/gorm"
+)
+
+// exchangeRates converts prices between currencies. Until InitExchangeRates
+// is called only the default currency is supported.
+var exchangeRates, _ = money.NewRates(money.DefaultCurrency())
+
+// InitExchangeRates sets the currencies products may be priced in and the
+// rates used to filter, sort and convert prices across them
+func InitExchangeRates(rates *money.Rates) {
+	exchangeRates = rates
+}
+
+// basePriceSQL is the SQL expression of a product price in the base
+// currency, the value price filters and the price sort compare. Products in
+// a currency without a rate evaluate to NULL.
+func basePriceSQL() string {
+	var b strings.Builder
+	b.WriteString("(CASE price_currency")
+	for _, code := range exchangeRates.Currencies() {
+		factor, _ := exchangeRates.MinorUnitFactor(code)
+		// Codes and factors come from the rate table, never from the client
+		fmt.Fprintf(&b, " WHEN '%s' THEN price_amount * %s", code, money.DecimalString(factor))
+	}
+	b.WriteString(" END)")
+	return b.String()
+}
+
+// basePrice returns the exact decimal value of a price in the base currency
+func basePrice(price money.Money) (string, error) {
+	value, err := exchangeRates.BaseValue(price)
+	if err != nil {
+		return "", err
+	}
+	return money.DecimalString(value), nil
+}
+
+// applyPriceFilter restricts the query to the filter price range. Products
+// in a currency the rate table no longer has cannot be compared and are left
+// out of price filtered and price sorted listings.
+func applyPriceFilter(query *gorm.DB, filter productFilter) *gorm.DB {
+	if filter.MinPrice == nil && filter.MaxPrice == nil && filter.Sort != "price" {
+		return query
+	}
+	query = query.Where("price_currency IN ?", exchangeRates.Currencies())
+
+	if filter.MinPrice != nil {
+		bound, _ := basePrice(*filter.MinPrice)
+		query = query.Where(basePriceSQL()+" >= ?", bound)
+	}
+	if filter.MaxPrice != nil {
+		bound, _ := basePrice(*filter.MaxPrice)
+		query = query.Where(basePriceSQL()+" <= ?", bound)
+	}
+	return query
+}
+
+// convertPrices shows the prices of the products in the requested currency
+func convertPrices(currency string, products ...*db.Product) {
+	if currency == "" {
+		return
+	}
+	for _, product := range products {
+		converted, err := exchangeRates.Convert(product.ProductPrice, currency)
+		if err != nil {
+			log.Printf("Error converting price of product %d to %s: %v", product.ID, currency, err)
+			continue
+		}
+		product.ProductPrice = converted
+	}
+}
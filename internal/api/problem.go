@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Machine readable error codes used in problem documents
+const (
+	codeMalformedBody    = "malformed_body"
+	codeValidationFailed = "validation_failed"
+	codeInvalidQuery     = "invalid_query"
+	codeInvalidID        = "invalid_id"
+	codeNotFound         = "not_found"
+	codeInternal         = "internal_error"
+	codeNotSupported     = "not_supported"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeConflict         = "conflict"
+	codeRateLimited      = "rate_limited"
+	codeInvalidHeader    = "invalid_header"
+	codeKeyReused        = "idempotency_key_reused"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details document extended with a machine
+// code and per-field errors
+type Problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Code   string       `json:"code"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes why a single field of the request was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeProblem aborts the request with a problem+json response
+func writeProblem(c *gin.Context, status int, code, detail string, errs ...FieldError) {
+	c.Header("Content-Type", problemContentType)
+	c.AbortWithStatusJSON(status, Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+		Errors: errs,
+	})
+}
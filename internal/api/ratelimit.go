@@ -0,0 +1,181 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/config"
+	"github.com/mohammadshaad/zocket/internal/auth"
+	"github.com/mohammadshaad/zocket/internal/cache"
+)
+
+// RateLimitRule allows Limit requests per client in any Window
+type RateLimitRule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// RateLimits holds the limit of every route, keyed by method and route
+// pattern such as "POST /api/v1/products", and the limit of other routes
+type RateLimits struct {
+	Routes  map[string]RateLimitRule
+	Default RateLimitRule
+	// IP bounds the requests of every IP address to all routes together,
+	// checked before the credentials are
+	IP RateLimitRule
+}
+
+// DefaultRateLimits protects the routes that fan out Kafka and storage work
+// more than the others
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		Routes: map[string]RateLimitRule{
+			"POST /api/v1/products":                     {Limit: 30, Window: time.Minute},
+			"PUT /api/v1/products/:id":                  {Limit: 60, Window: time.Minute},
+			"PATCH /api/v1/products/:id":                {Limit: 60, Window: time.Minute},
+			"POST /api/v1/products/:id/images":          {Limit: 20, Window: time.Minute},
+			"POST /api/v1/products/:id/images/presign":  {Limit: 20, Window: time.Minute},
+			"POST /api/v1/products/:id/images/complete": {Limit: 20, Window: time.Minute},
+			"POST /api/v1/api-keys":                     {Limit: 10, Window: time.Minute},
+			"POST /api/v1/api-keys/:id/rotate":          {Limit: 10, Window: time.Minute},
+		},
+		Default: RateLimitRule{Limit: 600, Window: time.Minute},
+		IP:      RateLimitRule{Limit: 1200, Window: time.Minute},
+	}
+}
+
+// RateLimitsFromEnv reads RATE_LIMIT_DEFAULT, RATE_LIMIT_IP and the per route
+// overrides of RATE_LIMITS, such as
+// "POST /api/v1/products=10/1m,GET /api/v1/products=100/10s". A limit of 0
+// disables limiting.
+func RateLimitsFromEnv() (RateLimits, error) {
+	limits := DefaultRateLimits()
+
+	if v := config.GetEnv("RATE_LIMIT_IP", ""); v != "" {
+		rule, err := parseRateLimitRule(v)
+		if err != nil {
+			return limits, fmt.Errorf("RATE_LIMIT_IP: %w", err)
+		}
+		limits.IP = rule
+	}
+
+	if v := config.GetEnv("RATE_LIMIT_DEFAULT", ""); v != "" {
+		rule, err := parseRateLimitRule(v)
+		if err != nil {
+			return limits, fmt.Errorf("RATE_LIMIT_DEFAULT: %w", err)
+		}
+		limits.Default = rule
+	}
+
+	for _, entry := range strings.Split(config.GetEnv("RATE_LIMITS", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		route, value, ok := strings.Cut(entry, "=")
+		method, path, hasPath := strings.Cut(strings.TrimSpace(route), " ")
+		if !ok || !hasPath {
+			return limits, fmt.Errorf("RATE_LIMITS entry %q is not METHOD /path=limit/window", entry)
+		}
+		rule, err := parseRateLimitRule(value)
+		if err != nil {
+			return limits, fmt.Errorf("RATE_LIMITS entry %q: %w", entry, err)
+		}
+		limits.Routes[strings.ToUpper(method)+" "+strings.TrimSpace(path)] = rule
+	}
+	return limits, nil
+}
+
+func parseRateLimitRule(value string) (RateLimitRule, error) {
+	count, window, ok := strings.Cut(strings.TrimSpace(value), "/")
+	limit, err := strconv.Atoi(count)
+	if !ok || err != nil || limit < 0 {
+		return RateLimitRule{}, fmt.Errorf("limit %q is not requests/window", value)
+	}
+	duration, err := time.ParseDuration(window)
+	if err != nil || duration < time.Second {
+		return RateLimitRule{}, fmt.Errorf("window of %q must be a duration of at least 1s", value)
+	}
+	return RateLimitRule{Limit: limit, Window: duration}, nil
+}
+
+var rateLimits RateLimits
+
+// allowRequest checks a request against the shared limiter, replaced in tests
+var allowRequest = cache.AllowRequest
+
+// InitRateLimits sets the limits enforced by RateLimit. Without it requests
+// are not limited.
+func InitRateLimits(limits RateLimits) {
+	rateLimits = limits
+}
+
+// RateLimitIP limits the requests of each IP address before the caller is
+// authenticated, so clients sending invalid credentials are limited too
+func RateLimitIP(c *gin.Context) {
+	if limitRequest(c, "ip:"+c.ClientIP(), rateLimits.IP) {
+		c.Next()
+	}
+}
+
+// RateLimit limits the requests of each client to the route. Clients are
+// identified by their API key, else their user, else their IP address, so it
+// must run after the authentication middleware. Limits are shared by every
+// API replica through Redis; when Redis fails requests are let through.
+func RateLimit(c *gin.Context) {
+	route := c.Request.Method + " " + c.FullPath()
+	rule, ok := rateLimits.Routes[route]
+	if !ok {
+		rule = rateLimits.Default
+	}
+	if limitRequest(c, route+":"+clientIdentity(c), rule) {
+		c.Next()
+	}
+}
+
+// limitRequest counts the request against the rule under key and reports
+// whether it may proceed, rejecting it otherwise
+func limitRequest(c *gin.Context, key string, rule RateLimitRule) bool {
+	if rule.Limit <= 0 {
+		return true
+	}
+
+	result, err := allowRequest(key, rule.Limit, rule.Window)
+	if err != nil {
+		log.Printf("Error checking rate limit of %s, allowing request: %v", key, err)
+		return true
+	}
+
+	// Headers of draft-ietf-httpapi-ratelimit-headers
+	reset := int(math.Ceil(result.Reset.Seconds()))
+	c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(reset))
+	c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.Limit, int(rule.Window.Seconds())))
+
+	if !result.Allowed {
+		c.Header("Retry-After", strconv.Itoa(max(reset, 1)))
+		writeProblem(c, http.StatusTooManyRequests, codeRateLimited, fmt.Sprintf("Rate limit of %d requests per %s exceeded", rule.Limit, rule.Window))
+		return false
+	}
+	return true
+}
+
+// clientIdentity identifies the caller of the request
+func clientIdentity(c *gin.Context) string {
+	if value, ok := c.Get(principalKey); ok {
+		if principal, ok := value.(*auth.Principal); ok {
+			if principal.APIKeyID != 0 {
+				return "key:" + strconv.FormatUint(uint64(principal.APIKeyID), 10)
+			}
+			return "user:" + strconv.FormatUint(uint64(principal.UserID), 10)
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
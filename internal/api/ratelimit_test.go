@@ -0,0 +1,142 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/auth"
+	"github.com/mohammadshaad/zocket/internal/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitsFromEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT_DEFAULT", "100/10s")
+	t.Setenv("RATE_LIMIT_IP", "300/10s")
+	t.Setenv("RATE_LIMITS", "post /api/v1/products=5/1m, GET /api/v1/products=0/1s")
+	limits, err := RateLimitsFromEnv()
+	require.NoError(t, err)
+	assert.Equal(t, RateLimitRule{Limit: 100, Window: 10 * time.Second}, limits.Default)
+	assert.Equal(t, RateLimitRule{Limit: 300, Window: 10 * time.Second}, limits.IP)
+	assert.Equal(t, RateLimitRule{Limit: 5, Window: time.Minute}, limits.Routes["POST /api/v1/products"])
+	assert.Equal(t, RateLimitRule{Limit: 0, Window: time.Second}, limits.Routes["GET /api/v1/products"])
+	assert.Equal(t, 20, limits.Routes["POST /api/v1/products/:id/images"].Limit)
+
+	for _, spec := range []string{"/api/v1/products=5/1m", "POST /api/v1/products=5", "POST /api/v1/products=-1/1m", "POST /api/v1/products=5/1ms"} {
+		t.Setenv("RATE_LIMITS", spec)
+		_, err := RateLimitsFromEnv()
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previous := rateLimits
+	InitRateLimits(RateLimits{
+		Routes:  map[string]RateLimitRule{"POST /limited": {Limit: 2, Window: time.Minute}},
+		Default: RateLimitRule{Limit: 0, Window: time.Minute},
+	})
+	defer InitRateLimits(previous)
+
+	// A fixed window counter per key is enough to check the middleware
+	counts := map[string]int{}
+	defer func(f func(string, int, time.Duration) (cache.RateLimitResult, error)) { allowRequest = f }(allowRequest)
+	allowRequest = func(key string, limit int, window time.Duration) (cache.RateLimitResult, error) {
+		counts[key]++
+		remaining := max(limit-counts[key], 0)
+		return cache.RateLimitResult{Allowed: counts[key] <= limit, Limit: limit, Remaining: remaining, Reset: 1500 * time.Millisecond}, nil
+	}
+
+	router := gin.New()
+	authenticate := func(c *gin.Context) {
+		switch c.GetHeader("X-Test-Caller") {
+		case "key":
+			c.Set(principalKey, &auth.Principal{UserID: 1, APIKeyID: 9})
+		case "user":
+			c.Set(principalKey, &auth.Principal{UserID: 1})
+		}
+	}
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router.POST("/limited", authenticate, RateLimit, ok)
+	router.GET("/unlimited", authenticate, RateLimit, ok)
+	send := func(method, path, caller string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if caller != "" {
+			req.Header.Set("X-Test-Caller", caller)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/limited", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2;w=60", w.Header().Get("RateLimit-Policy"))
+	assert.Empty(t, w.Header().Get("Retry-After"))
+
+	send("POST", "/limited", "")
+	w = send("POST", "/limited", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+	assert.Equal(t, problemContentType, w.Header().Get("Content-Type"))
+
+	// Users and API keys have their own budgets
+	assert.Equal(t, http.StatusOK, send("POST", "/limited", "user").Code)
+	assert.Equal(t, http.StatusOK, send("POST", "/limited", "key").Code)
+	assert.Equal(t, map[string]int{
+		"POST /limited:ip:192.0.2.1": 3,
+		"POST /limited:user:1":       1,
+		"POST /limited:key:9":        1,
+	}, counts)
+
+	// A limit of 0 disables limiting
+	w = send("GET", "/unlimited", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+}
+
+func TestRateLimitIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	previous := rateLimits
+	InitRateLimits(RateLimits{IP: RateLimitRule{Limit: 2, Window: time.Minute}})
+	defer InitRateLimits(previous)
+
+	counts := map[string]int{}
+	defer func(f func(string, int, time.Duration) (cache.RateLimitResult, error)) { allowRequest = f }(allowRequest)
+	allowRequest = func(key string, limit int, window time.Duration) (cache.RateLimitResult, error) {
+		counts[key]++
+		return cache.RateLimitResult{Allowed: counts[key] <= limit, Limit: limit, Remaining: max(limit-counts[key], 0), Reset: time.Second}, nil
+	}
+
+	// Requests with invalid credentials count against the IP address and
+	// stop reaching the authentication once it is exhausted
+	authenticated := 0
+	router := gin.New()
+	router.POST("/", RateLimitIP, func(c *gin.Context) {
+		authenticated++
+		c.Status(http.StatusUnauthorized)
+	})
+	send := func(remoteAddr string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "ApiKey invalid")
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send("192.0.2.1:1234"))
+	assert.Equal(t, http.StatusUnauthorized, send("192.0.2.1:1234"))
+	assert.Equal(t, http.StatusTooManyRequests, send("192.0.2.1:1234"))
+	assert.Equal(t, http.StatusUnauthorized, send("192.0.2.2:1234"))
+	assert.Equal(t, 3, authenticated)
+	assert.Equal(t, map[string]int{"ip:192.0.2.1": 3, "ip:192.0.2.2": 1}, counts)
+}
@@ -2,14 +2,51 @@ package api
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/auth"
 )
 
 func SetupRoutes (router *gin.Engine) {
-	api := router.Group("/api/v1")
+	// Every IP address is limited before credentials are checked, callers
+	// are limited again per route once they are known
+	api := router.Group("/api/v1", RateLimitIP)
 
+	// Reads are public, credentials are only checked when sent
+	readers := api.Group("", OptionalAuth, RateLimit)
 	{
-		api.POST("/products", AddProductHandler)
-		api.GET("/products/:id", GetProductByIDHandler)
-		api.GET("/products", GetAllProductsHandler)
+		readers.GET("/products/:id", GetProductByIDHandler)
+		readers.GET("/products", GetAllProductsHandler)
+		readers.GET("/products/:id/images", GetProductImagesHandler)
+		readers.GET("/products/:id/similar", GetSimilarProductsHandler)
+		readers.GET("/users/:id/products", GetUserProductsHandler)
+	}
+
+	// Writes need a bearer token or an API key, see RequireAuth
+	writers := api.Group("", RequireAuth, RequireScope(auth.ScopeProductsWrite), RateLimit)
+	{
+		writers.POST("/products", Idempotency, AddProductHandler)
+		writers.PUT("/products/:id", UpdateProductHandler)
+		writers.PATCH("/products/:id", UpdateProductHandler)
+		writers.DELETE("/products/:id", DeleteProductHandler)
+		writers.POST("/products/:id/images", UploadProductImagesHandler)
+		writers.POST("/products/:id/images/presign", PresignProductImageUploadHandler)
+		writers.POST("/products/:id/images/complete", CompleteProductImageUploadHandler)
+	}
+
+	keys := api.Group("/api-keys", RequireAuth, RateLimit)
+	{
+		keys.POST("", CreateAPIKeyHandler)
+		keys.GET("", ListAPIKeysHandler)
+		keys.DELETE("/:id", RevokeAPIKeyHandler)
+		keys.POST("/:id/rotate", RotateAPIKeyHandler)
+	}
+
+	users := api.Group("/users", RequireAuth, RateLimit)
+	{
+		users.POST("", CreateUserHandler)
+		users.GET("", ListUsersHandler)
+		users.GET("/:id", GetUserHandler)
+		users.PUT("/:id", RequireScope(auth.ScopeUsersWrite), UpdateUserHandler)
+		users.PATCH("/:id", RequireScope(auth.ScopeUsersWrite), UpdateUserHandler)
+		users.DELETE("/:id", DeleteUserHandler)
 	}
 }
\ No newline at end of file
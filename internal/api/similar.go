@@ -0,0 +1,109 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/db"
+	"gorm.io/gorm"
+)
+
+const (
+	// defaultSimilarDistance is the largest Hamming distance between two
+	// 64-bit image hashes that still counts as similar by default
+	defaultSimilarDistance = 10
+	maxSimilarDistance     = 64
+)
+
+// SimilarProduct is a product sharing a similar image with the requested one.
+// Distance is the smallest Hamming distance between their image hashes, 0
+// for identical images.
+type SimilarProduct struct {
+	Product  db.Product `json:"product"`
+	Distance int        `json:"distance"`
+}
+
+// SimilarProductsResponse lists similar products, closest first
+type SimilarProductsResponse struct {
+	ProductID uint             `json:"product_id"`
+	Items     []SimilarProduct `json:"items"`
+}
+
+func GetSimilarProductsHandler(c *gin.Context) {
+	productID, ok := parseID(c)
+	if !ok {
+		return
+	}
+
+	maxDistance, limit := defaultSimilarDistance, defaultPageLimit
+	var errs []FieldError
+	if v := c.Query("max_distance"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 0 || d > maxSimilarDistance {
+			errs = append(errs, FieldError{Field: "max_distance", Code: "out_of_range", Message: fmt.Sprintf("must be an integer between 0 and %d", maxSimilarDistance)})
+		}
+		maxDistance = d
+	}
+	if v := c.Query("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > maxPageLimit {
+			errs = append(errs, FieldError{Field: "limit", Code: "out_of_range", Message: fmt.Sprintf("must be an integer between 1 and %d", maxPageLimit)})
+		}
+		limit = l
+	}
+	if len(errs) > 0 {
+		writeProblem(c, http.StatusBadRequest, codeInvalidQuery, "Query parameters are invalid", errs...)
+		return
+	}
+
+	var product db.Product
+	if err := db.DB.First(&product, productID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			writeProblem(c, http.StatusNotFound, codeNotFound, "Product not found")
+		} else {
+			writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve product")
+		}
+		return
+	}
+
+	matches, err := db.FindSimilarProducts(productID, maxDistance, limit)
+	if err != nil {
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to find similar products")
+		return
+	}
+
+	ids := make([]uint, len(matches))
+	for i, match := range matches {
+		ids[i] = match.ProductID
+	}
+	var products []db.Product
+	if len(ids) > 0 {
+		if err := db.DB.Where("id IN ?", ids).Find(&products).Error; err != nil {
+			writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve products")
+			return
+		}
+	}
+	byID := make(map[uint]*db.Product, len(products))
+	for i := range products {
+		byID[products[i].ID] = &products[i]
+	}
+
+	// Keep the distance order, skipping products deleted in the meantime
+	items := make([]SimilarProduct, 0, len(matches))
+	for _, match := range matches {
+		if p, ok := byID[match.ProductID]; ok {
+			items = append(items, SimilarProduct{Product: *p, Distance: match.Distance})
+		}
+	}
+
+	found := make([]*db.Product, len(items))
+	for i := range items {
+		found[i] = &items[i].Product
+	}
+	negotiateImages(c, found...)
+
+	c.JSON(http.StatusOK, SimilarProductsResponse{ProductID: productID, Items: items})
+}
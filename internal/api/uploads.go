@@ -0,0 +1,397 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/cache"
+	"github.com/mohammadshaad/zocket/internal/db"
+	"github.com/mohammadshaad/zocket/internal/queue"
+	"github.com/mohammadshaad/zocket/pkg/storage"
+	"github.com/mohammadshaad/zocket/pkg/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// uploadFormField is the multipart field holding the image files
+	uploadFormField = "image"
+	// uploadHeadSize is how much of an upload is read to check that it is an
+	// image before it is stored
+	uploadHeadSize = 1 << 20
+	// presignExpiry is how long a presigned upload URL stays valid
+	presignExpiry = 15 * time.Minute
+)
+
+var blobStore storage.BlobStore
+var uploadLimits = util.DefaultDownloadConfig()
+
+// uploadKeyPattern matches the keys handed out for direct uploads
+var uploadKeyPattern = regexp.MustCompile(`^uploads/([0-9]+)/[0-9a-f]{32}\.(jpg|png|gif|webp)$`)
+
+// errUploadTooLarge is returned by the upload body once MaxBytes is exceeded
+var errUploadTooLarge = errors.New("upload is too large")
+
+// InitImageUploads sets the store uploaded images are written to and the
+// limits they must respect. Without a store the upload endpoints answer 501.
+func InitImageUploads(store storage.BlobStore, limits util.DownloadConfig) {
+	blobStore = store
+	uploadLimits = limits
+}
+
+// UploadProductImagesHandler stores images sent as multipart/form-data in the
+// blob store and adds them to the product
+func UploadProductImagesHandler(c *gin.Context) {
+	productID, ok := parseID(c)
+	if !ok || !requireBlobStore(c) || !authorizeProduct(c, productID) {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxProductImages*uploadLimits.MaxBytes+uploadHeadSize)
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		writeProblem(c, http.StatusBadRequest, codeMalformedBody, "Request body must be multipart/form-data")
+		return
+	}
+
+	var keys []string
+	// Uploaded files are removed again when the request fails
+	cleanup := func() { deleteUploads(keys) }
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			cleanup()
+			writeProblem(c, http.StatusBadRequest, codeMalformedBody, "Request body is not valid multipart/form-data")
+			return
+		}
+		if part.FormName() != uploadFormField {
+			part.Close()
+			continue
+		}
+
+		field := fmt.Sprintf("%s[%d]", uploadFormField, len(keys))
+		if len(keys) == maxProductImages {
+			cleanup()
+			writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "Upload is invalid", FieldError{
+				Field:   uploadFormField,
+				Code:    "too_many",
+				Message: fmt.Sprintf("must contain at most %d images", maxProductImages),
+			})
+			return
+		}
+
+		key, err := storeUpload(c.Request.Context(), productID, part)
+		part.Close()
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.Is(err, util.ErrImageRejected), errors.Is(err, errUploadTooLarge):
+			cleanup()
+			writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "Upload is invalid", FieldError{
+				Field:   field,
+				Code:    "invalid_image",
+				Message: err.Error(),
+			})
+			return
+		case errors.As(err, &tooLarge):
+			cleanup()
+			writeProblem(c, http.StatusRequestEntityTooLarge, codeValidationFailed, "Request body is too large")
+			return
+		case err != nil:
+			log.Printf("Error storing upload for product %d: %v", productID, err)
+			cleanup()
+			writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to store image")
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "Upload is invalid", FieldError{
+			Field:   uploadFormField,
+			Code:    "required",
+			Message: "must contain at least one image",
+		})
+		return
+	}
+
+	attachUploads(c, productID, keys)
+}
+
+// presignRequest asks for a URL to upload a single image to
+type presignRequest struct {
+	ContentType   string `json:"content_type"`
+	ContentLength int64  `json:"content_length"`
+}
+
+// PresignResponse tells the client how to upload an image directly to the
+// blob store. The key is passed to the completion endpoint afterwards.
+type PresignResponse struct {
+	Key       string            `json:"key"`
+	UploadURL string            `json:"upload_url"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// PresignProductImageUploadHandler issues a presigned PUT URL for uploading a
+// large image straight to the blob store
+func PresignProductImageUploadHandler(c *gin.Context) {
+	productID, ok := parseID(c)
+	if !ok || !requireBlobStore(c) {
+		return
+	}
+
+	var req presignRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	var errs []FieldError
+	ext, supported := util.ImageExtension(req.ContentType)
+	if !supported {
+		errs = append(errs, FieldError{Field: "content_type", Code: "unsupported", Message: "must be image/jpeg, image/png, image/gif or image/webp"})
+	}
+	if req.ContentLength <= 0 || req.ContentLength > uploadLimits.MaxBytes {
+		errs = append(errs, FieldError{Field: "content_length", Code: "out_of_range", Message: fmt.Sprintf("must be between 1 and %d bytes", uploadLimits.MaxBytes)})
+	}
+	if len(errs) > 0 {
+		writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "Upload request is invalid", errs...)
+		return
+	}
+
+	presigner, ok := blobStore.(storage.Presigner)
+	if !ok {
+		writeProblem(c, http.StatusNotImplemented, codeNotSupported, "The blob store does not support presigned uploads, use multipart uploads instead")
+		return
+	}
+	if !authorizeProduct(c, productID) {
+		return
+	}
+
+	key := uploadKey(productID, ext)
+	expiresAt := time.Now().Add(presignExpiry)
+	uploadURL, err := presigner.PresignPut(c.Request.Context(), key, req.ContentType, req.ContentLength, presignExpiry)
+	if err != nil {
+		log.Printf("Error presigning upload for product %d: %v", productID, err)
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to presign upload")
+		return
+	}
+
+	c.JSON(http.StatusOK, PresignResponse{
+		Key:       key,
+		UploadURL: uploadURL,
+		Method:    http.MethodPut,
+		Headers:   map[string]string{"Content-Type": req.ContentType},
+		ExpiresAt: expiresAt,
+	})
+}
+
+// completeUploadRequest names an object uploaded through a presigned URL
+type completeUploadRequest struct {
+	Key string `json:"key"`
+}
+
+// CompleteProductImageUploadHandler adds an image uploaded through a
+// presigned URL to the product once the upload has finished
+func CompleteProductImageUploadHandler(c *gin.Context) {
+	productID, ok := parseID(c)
+	if !ok || !requireBlobStore(c) {
+		return
+	}
+
+	var req completeUploadRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	// Only keys issued for this product can be attached to it
+	match := uploadKeyPattern.FindStringSubmatch(req.Key)
+	if match == nil || match[1] != strconv.FormatUint(uint64(productID), 10) {
+		writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "Upload is invalid", FieldError{
+			Field:   "key",
+			Code:    "invalid_key",
+			Message: "must be a key issued for this product",
+		})
+		return
+	}
+	if !authorizeProduct(c, productID) {
+		return
+	}
+
+	body, err := blobStore.Get(c.Request.Context(), req.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "Upload is invalid", FieldError{
+			Field:   "key",
+			Code:    "not_uploaded",
+			Message: "no image has been uploaded under this key",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading upload %s: %v", req.Key, err)
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to read upload")
+		return
+	}
+	head, err := io.ReadAll(io.LimitReader(body, uploadHeadSize))
+	body.Close()
+	if err != nil {
+		log.Printf("Error reading upload %s: %v", req.Key, err)
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to read upload")
+		return
+	}
+
+	// Presigned uploads bypass the API, so check the content now
+	if err := util.CheckImage(head, uploadLimits.MaxPixels); err != nil {
+		deleteUploads([]string{req.Key})
+		writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "Upload is invalid", FieldError{
+			Field:   "key",
+			Code:    "invalid_image",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	attachUploads(c, productID, []string{req.Key})
+}
+
+// attachUploads appends the uploaded images to the product and enqueues them
+// for processing like images added by URL
+func attachUploads(c *gin.Context, productID uint, keys []string) {
+	var product db.Product
+	var added []string
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&product, productID).Error; err != nil {
+			return err
+		}
+
+		images := append([]string{}, product.ProductImages...)
+		for _, key := range keys {
+			url := blobStore.URL(key)
+			// Completing the same upload twice adds it once
+			if !slices.Contains(images, url) {
+				images = append(images, url)
+			}
+		}
+		if len(images) > maxProductImages {
+			return &validationError{errs: []FieldError{{Field: "ProductImages", Code: "too_many", Message: fmt.Sprintf("must contain at most %d images", maxProductImages)}}}
+		}
+
+		added, _ = reconcileImages(&product, images)
+		if err := tx.Save(&product).Error; err != nil {
+			return err
+		}
+		return db.CreatePendingImageStatuses(tx, product.ID, added)
+	})
+	var invalid *validationError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		deleteUploads(keys)
+		writeProblem(c, http.StatusNotFound, codeNotFound, "Product not found")
+		return
+	case errors.As(err, &invalid):
+		deleteUploads(keys)
+		writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "Product is invalid", invalid.errs...)
+		return
+	case err != nil:
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to update product")
+		return
+	}
+
+	if err := cache.InvalidateProductCache(strconv.FormatUint(uint64(productID), 10)); err != nil {
+		log.Printf("Error invalidating cache for product %d: %v", productID, err)
+	}
+
+	for _, key := range keys {
+		url := blobStore.URL(key)
+		if slices.Contains(added, url) {
+			publishImageMessage(queue.ImageMessage{ProductID: int(productID), ImageURL: url, StorageKey: key})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Images uploaded successfully",
+		"product": product,
+	})
+}
+
+// storeUpload checks that the upload is a supported image and streams it
+// into the blob store, returning its key
+func storeUpload(ctx context.Context, productID uint, body io.Reader) (string, error) {
+	head, err := io.ReadAll(io.LimitReader(body, uploadHeadSize))
+	if err != nil {
+		return "", err
+	}
+	if err := util.CheckImage(head, uploadLimits.MaxPixels); err != nil {
+		return "", err
+	}
+
+	contentType := http.DetectContentType(head)
+	ext, _ := util.ImageExtension(contentType)
+	key := uploadKey(productID, ext)
+
+	// The head has been read already, the rest is streamed
+	content := &limitedReader{r: io.MultiReader(bytes.NewReader(head), body), remaining: uploadLimits.MaxBytes}
+	if _, err := blobStore.Put(ctx, key, content, contentType); err != nil {
+		// Stores may have written part of the object
+		deleteUploads([]string{key})
+		return "", err
+	}
+	return key, nil
+}
+
+// limitedReader fails with errUploadTooLarge instead of truncating the body
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, fmt.Errorf("%w: the limit is %d bytes", errUploadTooLarge, uploadLimits.MaxBytes)
+	}
+	return n, err
+}
+
+// uploadKey returns a new unguessable key for an image of the product
+func uploadKey(productID uint, ext string) string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("uploads/%d/%s.%s", productID, hex.EncodeToString(id[:]), ext)
+}
+
+func deleteUploads(keys []string) {
+	for _, key := range keys {
+		if err := blobStore.Delete(context.Background(), key); err != nil {
+			log.Printf("Error deleting upload %s: %v", key, err)
+		}
+	}
+}
+
+// requireBlobStore writes a problem response when uploads are not configured
+func requireBlobStore(c *gin.Context) bool {
+	if blobStore == nil {
+		writeProblem(c, http.StatusNotImplemented, codeNotSupported, "Image uploads are not configured")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,300 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/db"
+	"gorm.io/gorm"
+)
+
+const (
+	maxUserNameLength  = 100
+	maxUserEmailLength = 100
+)
+
+// UserPage is the envelope returned by ListUsersHandler
+type UserPage struct {
+	Items      []db.User `json:"items"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// userUpdate holds the fields of a user that can be changed. PATCH leaves
+// nil fields untouched, PUT resets them to their zero value.
+type userUpdate struct {
+	Name  *string
+	Email *string
+}
+
+// CreateUserHandler creates a user. Only admins create users, a seller's
+// user ID must then match the subject of their tokens.
+func CreateUserHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	var user db.User
+	if !bindJSON(c, &user) {
+		return
+	}
+	user.ID = 0
+	normalizeUser(&user)
+
+	if errs := validateUser(&user); len(errs) > 0 {
+		writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "User is invalid", errs...)
+		return
+	}
+
+	err := db.DB.Create(&user).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		writeEmailTaken(c)
+		return
+	}
+	if err != nil {
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to save user")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "User created successfully",
+		"user":    user,
+	})
+}
+
+// ListUsersHandler lists users by ID for admins, paginated with limit and
+// the cursor returned as next_cursor
+func ListUsersHandler(c *gin.Context) {
+	if !requireAdmin(c) {
+		return
+	}
+
+	limit := defaultPageLimit
+	var afterID uint
+	var errs []FieldError
+	if v := c.Query("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxPageLimit {
+			errs = append(errs, FieldError{Field: "limit", Code: "out_of_range", Message: fmt.Sprintf("must be an integer between 1 and %d", maxPageLimit)})
+		}
+		limit = parsed
+	}
+	if token := c.Query("cursor"); token != "" {
+		cursor, err := decodeCursor(token)
+		if err != nil || cursor.Sort != "id" {
+			errs = append(errs, FieldError{Field: "cursor", Code: "malformed", Message: "is not a cursor returned by this endpoint"})
+		}
+		afterID = cursor.ID
+	}
+	if len(errs) > 0 {
+		writeProblem(c, http.StatusBadRequest, codeInvalidQuery, "Query parameters are invalid", errs...)
+		return
+	}
+
+	var users []db.User
+	if err := db.DB.Where("id > ?", afterID).Order("id").Limit(limit + 1).Find(&users).Error; err != nil {
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve users")
+		return
+	}
+
+	page := UserPage{Items: users}
+	if len(users) > limit {
+		page.Items = users[:limit]
+		page.NextCursor = encodeCursor(pageCursor{Sort: "id", Order: "asc", ID: page.Items[limit-1].ID})
+	}
+	if page.Items == nil {
+		page.Items = []db.User{}
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// GetUserHandler returns a user to the user themselves or an admin
+func GetUserHandler(c *gin.Context) {
+	userID, ok := parseID(c)
+	if !ok || !authorizeUser(c, userID) {
+		return
+	}
+
+	var user db.User
+	err := db.DB.First(&user, userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeProblem(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve user")
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// UpdateUserHandler changes the name or email of a user
+func UpdateUserHandler(c *gin.Context) {
+	userID, ok := parseID(c)
+	if !ok || !authorizeUser(c, userID) {
+		return
+	}
+	replace := c.Request.Method == http.MethodPut
+
+	var update userUpdate
+	if !bindJSON(c, &update) {
+		return
+	}
+
+	var user db.User
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&user, userID).Error; err != nil {
+			return err
+		}
+		if update.Name != nil || replace {
+			user.Name = valueOrZero(update.Name)
+		}
+		if update.Email != nil || replace {
+			user.Email = valueOrZero(update.Email)
+		}
+		normalizeUser(&user)
+
+		if errs := validateUser(&user); len(errs) > 0 {
+			return &validationError{errs: errs}
+		}
+		return tx.Save(&user).Error
+	})
+	var invalid *validationError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		writeProblem(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	case errors.As(err, &invalid):
+		writeProblem(c, http.StatusUnprocessableEntity, codeValidationFailed, "User is invalid", invalid.errs...)
+		return
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		writeEmailTaken(c)
+		return
+	case err != nil:
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to update user")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "User updated successfully",
+		"user":    user,
+	})
+}
+
+// DeleteUserHandler deletes a user that no longer sells any product. Their
+// API keys are deleted with them.
+func DeleteUserHandler(c *gin.Context) {
+	userID, ok := parseID(c)
+	if !ok || !requireAdmin(c) {
+		return
+	}
+
+	result := db.DB.Delete(&db.User{}, userID)
+	switch {
+	case errors.Is(result.Error, gorm.ErrForeignKeyViolated):
+		writeProblem(c, http.StatusConflict, codeConflict, "User still has products, delete or reassign them first")
+		return
+	case result.Error != nil:
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to delete user")
+		return
+	case result.RowsAffected == 0:
+		writeProblem(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
+}
+
+// GetUserProductsHandler lists the products of a user with the filters,
+// sorting and pagination of GetAllProductsHandler
+func GetUserProductsHandler(c *gin.Context) {
+	userID, ok := parseID(c)
+	if !ok {
+		return
+	}
+
+	filter, errs := parseProductFilter(c)
+	if len(errs) > 0 {
+		writeProblem(c, http.StatusBadRequest, codeInvalidQuery, "Query parameters are invalid", errs...)
+		return
+	}
+
+	var count int64
+	if err := db.DB.Model(&db.User{}).Where("id = ?", userID).Count(&count).Error; err != nil {
+		writeProblem(c, http.StatusInternalServerError, codeInternal, "Failed to retrieve user")
+		return
+	}
+	if count == 0 {
+		writeProblem(c, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	filter.UserID = userID
+	listProducts(c, filter)
+}
+
+// normalizeUser trims the fields and lowercases the email, so addresses
+// differing only in case are recognized as taken
+func normalizeUser(user *db.User) {
+	user.Name = strings.TrimSpace(user.Name)
+	user.Email = strings.ToLower(strings.TrimSpace(user.Email))
+}
+
+// validateUser checks the rules every stored user must satisfy
+func validateUser(user *db.User) []FieldError {
+	var errs []FieldError
+
+	switch {
+	case user.Name == "":
+		errs = append(errs, FieldError{Field: "Name", Code: "required", Message: "must not be empty"})
+	case len(user.Name) > maxUserNameLength:
+		errs = append(errs, FieldError{Field: "Name", Code: "too_long", Message: fmt.Sprintf("must be at most %d characters", maxUserNameLength)})
+	}
+
+	switch {
+	case user.Email == "":
+		errs = append(errs, FieldError{Field: "Email", Code: "required", Message: "must not be empty"})
+	case len(user.Email) > maxUserEmailLength:
+		errs = append(errs, FieldError{Field: "Email", Code: "too_long", Message: fmt.Sprintf("must be at most %d characters", maxUserEmailLength)})
+	default:
+		// Display names and comments are not part of a stored address
+		addr, err := mail.ParseAddress(user.Email)
+		if err != nil || addr.Address != user.Email {
+			errs = append(errs, FieldError{Field: "Email", Code: "invalid_email", Message: "must be an email address"})
+		}
+	}
+
+	return errs
+}
+
+// requireAdmin writes a problem response unless the caller is an admin
+func requireAdmin(c *gin.Context) bool {
+	if principalOf(c).IsAdmin() {
+		return true
+	}
+	writeProblem(c, http.StatusForbidden, codeForbidden, "Only admins may manage users")
+	return false
+}
+
+// authorizeUser writes a problem response unless the caller is the user or
+// an admin
+func authorizeUser(c *gin.Context, userID uint) bool {
+	principal := principalOf(c)
+	if principal.UserID == userID || principal.IsAdmin() {
+		return true
+	}
+	writeProblem(c, http.StatusForbidden, codeForbidden, "Only the user or an admin may access this user")
+	return false
+}
+
+func writeEmailTaken(c *gin.Context) {
+	writeProblem(c, http.StatusConflict, codeConflict, "Email is already taken", FieldError{
+		Field:   "Email",
+		Code:    "taken",
+		Message: "is used by another user",
+	})
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/db"
+	"github.com/mohammadshaad/zocket/pkg/money"
+)
+
+const (
+	maxProductNameLength = 255
+	maxProductImages     = 10
+	maxImageURLLength    = 2048
+)
+
+// validationError carries field errors out of a database transaction
+type validationError struct {
+	errs []FieldError
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("%d invalid fields", len(e.errs))
+}
+
+// bindJSON decodes the request body and writes a problem response when the
+// body is not valid JSON or a field has the wrong type
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr):
+		writeProblem(c, http.StatusBadRequest, codeMalformedBody, "Request body has a field of the wrong type", FieldError{
+			Field:   typeErr.Field,
+			Code:    "invalid_type",
+			Message: fmt.Sprintf("must be of type %s", typeErr.Type),
+		})
+	case errors.Is(err, money.ErrInvalidAmount), errors.Is(err, money.ErrUnknownCurrency):
+		writeProblem(c, http.StatusBadRequest, codeMalformedBody, "Request body has an invalid price", FieldError{
+			Field:   "ProductPrice",
+			Code:    "invalid_price",
+			Message: err.Error(),
+		})
+	case errors.Is(err, io.EOF):
+		writeProblem(c, http.StatusBadRequest, codeMalformedBody, "Request body is empty")
+	default:
+		writeProblem(c, http.StatusBadRequest, codeMalformedBody, "Request body is not valid JSON")
+	}
+	return false
+}
+
+// parseID reads the :id path parameter and writes a problem response when it
+// is not a positive integer
+func parseID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil || id == 0 {
+		writeProblem(c, http.StatusBadRequest, codeInvalidID, "Path parameter id must be a positive integer", FieldError{
+			Field:   "id",
+			Code:    "invalid_id",
+			Message: "must be a positive integer",
+		})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// validateProduct checks the business rules every stored product must satisfy
+func validateProduct(product *db.Product) []FieldError {
+	var errs []FieldError
+
+	name := strings.TrimSpace(product.ProductName)
+	switch {
+	case name == "":
+		errs = append(errs, FieldError{Field: "ProductName", Code: "required", Message: "must not be empty"})
+	case len(product.ProductName) > maxProductNameLength:
+		errs = append(errs, FieldError{Field: "ProductName", Code: "too_long", Message: fmt.Sprintf("must be at most %d characters", maxProductNameLength)})
+	}
+
+	switch {
+	case product.ProductPrice.Amount <= 0:
+		errs = append(errs, FieldError{Field: "ProductPrice", Code: "not_positive", Message: "must be greater than zero"})
+	case !exchangeRates.Supports(product.ProductPrice.Currency):
+		errs = append(errs, FieldError{Field: "ProductPrice", Code: "unsupported_currency", Message: currencyMessage()})
+	}
+
+	if len(product.ProductImages) > maxProductImages {
+		errs = append(errs, FieldError{Field: "ProductImages", Code: "too_many", Message: fmt.Sprintf("must contain at most %d images", maxProductImages)})
+	}
+	for i, image := range product.ProductImages {
+		if err := validateImageURL(image); err != "" {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("ProductImages[%d]", i), Code: "invalid_url", Message: err})
+		}
+	}
+
+	return errs
+}
+
+// validateImageURL returns a message describing why the URL is not an
+// absolute http(s) URL, or an empty string when it is valid
+func validateImageURL(raw string) string {
+	if len(raw) > maxImageURLLength {
+		return fmt.Sprintf("must be at most %d characters", maxImageURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return "must be an absolute URL"
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "must use http or https"
+	}
+	return ""
+}
+
+// productFilter holds the validated query parameters of GetAllProductsHandler
+type productFilter struct {
+	UserID   uint
+	MinPrice *money.Money
+	MaxPrice *money.Money
+	// Currency is the currency prices are shown in, empty to keep the
+	// currency of each product. Price bounds are in this currency, or in the
+	// base currency when it is empty.
+	Currency string
+	Sort     string
+	Order    string
+	Limit    int
+	Cursor   *pageCursor
+}
+
+// parseProductFilter validates the listing query parameters, collecting every
+// problem instead of stopping at the first one
+func parseProductFilter(c *gin.Context) (productFilter, []FieldError) {
+	filter := productFilter{
+		Sort:  c.DefaultQuery("sort", "created_at"),
+		Order: c.DefaultQuery("order", "desc"),
+		Limit: defaultPageLimit,
+	}
+	var errs []FieldError
+
+	if v := c.Query("user_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || id == 0 {
+			errs = append(errs, FieldError{Field: "user_id", Code: "invalid_id", Message: "must be a positive integer"})
+		}
+		filter.UserID = uint(id)
+	}
+
+	boundCurrency := exchangeRates.Base()
+	if v := c.Query("currency"); v != "" {
+		filter.Currency = strings.ToUpper(v)
+		if exchangeRates.Supports(filter.Currency) {
+			boundCurrency = filter.Currency
+		} else {
+			errs = append(errs, FieldError{Field: "currency", Code: "unsupported_currency", Message: currencyMessage()})
+		}
+	}
+
+	filter.MinPrice, errs = parsePrice(c, "min_price", boundCurrency, errs)
+	filter.MaxPrice, errs = parsePrice(c, "max_price", boundCurrency, errs)
+	if filter.MinPrice != nil && filter.MaxPrice != nil && filter.MinPrice.Amount > filter.MaxPrice.Amount {
+		errs = append(errs, FieldError{Field: "min_price", Code: "out_of_range", Message: "must not be greater than max_price"})
+	}
+
+	if _, ok := sortColumns[filter.Sort]; !ok {
+		errs = append(errs, FieldError{Field: "sort", Code: "invalid_value", Message: "must be one of price, created_at, name"})
+	}
+	if filter.Order != "asc" && filter.Order != "desc" {
+		errs = append(errs, FieldError{Field: "order", Code: "invalid_value", Message: "must be asc or desc"})
+	}
+
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			errs = append(errs, FieldError{Field: "limit", Code: "out_of_range", Message: fmt.Sprintf("must be an integer between 1 and %d", maxPageLimit)})
+		}
+		filter.Limit = limit
+	}
+
+	if token := c.Query("cursor"); token != "" {
+		cursor, err := decodeCursor(token)
+		if err == nil {
+			_, err = cursorValue(cursor)
+		}
+		switch {
+		case err != nil:
+			errs = append(errs, FieldError{Field: "cursor", Code: "malformed", Message: "is not a cursor returned by this endpoint"})
+		case cursor.Sort != filter.Sort || cursor.Order != filter.Order:
+			errs = append(errs, FieldError{Field: "cursor", Code: "mismatch", Message: "was issued for a different sort or order"})
+		default:
+			filter.Cursor = &cursor
+		}
+	}
+
+	return filter, errs
+}
+
+func parsePrice(c *gin.Context, name, currency string, errs []FieldError) (*money.Money, []FieldError) {
+	v := c.Query(name)
+	if v == "" {
+		return nil, errs
+	}
+	price, err := money.Parse(v, currency)
+	if err != nil || price.Amount < 0 {
+		exp, _ := money.Exponent(currency)
+		return nil, append(errs, FieldError{Field: name, Code: "invalid_number", Message: fmt.Sprintf("must be a non-negative number with at most %d decimals", exp)})
+	}
+	return &price, errs
+}
+
+func currencyMessage() string {
+	return "must be one of " + strings.Join(exchangeRates.Currencies(), ", ")
+}
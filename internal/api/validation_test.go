@@ -0,0 +1,124 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mohammadshaad/zocket/internal/db"
+	"github.com/mohammadshaad/zocket/pkg/money"
+	"github.com/stretchr/testify/assert"
+)
+
+func fieldsOf(errs []FieldError) []string {
+	var fields []string
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+	return fields
+}
+
+func TestValidateProduct(t *testing.T) {
+	valid := db.Product{
+		ProductName:   "Lamp",
+		ProductPrice:  money.MustParse("19.99", "USD"),
+		ProductImages: []string{"https://example.com/lamp.jpg"},
+	}
+	assert.Empty(t, validateProduct(&valid))
+
+	invalid := db.Product{
+		ProductName:   "   ",
+		ProductPrice:  money.MustParse("-1", "USD"),
+		ProductImages: []string{"https://example.com/ok.jpg", "/relative.jpg", "ftp://example.com/a.jpg"},
+	}
+	assert.Equal(t,
+		[]string{"ProductName", "ProductPrice", "ProductImages[1]", "ProductImages[2]"},
+		fieldsOf(validateProduct(&invalid)))
+
+	tooMany := valid
+	tooMany.ProductImages = make([]string, maxProductImages+1)
+	for i := range tooMany.ProductImages {
+		tooMany.ProductImages[i] = "https://example.com/a.jpg"
+	}
+	assert.Equal(t, []string{"ProductImages"}, fieldsOf(validateProduct(&tooMany)))
+}
+
+func TestParseProductFilter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	parse := func(query string) (productFilter, []FieldError) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/api/v1/products?"+query, nil)
+		return parseProductFilter(c)
+	}
+
+	filter, errs := parse("user_id=3&min_price=1.5&max_price=10&sort=price&order=asc&limit=5")
+	assert.Empty(t, errs)
+	assert.Equal(t, uint(3), filter.UserID)
+	assert.Equal(t, money.MustParse("1.5", "USD"), *filter.MinPrice)
+	assert.Equal(t, 5, filter.Limit)
+
+	_, errs = parse("user_id=abc&min_price=abc&max_price=-1&sort=color&order=up&limit=1000&cursor=!!!")
+	assert.Equal(t,
+		[]string{"user_id", "min_price", "max_price", "sort", "order", "limit", "cursor"},
+		fieldsOf(errs))
+
+	_, errs = parse("min_price=10&max_price=5")
+	assert.Equal(t, []string{"min_price"}, fieldsOf(errs))
+
+	_, errs = parse("min_price=1.005")
+	assert.Equal(t, []string{"min_price"}, fieldsOf(errs))
+
+	cursor := encodeCursor(pageCursor{Sort: "name", Order: "asc", Value: "a", ID: 1})
+	_, errs = parse("sort=price&cursor=" + cursor)
+	assert.Equal(t, []string{"cursor"}, fieldsOf(errs))
+}
+
+func TestPricesInOtherCurrencies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rates, err := money.ParseRates("USD", "EUR=1.08,JPY=0.0067")
+	assert.NoError(t, err)
+	previous := exchangeRates
+	InitExchangeRates(rates)
+	defer InitExchangeRates(previous)
+
+	parse := func(query string) (productFilter, []FieldError) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/api/v1/products?"+query, nil)
+		return parseProductFilter(c)
+	}
+
+	// Bounds are read in the requested currency
+	filter, errs := parse("currency=jpy&min_price=1500")
+	assert.Empty(t, errs)
+	assert.Equal(t, "JPY", filter.Currency)
+	assert.Equal(t, money.MustParse("1500", "JPY"), *filter.MinPrice)
+	_, errs = parse("currency=JPY&min_price=1500.5")
+	assert.Equal(t, []string{"min_price"}, fieldsOf(errs))
+	_, errs = parse("currency=GBP")
+	assert.Equal(t, []string{"currency"}, fieldsOf(errs))
+
+	product := db.Product{ProductName: "Lamp", ProductPrice: money.MustParse("19.99", "GBP")}
+	assert.Equal(t, []string{"ProductPrice"}, fieldsOf(validateProduct(&product)))
+
+	product.ProductPrice = money.MustParse("100", "EUR")
+	assert.Empty(t, validateProduct(&product))
+	convertPrices("USD", &product)
+	assert.Equal(t, money.MustParse("108", "USD"), product.ProductPrice)
+
+	assert.Equal(t, "(CASE price_currency WHEN 'EUR' THEN price_amount * 0.0108 WHEN 'JPY' THEN price_amount * 0.0067 WHEN 'USD' THEN price_amount * 0.01 END)", basePriceSQL())
+}
+
+func TestValidateUser(t *testing.T) {
+	user := db.User{Name: "  Ada ", Email: " Ada@Example.com "}
+	normalizeUser(&user)
+	assert.Equal(t, db.User{Name: "Ada", Email: "ada@example.com"}, user)
+	assert.Empty(t, validateUser(&user))
+
+	for _, email := range []string{"", "ada", "Ada <ada@example.com>", "ada@example.com (work)"} {
+		invalid := db.User{Name: "Ada", Email: email}
+		assert.Equal(t, []string{"Email"}, fieldsOf(validateUser(&invalid)), email)
+	}
+	assert.Equal(t, []string{"Name"}, fieldsOf(validateUser(&db.User{Email: "ada@example.com"})))
+}
@@ -0,0 +1,242 @@
+// Package auth verifies the JWT bearer tokens sellers and admins call the
+// API with
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mohammadshaad/zocket/config"
+)
+
+// Supported signing algorithms
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+)
+
+// Scopes limit what a caller may do. Admin implies every other scope.
+const (
+	ScopeProductsRead  = "products:read"
+	ScopeProductsWrite = "products:write"
+	ScopeUsersWrite    = "users:write"
+	ScopeAdmin         = "admin"
+)
+
+// Scopes lists every scope
+var Scopes = []string{ScopeProductsRead, ScopeProductsWrite, ScopeUsersWrite, ScopeAdmin}
+
+// ErrInvalidToken is returned for tokens that are malformed, expired, badly
+// signed or have no usable subject
+var ErrInvalidToken = errors.New("invalid token")
+
+// Config selects the algorithm and keys tokens are verified with
+type Config struct {
+	// Algorithm is HS256 or RS256, tokens signed otherwise are rejected
+	Algorithm string
+	// Secret is the shared HS256 key
+	Secret string
+	// PublicKeyFile is a PEM encoded RS256 public key
+	PublicKeyFile string
+	// JWKSFile is a local JSON Web Key Set of RS256 keys, selected by the
+	// kid header of the token. It takes precedence over PublicKeyFile.
+	JWKSFile string
+	// Issuer and Audience are checked when set
+	Issuer   string
+	Audience string
+	// AdminRole is the role that may act on every seller's products
+	AdminRole string
+	// Leeway tolerates clock skew when checking expiry
+	Leeway time.Duration
+}
+
+// Configured reports whether keys to verify tokens with are set
+func (c Config) Configured() bool {
+	return c.Secret != "" || c.PublicKeyFile != "" || c.JWKSFile != ""
+}
+
+// ConfigFromEnv reads the token verification settings from the environment
+func ConfigFromEnv() Config {
+	return Config{
+		Algorithm:     config.GetEnv("JWT_ALGORITHM", AlgorithmHS256),
+		Secret:        config.GetEnv("JWT_HMAC_SECRET", ""),
+		PublicKeyFile: config.GetEnv("JWT_PUBLIC_KEY_FILE", ""),
+		JWKSFile:      config.GetEnv("JWT_JWKS_FILE", ""),
+		Issuer:        config.GetEnv("JWT_ISSUER", ""),
+		Audience:      config.GetEnv("JWT_AUDIENCE", ""),
+		AdminRole:     config.GetEnv("JWT_ADMIN_ROLE", "admin"),
+		Leeway:        config.GetEnvDuration("JWT_LEEWAY", 30*time.Second),
+	}
+}
+
+// Claims are the claims read from a token. The subject is the user ID.
+type Claims struct {
+	jwt.RegisteredClaims
+	Roles []string `json:"roles,omitempty"`
+}
+
+// Principal is the authenticated caller
+type Principal struct {
+	UserID uint
+	Roles  []string
+	Scopes []string
+	// APIKeyID is the key the caller authenticated with, 0 for tokens
+	APIKeyID uint
+}
+
+// HasScope reports whether the caller was granted the scope
+func (p *Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, ScopeAdmin)
+}
+
+// IsAdmin reports whether the caller may act on every seller's products
+func (p *Principal) IsAdmin() bool {
+	return p.HasScope(ScopeAdmin)
+}
+
+// CanModify reports whether the caller may change a product of the seller
+func (p *Principal) CanModify(ownerID uint) bool {
+	return p.HasScope(ScopeProductsWrite) && (p.IsAdmin() || p.UserID == ownerID)
+}
+
+// Verifier checks token signatures and claims
+type Verifier struct {
+	cfg    Config
+	parser *jwt.Parser
+	key    jwt.Keyfunc
+}
+
+// NewVerifier loads the keys of cfg
+func NewVerifier(cfg Config) (*Verifier, error) {
+	var key jwt.Keyfunc
+	switch cfg.Algorithm {
+	case AlgorithmHS256:
+		// Short secrets can be brute forced offline from any token
+		if len(cfg.Secret) < 32 {
+			return nil, fmt.Errorf("JWT_HMAC_SECRET must be at least 32 bytes for HS256")
+		}
+		secret := []byte(cfg.Secret)
+		key = func(*jwt.Token) (interface{}, error) { return secret, nil }
+	case AlgorithmRS256:
+		switch {
+		case cfg.JWKSFile != "":
+			keys, err := loadJWKS(cfg.JWKSFile)
+			if err != nil {
+				return nil, err
+			}
+			key = keys.keyfunc
+		case cfg.PublicKeyFile != "":
+			data, err := os.ReadFile(cfg.PublicKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading JWT public key: %w", err)
+			}
+			publicKey, err := jwt.ParseRSAPublicKeyFromPEM(data)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing JWT public key: %w", err)
+			}
+			key = func(*jwt.Token) (interface{}, error) { return publicKey, nil }
+		default:
+			return nil, fmt.Errorf("JWT_JWKS_FILE or JWT_PUBLIC_KEY_FILE is required for RS256")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q, use HS256 or RS256", cfg.Algorithm)
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{cfg.Algorithm}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.Leeway),
+	}
+	if cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		options = append(options, jwt.WithAudience(cfg.Audience))
+	}
+	return &Verifier{cfg: cfg, parser: jwt.NewParser(options...), key: key}, nil
+}
+
+// Verify checks the token and returns the caller it was issued to
+func (v *Verifier) Verify(token string) (*Principal, error) {
+	var claims Claims
+	if _, err := v.parser.ParseWithClaims(token, &claims, v.key); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	userID, err := strconv.ParseUint(claims.Subject, 10, 32)
+	if err != nil || userID == 0 {
+		return nil, fmt.Errorf("%w: subject must be a user ID", ErrInvalidToken)
+	}
+	// Users may do everything with their own products and account
+	scopes := []string{ScopeProductsRead, ScopeProductsWrite, ScopeUsersWrite}
+	if v.cfg.AdminRole != "" && slices.Contains(claims.Roles, v.cfg.AdminRole) {
+		scopes = append(scopes, ScopeAdmin)
+	}
+	return &Principal{UserID: uint(userID), Roles: claims.Roles, Scopes: scopes}, nil
+}
+
+// jwks holds the RSA keys of a JSON Web Key Set by kid
+type jwks map[string]*rsa.PublicKey
+
+func loadJWKS(path string) (jwks, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWKS: %w", err)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS: %w", err)
+	}
+
+	keys := make(jwks)
+	for _, k := range set.Keys {
+		// Encryption keys and keys meant for other algorithms are skipped
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != AlgorithmRS256) {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("JWKS key %q has an invalid modulus or exponent", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS %s has no RS256 signing keys", path)
+	}
+	return keys, nil
+}
+
+// keyfunc selects the key named by the kid header, or the only key of the
+// set when the token has none
+func (keys jwks) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func claimsFor(subject string, roles ...string) Claims {
+	return Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Roles: roles,
+	}
+}
+
+func TestVerifyHS256(t *testing.T) {
+	assert.False(t, Config{Algorithm: AlgorithmHS256}.Configured())
+	assert.True(t, Config{Algorithm: AlgorithmHS256, Secret: testSecret}.Configured())
+
+	verifier, err := NewVerifier(Config{Algorithm: AlgorithmHS256, Secret: testSecret, AdminRole: "admin"})
+	require.NoError(t, err)
+
+	principal, err := verifier.Verify(sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claimsFor("7")))
+	require.NoError(t, err)
+	assert.Equal(t, uint(7), principal.UserID)
+	assert.False(t, principal.IsAdmin())
+	assert.True(t, principal.CanModify(7))
+	assert.False(t, principal.CanModify(8))
+
+	principal, err = verifier.Verify(sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claimsFor("7", "admin")))
+	require.NoError(t, err)
+	assert.True(t, principal.CanModify(8))
+
+	expired := claimsFor("7")
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	noExpiry := claimsFor("7")
+	noExpiry.ExpiresAt = nil
+	for name, token := range map[string]string{
+		"wrong key":    sign(t, jwt.SigningMethodHS256, []byte("another secret, another secret!!"), "", claimsFor("7")),
+		"wrong method": sign(t, jwt.SigningMethodHS384, []byte(testSecret), "", claimsFor("7")),
+		"expired":      sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", expired),
+		"no expiry":    sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", noExpiry),
+		"bad subject":  sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claimsFor("alice")),
+		"zero subject": sign(t, jwt.SigningMethodHS256, []byte(testSecret), "", claimsFor("0")),
+		"garbage":      "not.a.token",
+	} {
+		_, err := verifier.Verify(token)
+		assert.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+
+	_, err = NewVerifier(Config{Algorithm: AlgorithmHS256, Secret: "short"})
+	assert.Error(t, err)
+}
+
+func TestVerifyRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	pemFile := filepath.Join(dir, "public.pem")
+	require.NoError(t, os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "key-1",
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	jwksFile := filepath.Join(dir, "jwks.json")
+	require.NoError(t, os.WriteFile(jwksFile, jwks, 0o600))
+
+	for name, cfg := range map[string]Config{
+		"pem":  {Algorithm: AlgorithmRS256, PublicKeyFile: pemFile},
+		"jwks": {Algorithm: AlgorithmRS256, JWKSFile: jwksFile},
+	} {
+		verifier, err := NewVerifier(cfg)
+		require.NoError(t, err, name)
+
+		principal, err := verifier.Verify(sign(t, jwt.SigningMethodRS256, key, "key-1", claimsFor("42")))
+		require.NoError(t, err, name)
+		assert.Equal(t, uint(42), principal.UserID, name)
+
+		// A token signed with the public key as HMAC secret must not pass
+		_, err = verifier.Verify(sign(t, jwt.SigningMethodHS256, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), "key-1", claimsFor("42")))
+		assert.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+
+	verifier, err := NewVerifier(Config{Algorithm: AlgorithmRS256, JWKSFile: jwksFile})
+	require.NoError(t, err)
+	_, err = verifier.Verify(sign(t, jwt.SigningMethodRS256, key, "key-2", claimsFor("42")))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestAPIKeys(t *testing.T) {
+	key, id, hash, err := NewAPIKey()
+	require.NoError(t, err)
+	assert.True(t, LooksLikeAPIKey(key))
+	assert.Contains(t, key, "zk_"+id+"_")
+	assert.Equal(t, HashAPIKey(key), hash)
+	assert.Len(t, hash, 64)
+
+	other, _, _, err := NewAPIKey()
+	require.NoError(t, err)
+	assert.NotEqual(t, key, other)
+
+	for _, value := range []string{"", "zk_", "zk_abcdefgh", "sk_" + key[3:], key + "x"} {
+		assert.False(t, LooksLikeAPIKey(value), value)
+	}
+}
+
+func TestPrincipalScopes(t *testing.T) {
+	reader := &Principal{UserID: 1, Scopes: []string{ScopeProductsRead}}
+	assert.True(t, reader.HasScope(ScopeProductsRead))
+	assert.False(t, reader.CanModify(1))
+
+	writer := &Principal{UserID: 1, Scopes: []string{ScopeProductsWrite}}
+	assert.True(t, writer.CanModify(1))
+	assert.False(t, writer.CanModify(2))
+
+	admin := &Principal{UserID: 1, Scopes: []string{ScopeAdmin}}
+	assert.True(t, admin.HasScope(ScopeProductsWrite))
+	assert.True(t, admin.CanModify(2))
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const idempotencyKeyPrefix = "idempotency:"
+
+// IdempotentResponse is the record of a request sent with an Idempotency-Key.
+// Until the request completes only its fingerprint is set.
+type IdempotentResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Completed   bool   `json:"completed"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// ReserveIdempotencyKey claims the key for a request with the fingerprint
+// for at most lock. It returns nil when the caller now owns the key, or the
+// record of the request that claimed it first.
+func ReserveIdempotencyKey(key, fingerprint string, lock time.Duration) (*IdempotentResponse, error) {
+	if rdb == nil {
+		return nil, errors.New("redis is not initialized")
+	}
+	data, err := json.Marshal(IdempotentResponse{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+
+	// The record may expire between SETNX and GET, then claim it again
+	for {
+		reserved, err := rdb.SetNX(ctx, idempotencyKeyPrefix+key, data, lock).Result()
+		if err != nil || reserved {
+			return nil, err
+		}
+
+		existing, err := rdb.Get(ctx, idempotencyKeyPrefix+key).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var record IdempotentResponse
+		if err := json.Unmarshal(existing, &record); err != nil {
+			return nil, err
+		}
+		return &record, nil
+	}
+}
+
+// SaveIdempotentResponse completes the record of a reserved key, replayed to
+// retries for ttl
+func SaveIdempotentResponse(key string, response IdempotentResponse, ttl time.Duration) error {
+	response.Completed = true
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return rdb.Set(ctx, idempotencyKeyPrefix+key, data, ttl).Err()
+}
+
+// ReleaseIdempotencyKey forgets a reserved key so the request can be retried
+func ReleaseIdempotencyKey(key string) error {
+	return rdb.Del(ctx, idempotencyKeyPrefix+key).Err()
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const rateLimitKeyPrefix = "ratelimit:"
+
+// RateLimitResult is the outcome of one request against a limit
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the oldest request in the window expires and
+	// frees a slot
+	Reset time.Duration
+}
+
+// slidingWindowScript keeps the timestamps of the requests of the last
+// window in a sorted set. Everything runs in Redis with the Redis clock, so
+// the limit holds across API replicas even when their clocks drift.
+var slidingWindowScript = redis.NewScript(`
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local member = ARGV[3]
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local count = redis.call('ZCARD', key)
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', key, now, member)
+	count = count + 1
+	allowed = 1
+end
+redis.call('PEXPIRE', key, math.ceil(window / 1000))
+
+local reset = 0
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, limit - count, reset}
+`)
+
+// AllowRequest records a request of the client against a sliding window
+// limit and reports whether it is within the limit. Rejected requests are
+// not recorded.
+func AllowRequest(key string, limit int, window time.Duration) (RateLimitResult, error) {
+	if rdb == nil {
+		return RateLimitResult{}, errors.New("redis is not initialized")
+	}
+
+	// Requests in the same microsecond need distinct members
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return RateLimitResult{}, err
+	}
+
+	values, err := slidingWindowScript.Run(ctx, rdb,
+		[]string{rateLimitKeyPrefix + key},
+		limit, window.Microseconds(), hex.EncodeToString(suffix),
+	).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	if len(values) != 3 {
+		return RateLimitResult{}, fmt.Errorf("unexpected rate limit reply %v", values)
+	}
+
+	return RateLimitResult{
+		Allowed:   values[0] == 1,
+		Limit:     limit,
+		Remaining: int(values[1]),
+		Reset:     time.Duration(values[2]) * time.Microsecond,
+	}, nil
+}
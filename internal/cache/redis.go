@@ -35,6 +35,15 @@ func InitRedis(addr, username, password string) {
     log.Println("Successfully connected to Redis")
 }
 
+// CloseRedis closes the Redis client
+func CloseRedis() {
+    if rdb != nil {
+        if err := rdb.Close(); err != nil {
+            log.Printf("Error closing Redis client: %v", err)
+        }
+    }
+}
+
 // GetProductFromCache retrieves a product from cache
 func GetProductFromCache(productID string) (*db.Product, error) {
     key := fmt.Sprintf("%s%s", productKeyPrefix, productID)
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// APIKey lets a machine client act as a user within the granted scopes. Only
+// the hash of the key is stored; KeyID is the short public part of the key
+// that identifies it in listings.
+type APIKey struct {
+	ID         uint           `gorm:"primaryKey"`
+	UserID     uint           `gorm:"not null;index:idx_api_keys_user_id,priority:1"`
+	Name       string         `gorm:"size:100;not null"`
+	KeyID      string         `gorm:"type:char(8);not null"`
+	KeyHash    string         `gorm:"type:char(64);not null;unique" json:"-"`
+	Scopes     GormStringList `gorm:"type:text[];not null"`
+	ExpiresAt  time.Time      `gorm:"type:timestamp with time zone;not null"`
+	LastUsedAt *time.Time     `gorm:"type:timestamp with time zone"`
+	RevokedAt  *time.Time     `gorm:"type:timestamp with time zone"`
+	CreatedAt  time.Time      `gorm:"type:timestamp with time zone"`
+}
+
+// Active reports whether the key may still be used
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && now.Before(k.ExpiresAt)
+}
+
+// CreateAPIKey stores a new key
+func CreateAPIKey(key *APIKey) error {
+	return DB.Create(key).Error
+}
+
+// ListAPIKeys returns every key of the user, revoked and expired ones
+// included, oldest first
+func ListAPIKeys(userID uint) ([]APIKey, error) {
+	var keys []APIKey
+	err := DB.Where("user_id = ?", userID).Order("id").Find(&keys).Error
+	return keys, err
+}
+
+// GetAPIKey returns a key by ID
+func GetAPIKey(id uint) (APIKey, error) {
+	var key APIKey
+	err := DB.First(&key, id).Error
+	return key, err
+}
+
+// FindAPIKeyByHash returns the key with the given hash
+func FindAPIKeyByHash(hash string) (APIKey, error) {
+	var key APIKey
+	err := DB.Where("key_hash = ?", hash).Take(&key).Error
+	return key, err
+}
+
+// RevokeAPIKey revokes a key immediately. Revoking a key twice keeps the
+// first revocation time.
+func RevokeAPIKey(id uint, at time.Time) error {
+	return DB.Model(&APIKey{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", at).Error
+}
+
+// RotateAPIKey stores the replacement of a key and shortens the expiry of
+// the old key to graceUntil, so clients can switch over without downtime.
+// It returns gorm.ErrRecordNotFound when the old key is no longer active.
+func RotateAPIKey(oldID uint, replacement *APIKey, graceUntil time.Time) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		var old APIKey
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&old, oldID).Error; err != nil {
+			return err
+		}
+		if !old.Active(time.Now()) {
+			return gorm.ErrRecordNotFound
+		}
+		if err := tx.Create(replacement).Error; err != nil {
+			return err
+		}
+		if graceUntil.Before(old.ExpiresAt) {
+			return tx.Model(&old).Update("expires_at", graceUntil).Error
+		}
+		return nil
+	})
+}
+
+// TouchAPIKey records that the key was used. The row is written at most once
+// per interval, so busy clients do not cause a write per request.
+func TouchAPIKey(id uint, now time.Time, interval time.Duration) error {
+	return DB.Model(&APIKey{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", id, now.Add(-interval)).
+		Update("last_used_at", now).Error
+}
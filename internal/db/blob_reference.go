@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// BlobReference records that a product image uses a stored object. Objects
+// are content addressed and shared between images, so an object may only be
+// deleted once no reference to its key is left.
+type BlobReference struct {
+	Key       string    `gorm:"type:text;primaryKey"`
+	ProductID uint      `gorm:"primaryKey;index:idx_blob_references_product_url,priority:1"`
+	SourceURL string    `gorm:"type:text;primaryKey;index:idx_blob_references_product_url,priority:2"`
+	CreatedAt time.Time `gorm:"type:timestamp with time zone"`
+}
+
+// blobKeyLockClass namespaces the advisory locks taken on object keys
+const blobKeyLockClass = 7_402_114
+
+// ReserveBlobReference records that a product image is about to use an
+// object, before the caller checks whether it exists. The collector deletes
+// objects under LockBlobKey, so once this returns the object is either kept
+// for the image or already gone and uploaded again by the caller. It reports
+// whether the reference is new, an earlier processing run of the image may
+// already use the object.
+func ReserveBlobReference(productID uint, sourceURL, key string) (bool, error) {
+	var created bool
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock_shared(?, hashtext(?))", blobKeyLockClass, key).Error; err != nil {
+			return err
+		}
+		ref := BlobReference{Key: key, ProductID: productID, SourceURL: sourceURL}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ref)
+		created = result.RowsAffected > 0
+		return result.Error
+	})
+	return created, err
+}
+
+// ReleaseBlobReferences drops references reserved for a product image whose
+// processing failed
+func ReleaseBlobReferences(productID uint, sourceURL string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return DB.Where("product_id = ? AND source_url = ? AND key IN ?", productID, sourceURL, keys).Delete(&BlobReference{}).Error
+}
+
+// LockBlobKey runs fn while no reference to the object can be reserved
+func LockBlobKey(ctx context.Context, key string, fn func() error) error {
+	return DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?, hashtext(?))", blobKeyLockClass, key).Error; err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+// ReplaceBlobReferences sets the objects used by a product image, dropping
+// the references of an earlier processing run
+func ReplaceBlobReferences(productID uint, sourceURL string, keys []string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := DeleteBlobReferences(tx, productID, []string{sourceURL}); err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		refs := make([]BlobReference, 0, len(keys))
+		for _, key := range keys {
+			refs = append(refs, BlobReference{Key: key, ProductID: productID, SourceURL: sourceURL})
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&refs).Error
+	})
+}
+
+// DeleteBlobReferences removes the references of the given images, or of
+// every image of the product when urls is nil
+func DeleteBlobReferences(tx *gorm.DB, productID uint, urls []string) error {
+	query := tx.Where("product_id = ?", productID)
+	if urls != nil {
+		if len(urls) == 0 {
+			return nil
+		}
+		query = query.Where("source_url IN ?", urls)
+	}
+	return query.Delete(&BlobReference{}).Error
+}
+
+// CountBlobReferences returns how many product images use the object
+func CountBlobReferences(key string) (int64, error) {
+	var count int64
+	err := DB.Model(&BlobReference{}).Where("key = ?", key).Count(&count).Error
+	return count, err
+}
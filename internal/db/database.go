@@ -13,10 +13,26 @@ var DB *gorm.DB
 func InitDatabase() {
 	dsn := os.Getenv("DATABASE_DSN")
 	var err error
-	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	// Constraint violations are translated to gorm.ErrDuplicatedKey and
+	// gorm.ErrForeignKeyViolated so handlers can answer 409 and 422
+	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		log.Fatalf("Error connecting to database: %v", err)
 	}
 
 	log.Println("Connected to database")
-}
\ No newline at end of file
+}
+// CloseDatabase closes the underlying connection pool
+func CloseDatabase() {
+	if DB == nil {
+		return
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		log.Printf("Error getting database connection pool: %v", err)
+		return
+	}
+	if err := sqlDB.Close(); err != nil {
+		log.Printf("Error closing database: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ImageHash stores the perceptual hash of a processed product image. The
+// 64-bit hash is stored as a signed bigint.
+type ImageHash struct {
+	ID        uint      `gorm:"primaryKey"`
+	ProductID uint      `gorm:"not null;uniqueIndex:idx_image_hashes_product_url,priority:1"`
+	ImageURL  string    `gorm:"type:text;not null;uniqueIndex:idx_image_hashes_product_url,priority:2"`
+	Hash      int64     `gorm:"not null;index"`
+	CreatedAt time.Time `gorm:"type:timestamp with time zone"`
+}
+
+// SimilarProduct is a product with an image close to an image of another
+// product
+type SimilarProduct struct {
+	ProductID uint
+	Distance  int
+}
+
+// hammingDistanceSQL counts the differing bits of two hashes. bit_count only
+// exists from PostgreSQL 14 on.
+const hammingDistanceSQL = "length(replace(((mine.hash # other.hash)::bit(64))::text, '0', ''))"
+
+// SaveImageHash records the perceptual hash of a product image
+func SaveImageHash(productID uint, url string, hash uint64) error {
+	record := ImageHash{ProductID: productID, ImageURL: url, Hash: int64(hash)}
+	return DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "product_id"}, {Name: "image_url"}},
+		DoUpdates: clause.AssignmentColumns([]string{"hash"}),
+	}).Create(&record).Error
+}
+
+// FindDuplicateImage returns another image with exactly the given hash in
+// the catalog of the seller of the product, or nil when there is none
+func FindDuplicateImage(productID uint, url string, hash uint64) (*ImageHash, error) {
+	var duplicate ImageHash
+	err := DB.Table("image_hashes AS h").
+		Select("h.*").
+		Joins("JOIN products p ON p.id = h.product_id").
+		Where("h.hash = ?", int64(hash)).
+		Where("p.user_id = (SELECT user_id FROM products WHERE id = ?)", productID).
+		Where("NOT (h.product_id = ? AND h.image_url = ?)", productID, url).
+		Order("h.product_id, h.id").
+		Take(&duplicate).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &duplicate, nil
+}
+
+// FindSimilarProducts returns the products having an image within
+// maxDistance bits of an image of the product, closest first
+func FindSimilarProducts(productID uint, maxDistance, limit int) ([]SimilarProduct, error) {
+	var similar []SimilarProduct
+	err := DB.Table("image_hashes AS mine").
+		Select("other.product_id AS product_id, MIN("+hammingDistanceSQL+") AS distance").
+		Joins("JOIN image_hashes other ON other.product_id <> mine.product_id").
+		Where("mine.product_id = ?", productID).
+		Where(hammingDistanceSQL+" <= ?", maxDistance).
+		Group("other.product_id").
+		Order("distance, other.product_id").
+		Limit(limit).
+		Scan(&similar).Error
+	return similar, err
+}
+
+// DeleteImageHashes removes the hashes of the given images, or of every
+// image of the product when urls is nil
+func DeleteImageHashes(tx *gorm.DB, productID uint, urls []string) error {
+	query := tx.Where("product_id = ?", productID)
+	if urls != nil {
+		if len(urls) == 0 {
+			return nil
+		}
+		query = query.Where("image_url IN ?", urls)
+	}
+	return query.Delete(&ImageHash{}).Error
+}
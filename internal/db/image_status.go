@@ -0,0 +1,167 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Processing states of a product image
+const (
+	ImageStatusPending    = "pending"
+	ImageStatusProcessing = "processing"
+	ImageStatusDone       = "done"
+	ImageStatusFailed     = "failed"
+)
+
+// ImageStatus tracks the processing of a single product image
+type ImageStatus struct {
+	ID            uint       `gorm:"primaryKey"`
+	ProductID     uint       `gorm:"not null;uniqueIndex:idx_image_statuses_product_url,priority:1"`
+	ImageURL      string     `gorm:"type:text;not null;uniqueIndex:idx_image_statuses_product_url,priority:2"`
+	Status        string     `gorm:"size:20;not null;index"`
+	Attempts      int        `gorm:"not null;default:0"`
+	LastError     string     `gorm:"type:text"`
+	CompressedURL string     `gorm:"type:text"`
+	StartedAt     *time.Time `gorm:"type:timestamp with time zone"`
+	CompletedAt   *time.Time `gorm:"type:timestamp with time zone"`
+	CreatedAt     time.Time  `gorm:"type:timestamp with time zone"`
+	UpdatedAt     time.Time  `gorm:"type:timestamp with time zone"`
+
+	// DuplicateOf names an image of the same seller with an identical
+	// perceptual hash, when duplicates are flagged
+	DuplicateOfProductID *uint  `gorm:"index"`
+	DuplicateOfURL       string `gorm:"type:text"`
+}
+
+// CreatePendingImageStatuses records the given images as waiting for the
+// processor, resetting any earlier attempt for the same image
+func CreatePendingImageStatuses(tx *gorm.DB, productID uint, urls []string) error {
+	if len(urls) == 0 {
+		return nil
+	}
+
+	statuses := make([]ImageStatus, 0, len(urls))
+	for _, url := range urls {
+		statuses = append(statuses, ImageStatus{ProductID: productID, ImageURL: url, Status: ImageStatusPending})
+	}
+
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "product_id"}, {Name: "image_url"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"status":                  ImageStatusPending,
+			"attempts":                0,
+			"last_error":              "",
+			"compressed_url":          "",
+			"duplicate_of_product_id": nil,
+			"duplicate_of_url":        "",
+			"started_at":              nil,
+			"completed_at":            nil,
+			"updated_at":              time.Now(),
+		}),
+	}).Create(&statuses).Error
+}
+
+// ErrImageGone is returned for images whose product was deleted, or which
+// were removed from their product, while they waited to be processed
+var ErrImageGone = errors.New("product image no longer exists")
+
+// MarkImageProcessing records the start of a processing attempt. It returns
+// ErrImageGone instead of recreating the status of an image that is gone.
+func MarkImageProcessing(productID uint, url string) error {
+	now := time.Now()
+	status := ImageStatus{
+		ProductID: productID,
+		ImageURL:  url,
+		Status:    ImageStatusProcessing,
+		Attempts:  1,
+		StartedAt: &now,
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		// The share lock keeps the product from being deleted, or losing the
+		// image, until the status row is written
+		var product Product
+		err := tx.Clauses(clause.Locking{Strength: "SHARE"}).
+			Select("id").
+			Where("id = ? AND ? = ANY(product_images)", productID, url).
+			Take(&product).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w: %s of product %d", ErrImageGone, url, productID)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Images enqueued before status tracking existed have no row yet
+		return tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "product_id"}, {Name: "image_url"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"status":                  ImageStatusProcessing,
+				"attempts":                gorm.Expr("image_statuses.attempts + 1"),
+				"duplicate_of_product_id": nil,
+				"duplicate_of_url":        "",
+				"started_at":              now,
+				"updated_at":              now,
+			}),
+		}).Create(&status).Error
+	})
+}
+
+// MarkImageDone records a successful processing attempt
+func MarkImageDone(productID uint, url, compressedURL string) error {
+	now := time.Now()
+	return DB.Model(&ImageStatus{}).
+		Where("product_id = ? AND image_url = ?", productID, url).
+		Updates(map[string]interface{}{
+			"status":         ImageStatusDone,
+			"last_error":     "",
+			"compressed_url": compressedURL,
+			"completed_at":   now,
+		}).Error
+}
+
+// MarkImageDuplicate flags an image as a copy of another image of the seller
+func MarkImageDuplicate(productID uint, url string, duplicate *ImageHash) error {
+	return DB.Model(&ImageStatus{}).
+		Where("product_id = ? AND image_url = ?", productID, url).
+		Updates(map[string]interface{}{
+			"duplicate_of_product_id": duplicate.ProductID,
+			"duplicate_of_url":        duplicate.ImageURL,
+		}).Error
+}
+
+// MarkImageFailed records a failed processing attempt
+func MarkImageFailed(productID uint, url string, cause error) error {
+	now := time.Now()
+	return DB.Model(&ImageStatus{}).
+		Where("product_id = ? AND image_url = ?", productID, url).
+		Updates(map[string]interface{}{
+			"status":       ImageStatusFailed,
+			"last_error":   cause.Error(),
+			"completed_at": now,
+		}).Error
+}
+
+// DeleteImageStatuses removes the status of the given images, or of every
+// image of the product when urls is nil
+func DeleteImageStatuses(tx *gorm.DB, productID uint, urls []string) error {
+	query := tx.Where("product_id = ?", productID)
+	if urls != nil {
+		if len(urls) == 0 {
+			return nil
+		}
+		query = query.Where("image_url IN ?", urls)
+	}
+	return query.Delete(&ImageStatus{}).Error
+}
+
+// GetImageStatuses returns the status of every tracked image of a product
+func GetImageStatuses(productID uint) ([]ImageStatus, error) {
+	var statuses []ImageStatus
+	err := DB.Where("product_id = ?", productID).Find(&statuses).Error
+	return statuses, err
+}
@@ -0,0 +1,265 @@
+package db
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID serializes migrators through a transaction level advisory
+// lock, so several instances starting at once apply each migration once
+const migrationLockID = 7_402_113
+
+// migrationParams are handed to the migrations as zocket.<name> settings,
+// read with current_setting
+var migrationParams = map[string]string{
+	// legacy_currency is the currency of prices stored before products had one
+	"legacy_currency": "USD",
+}
+
+// InitMigrationParams overrides parameters of the migrations
+func InitMigrationParams(params map[string]string) {
+	for name, value := range params {
+		migrationParams[name] = value
+	}
+}
+
+// ErrSchemaBehind is returned when migrations are waiting to be applied
+var ErrSchemaBehind = errors.New("database schema is behind")
+
+var migrationName = regexp.MustCompile(`^([0-9]+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is one versioned schema change with the SQL to apply and to
+// revert it
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int64     `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"type:text;not null"`
+	AppliedAt time.Time `gorm:"type:timestamp with time zone;not null"`
+}
+
+// MigrationState is a migration with the time it was applied, nil when it is
+// pending
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrations returns the embedded migrations ordered by version
+func Migrations() ([]Migration, error) {
+	return loadMigrations(migrationFiles, "migrations")
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %s is not named <version>_<name>.<up|down>.sql", entry.Name())
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		data, err := fs.ReadFile(fsys, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// MigrateUp applies every pending migration in order, each in its own
+// transaction, and returns how many were applied
+func MigrateUp() (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	if err := ensureMigrationTable(); err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		done := false
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockID).Error; err != nil {
+				return err
+			}
+			// Another instance may have applied it while we waited
+			var count int64
+			if err := tx.Model(&SchemaMigration{}).Where("version = ?", m.Version).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return nil
+			}
+
+			for name, value := range migrationParams {
+				if err := tx.Exec("SELECT set_config(?, ?, true)", "zocket."+name, value).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Exec(m.Up).Error; err != nil {
+				return err
+			}
+			done = true
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return applied, fmt.Errorf("error applying migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		if done {
+			log.Printf("Applied migration %d_%s", m.Version, m.Name)
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the latest steps applied migrations, newest first,
+// and returns how many were reverted
+func MigrateDown(steps int) (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	byVersion := make(map[int64]Migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+	if err := ensureMigrationTable(); err != nil {
+		return 0, err
+	}
+
+	reverted := 0
+	for reverted < steps {
+		var latest SchemaMigration
+		err := DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockID).Error; err != nil {
+				return err
+			}
+			if err := tx.Order("version DESC").Take(&latest).Error; err != nil {
+				return err
+			}
+			m, ok := byVersion[latest.Version]
+			if !ok {
+				return fmt.Errorf("applied migration %d_%s is unknown to this build", latest.Version, latest.Name)
+			}
+
+			if err := tx.Exec(m.Down).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, latest.Version).Error
+		})
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			break
+		}
+		if err != nil {
+			return reverted, fmt.Errorf("error reverting migration %d_%s: %w", latest.Version, latest.Name, err)
+		}
+		log.Printf("Reverted migration %d_%s", latest.Version, latest.Name)
+		reverted++
+	}
+	return reverted, nil
+}
+
+// MigrationStatus lists every known migration and when it was applied
+func MigrationStatus() ([]MigrationState, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationTable(); err != nil {
+		return nil, err
+	}
+
+	var applied []SchemaMigration
+	if err := DB.Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	appliedAt := make(map[int64]time.Time, len(applied))
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i] = MigrationState{Migration: m}
+		if at, ok := appliedAt[m.Version]; ok {
+			states[i].AppliedAt = &at
+		}
+	}
+	return states, nil
+}
+
+// CheckSchema returns ErrSchemaBehind when a migration has not been applied
+// yet. Migrations newer than this build are fine, so an old build keeps
+// running during a rolling deploy.
+func CheckSchema() error {
+	states, err := MigrationStatus()
+	if err != nil {
+		return err
+	}
+	var pending []string
+	for _, state := range states {
+		if state.AppliedAt == nil {
+			pending = append(pending, fmt.Sprintf("%d_%s", state.Version, state.Name))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w, pending migrations: %v", ErrSchemaBehind, pending)
+	}
+	return nil
+}
+
+func ensureMigrationTable() error {
+	return DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    bigint PRIMARY KEY,
+		name       text NOT NULL,
+		applied_at timestamp with time zone NOT NULL
+	)`).Error
+}
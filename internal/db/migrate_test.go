@@ -0,0 +1,114 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// baselineSchema is what AutoMigrate created for the first models, before
+// image renditions, status tracking and versioned migrations existed
+const baselineSchema = `
+CREATE TABLE users (
+    id    bigserial PRIMARY KEY,
+    name  varchar(100),
+    email varchar(100),
+    CONSTRAINT uni_users_email UNIQUE (email)
+);
+CREATE TABLE products (
+    id                        bigserial PRIMARY KEY,
+    user_id                   bigint,
+    product_name              varchar(255),
+    product_description       text,
+    product_images            text[],
+    compressed_product_images text[],
+    product_price             decimal(10,2),
+    created_at                timestamp with time zone DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_products_user_id ON products (user_id);
+INSERT INTO products (user_id, product_name, product_images, product_price)
+VALUES (7, 'Legacy product', '{https://example.com/a.jpg}', 12.34);
+`
+
+func TestMigrationsArePaired(t *testing.T) {
+	migrations, err := Migrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	// Versions are consecutive so a missing file is noticed
+	for i, m := range migrations {
+		assert.Equal(t, int64(i+1), m.Version, m.Name)
+		assert.NotEmpty(t, m.Up, m.Name)
+		assert.NotEmpty(t, m.Down, m.Name)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0002_add_column.up.sql":   {Data: []byte("ALTER TABLE t ADD c int;")},
+		"m/0002_add_column.down.sql": {Data: []byte("ALTER TABLE t DROP c;")},
+		"m/0001_create.up.sql":       {Data: []byte("CREATE TABLE t ();")},
+		"m/0001_create.down.sql":     {Data: []byte("DROP TABLE t;")},
+	}
+	migrations, err := loadMigrations(fsys, "m")
+	require.NoError(t, err)
+	require.Len(t, migrations, 2)
+	assert.Equal(t, Migration{Version: 1, Name: "create", Up: "CREATE TABLE t ();", Down: "DROP TABLE t;"}, migrations[0])
+	assert.Equal(t, "add_column", migrations[1].Name)
+
+	delete(fsys, "m/0002_add_column.down.sql")
+	_, err = loadMigrations(fsys, "m")
+	assert.ErrorContains(t, err, "needs both")
+
+	fsys["m/notes.txt"] = &fstest.MapFile{}
+	_, err = loadMigrations(fsys, "m")
+	assert.Error(t, err)
+}
+
+func TestMigrateUpFromAutoMigrateSchema(t *testing.T) {
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("DATABASE_DSN is not set")
+	}
+
+	// A single connection keeps the scratch schema on the search path
+	scratch, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
+	require.NoError(t, err)
+	sqlDB, err := scratch.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+	defer sqlDB.Close()
+
+	require.NoError(t, scratch.Exec("DROP SCHEMA IF EXISTS migrate_baseline CASCADE").Error)
+	require.NoError(t, scratch.Exec("CREATE SCHEMA migrate_baseline").Error)
+	defer scratch.Exec("DROP SCHEMA migrate_baseline CASCADE")
+	require.NoError(t, scratch.Exec("SET search_path TO migrate_baseline").Error)
+	require.NoError(t, scratch.Exec(baselineSchema).Error)
+
+	previous := DB
+	DB = scratch
+	defer func() { DB = previous }()
+
+	// Legacy prices are in the currency passed to the migrations
+	InitMigrationParams(map[string]string{"legacy_currency": "EUR"})
+	defer InitMigrationParams(map[string]string{"legacy_currency": "USD"})
+
+	_, err = MigrateUp()
+	require.NoError(t, err)
+	require.NoError(t, CheckSchema())
+
+	// The processor writes renditions of the adopted products
+	var product Product
+	require.NoError(t, DB.First(&product).Error)
+	assert.Equal(t, "12.34", product.ProductPrice.Decimal())
+	assert.Equal(t, "EUR", product.ProductPrice.Currency)
+	product.ImageRenditions = product.ImageRenditions.Set(ImageRenditions{SourceURL: "https://example.com/a.jpg"})
+	require.NoError(t, DB.Model(&product).Update("image_renditions", product.ImageRenditions).Error)
+	require.NoError(t, MarkImageProcessing(product.ID, "https://example.com/a.jpg"))
+	require.NoError(t, MarkImageDuplicate(product.ID, "https://example.com/a.jpg", &ImageHash{ProductID: product.ID, ImageURL: "https://example.com/b.jpg"}))
+}
@@ -0,0 +1,27 @@
+-- Tables are created only when missing, so databases set up by the old
+-- AutoMigrate call adopt this migration. Columns and indexes added after
+-- their tables were first created are added to those databases below.
+CREATE TABLE IF NOT EXISTS users (
+    id    bigserial PRIMARY KEY,
+    name  varchar(100),
+    email varchar(100) UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS products (
+    id                        bigserial PRIMARY KEY,
+    user_id                   bigint,
+    product_name              varchar(255),
+    product_description       text,
+    product_images            text[],
+    compressed_product_images text[],
+    image_renditions          jsonb,
+    product_price             decimal(10,2),
+    created_at                timestamp with time zone DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS image_renditions jsonb;
+
+CREATE INDEX IF NOT EXISTS idx_products_user_id ON products (user_id);
+CREATE INDEX IF NOT EXISTS idx_products_created_at_id ON products (created_at, id);
+CREATE INDEX IF NOT EXISTS idx_products_price_id ON products (product_price, id);
+CREATE INDEX IF NOT EXISTS idx_products_name_id ON products (product_name, id);
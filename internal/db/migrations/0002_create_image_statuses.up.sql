@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS image_statuses (
+    id                      bigserial PRIMARY KEY,
+    product_id              bigint NOT NULL,
+    image_url               text NOT NULL,
+    status                  varchar(20) NOT NULL,
+    attempts                bigint NOT NULL DEFAULT 0,
+    last_error              text,
+    compressed_url          text,
+    started_at              timestamp with time zone,
+    completed_at            timestamp with time zone,
+    created_at              timestamp with time zone,
+    updated_at              timestamp with time zone,
+    duplicate_of_product_id bigint,
+    duplicate_of_url        text
+);
+
+-- Duplicate detection came after status tracking, AutoMigrate databases from
+-- in between lack its columns
+ALTER TABLE image_statuses ADD COLUMN IF NOT EXISTS duplicate_of_product_id bigint;
+ALTER TABLE image_statuses ADD COLUMN IF NOT EXISTS duplicate_of_url text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_image_statuses_product_url ON image_statuses (product_id, image_url);
+CREATE INDEX IF NOT EXISTS idx_image_statuses_status ON image_statuses (status);
+CREATE INDEX IF NOT EXISTS idx_image_statuses_duplicate_of_product_id ON image_statuses (duplicate_of_product_id);
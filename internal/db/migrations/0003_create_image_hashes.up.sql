@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS image_hashes (
+    id         bigserial PRIMARY KEY,
+    product_id bigint NOT NULL,
+    image_url  text NOT NULL,
+    hash       bigint NOT NULL,
+    created_at timestamp with time zone
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_image_hashes_product_url ON image_hashes (product_id, image_url);
+CREATE INDEX IF NOT EXISTS idx_image_hashes_hash ON image_hashes (hash);
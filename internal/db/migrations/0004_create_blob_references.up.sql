@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS blob_references (
+    key        text NOT NULL,
+    product_id bigint NOT NULL,
+    source_url text NOT NULL,
+    created_at timestamp with time zone,
+    PRIMARY KEY (key, product_id, source_url)
+);
+
+CREATE INDEX IF NOT EXISTS idx_blob_references_product_url ON blob_references (product_id, source_url);
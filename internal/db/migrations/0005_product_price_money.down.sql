@@ -0,0 +1,14 @@
+-- The currency is dropped, amounts are kept in their own major units
+ALTER TABLE products ADD COLUMN product_price decimal(10,2);
+
+UPDATE products SET product_price = price_amount / power(10, CASE
+    WHEN price_currency IN ('CLP', 'ISK', 'JPY', 'KRW', 'VND') THEN 0
+    WHEN price_currency IN ('BHD', 'JOD', 'KWD', 'OMR', 'TND') THEN 3
+    ELSE 2
+END)::numeric;
+
+DROP INDEX IF EXISTS idx_products_price_currency_amount_id;
+ALTER TABLE products DROP COLUMN price_amount;
+ALTER TABLE products DROP COLUMN price_currency;
+
+CREATE INDEX IF NOT EXISTS idx_products_price_id ON products (product_price, id);
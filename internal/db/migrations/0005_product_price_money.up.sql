@@ -0,0 +1,21 @@
+-- Prices become an integer amount of minor units and an ISO 4217 currency.
+-- Existing prices were stored without a currency. They are taken to be in
+-- the zocket.legacy_currency migration parameter, which cmd/migrate sets
+-- from LEGACY_CURRENCY, see InitMigrationParams.
+ALTER TABLE products ADD COLUMN price_amount bigint;
+ALTER TABLE products ADD COLUMN price_currency char(3);
+
+UPDATE products SET price_currency = current_setting('zocket.legacy_currency');
+UPDATE products SET price_amount = round(coalesce(product_price, 0) * power(10, CASE
+    WHEN price_currency IN ('CLP', 'ISK', 'JPY', 'KRW', 'VND') THEN 0
+    WHEN price_currency IN ('BHD', 'JOD', 'KWD', 'OMR', 'TND') THEN 3
+    ELSE 2
+END)::numeric);
+
+ALTER TABLE products ALTER COLUMN price_amount SET NOT NULL;
+ALTER TABLE products ALTER COLUMN price_currency SET NOT NULL;
+
+DROP INDEX IF EXISTS idx_products_price_id;
+ALTER TABLE products DROP COLUMN product_price;
+
+CREATE INDEX idx_products_price_currency_amount_id ON products (price_currency, price_amount, id);
@@ -0,0 +1,14 @@
+CREATE TABLE api_keys (
+    id           bigserial PRIMARY KEY,
+    user_id      bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name         varchar(100) NOT NULL,
+    key_id       char(8) NOT NULL,
+    key_hash     char(64) NOT NULL UNIQUE,
+    scopes       text[] NOT NULL,
+    expires_at   timestamp with time zone NOT NULL,
+    last_used_at timestamp with time zone,
+    revoked_at   timestamp with time zone,
+    created_at   timestamp with time zone NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_api_keys_user_id ON api_keys (user_id, id);
@@ -0,0 +1,3 @@
+-- Placeholder users created by the up migration are kept
+ALTER TABLE products DROP CONSTRAINT IF EXISTS fk_products_user;
+ALTER TABLE products ALTER COLUMN user_id DROP NOT NULL;
@@ -0,0 +1,21 @@
+-- Products of sellers without a user row get a placeholder user, so the
+-- foreign key can be added without losing products
+INSERT INTO users (id, name)
+SELECT DISTINCT p.user_id, 'Seller ' || p.user_id
+FROM products p
+WHERE p.user_id > 0 AND NOT EXISTS (SELECT 1 FROM users u WHERE u.id = p.user_id);
+
+SELECT setval(pg_get_serial_sequence('users', 'id'), GREATEST((SELECT max(id) FROM users), 1));
+
+WITH placeholder AS (
+    INSERT INTO users (name)
+    SELECT 'Unassigned products'
+    WHERE EXISTS (SELECT 1 FROM products WHERE user_id IS NULL OR user_id = 0)
+    RETURNING id
+)
+UPDATE products SET user_id = (SELECT id FROM placeholder) WHERE user_id IS NULL OR user_id = 0;
+
+-- Users cannot be deleted while they still sell products
+ALTER TABLE products ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE products ADD CONSTRAINT fk_products_user
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE RESTRICT;
@@ -2,9 +2,11 @@ package db
 
 import (
 	"database/sql/driver"
+	"encoding/json"
 	"fmt"
-	"strings"
 	"time"
+
+	"github.com/mohammadshaad/zocket/pkg/money"
 )
 
 type User struct {
@@ -14,14 +16,15 @@ type User struct {
 }
 
 type Product struct {
-	ID                    uint           `gorm:"primaryKey"`
-	UserID                uint           `gorm:"index"`
-	ProductName           string         `gorm:"size:255"`
+	ID                    uint           `gorm:"primaryKey;index:idx_products_created_at_id,priority:2;index:idx_products_name_id,priority:2"`
+	UserID                uint           `gorm:"not null;index"`
+	ProductName           string         `gorm:"size:255;index:idx_products_name_id,priority:1"`
 	ProductDescription    string         `gorm:"type:text"`
 	ProductImages         GormStringList `gorm:"type:text[]"`
 	CompressedProductImages GormStringList `gorm:"type:text[]"`
-	ProductPrice          float64        `gorm:"type:decimal(10,2)"`
-	CreatedAt              time.Time      `gorm:"type:timestamp with time zone;default:CURRENT_TIMESTAMP"`
+	ImageRenditions       RenditionList  `gorm:"type:jsonb"`
+	ProductPrice          money.Money    `gorm:"embedded;embeddedPrefix:price_"`
+	CreatedAt              time.Time      `gorm:"type:timestamp with time zone;default:CURRENT_TIMESTAMP;index:idx_products_created_at_id,priority:1"`
 }
 
 type GormStringList []string
@@ -44,17 +47,11 @@ func (list *GormStringList) Scan(value interface{}) error {
 		return fmt.Errorf("cannot scan type %T into GormStringList", value)
 	}
 
-	// Parse PostgreSQL array format: {"value1","value2"}
-	str = strings.Trim(str, "{}") // Remove the curly braces
-	if str == "" {
-		*list = []string{}
-	} else {
-		*list = strings.Split(str, ",")
-		for i, s := range *list {
-			(*list)[i] = strings.Trim(s, `"`) // Remove quotes around each string
-		}
+	parsed, err := decodeTextArray(str)
+	if err != nil {
+		return err
 	}
-
+	*list = parsed
 	return nil
 }
 
@@ -64,10 +61,75 @@ func (list GormStringList) Value() (driver.Value, error) {
 		return "{}", nil
 	}
 	// Convert Go slice to PostgreSQL array format
-	return "{" + strings.Join(list, ",") + "}", nil
+	return encodeTextArray(list), nil
+}
+
+
+// ImageRendition is one resized variant of a product image
+type ImageRendition struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Format      string `json:"format"`
+	ContentType string `json:"content_type"`
+}
+
+// ImageRenditions groups the renditions generated from one source image
+type ImageRenditions struct {
+	SourceURL  string           `json:"source_url"`
+	Renditions []ImageRendition `json:"renditions"`
+}
+
+// RenditionList holds the renditions of every product image as JSONB
+type RenditionList []ImageRenditions
+
+// Scan implements the Scanner interface for RenditionList
+func (list *RenditionList) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*list = RenditionList{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan type %T into RenditionList", value)
+	}
+	return json.Unmarshal(data, list)
+}
+
+// Value implements the Valuer interface for RenditionList
+func (list RenditionList) Value() (driver.Value, error) {
+	if list == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
 }
 
+// Find returns the renditions generated from the given source image
+func (list RenditionList) Find(sourceURL string) (ImageRenditions, bool) {
+	for _, entry := range list {
+		if entry.SourceURL == sourceURL {
+			return entry, true
+		}
+	}
+	return ImageRenditions{}, false
+}
 
-func Migrate() {
-	DB.AutoMigrate(&User{}, &Product{})
+// Set replaces the renditions of a source image, adding it when missing
+func (list RenditionList) Set(entry ImageRenditions) RenditionList {
+	for i := range list {
+		if list[i].SourceURL == entry.SourceURL {
+			list[i] = entry
+			return list
+		}
+	}
+	return append(list, entry)
 }
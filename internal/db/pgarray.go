@@ -0,0 +1,135 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// encodeTextArray formats a one-dimensional PostgreSQL text array literal.
+// Every element is quoted, so empty strings, the word NULL and elements
+// containing delimiters, braces or whitespace are kept exactly.
+func encodeTextArray(list []string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, s := range list {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('"')
+		for j := 0; j < len(s); j++ {
+			if s[j] == '"' || s[j] == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(s[j])
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// decodeTextArray parses a one-dimensional PostgreSQL text array literal as
+// returned by the server. NULL elements are rejected since the list has no
+// way to represent them.
+func decodeTextArray(literal string) ([]string, error) {
+	s := literal
+	// Arrays with a lower bound other than 1 carry a dimension decoration
+	if strings.HasPrefix(s, "[") {
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("malformed array literal %q", literal)
+		}
+		s = s[eq+1:]
+	}
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, fmt.Errorf("malformed array literal %q", literal)
+	}
+	s = s[1 : len(s)-1]
+
+	list := []string{}
+	if strings.TrimSpace(s) == "" {
+		return list, nil
+	}
+
+	i := 0
+	for {
+		// Whitespace around elements is not part of them
+		for i < len(s) && isArraySpace(s[i]) {
+			i++
+		}
+		if i == len(s) {
+			return nil, fmt.Errorf("malformed array literal %q: missing element", literal)
+		}
+
+		var elem strings.Builder
+		switch s[i] {
+		case '{':
+			return nil, fmt.Errorf("malformed array literal %q: only one-dimensional arrays are supported", literal)
+		case '"':
+			i++
+			closed := false
+			for i < len(s) {
+				c := s[i]
+				i++
+				if c == '\\' && i < len(s) {
+					elem.WriteByte(s[i])
+					i++
+					continue
+				}
+				if c == '"' {
+					closed = true
+					break
+				}
+				elem.WriteByte(c)
+			}
+			if !closed {
+				return nil, fmt.Errorf("malformed array literal %q: unterminated quoted element", literal)
+			}
+			list = append(list, elem.String())
+		default:
+			// Unquoted elements end at the delimiter, trailing whitespace is
+			// dropped unless it was escaped
+			kept := 0
+			escaped := false
+			for i < len(s) && s[i] != ',' {
+				c := s[i]
+				i++
+				if c == '"' || c == '{' || c == '}' {
+					return nil, fmt.Errorf("malformed array literal %q: unexpected %q", literal, c)
+				}
+				if c == '\\' && i < len(s) {
+					elem.WriteByte(s[i])
+					i++
+					kept = elem.Len()
+					escaped = true
+					continue
+				}
+				elem.WriteByte(c)
+				if !isArraySpace(c) {
+					kept = elem.Len()
+				}
+			}
+			value := elem.String()[:kept]
+			// A quoted or escaped "NULL" is a string, a bare one is NULL
+			if !escaped && strings.EqualFold(value, "NULL") {
+				return nil, fmt.Errorf("array literal %q has a NULL element", literal)
+			}
+			list = append(list, value)
+		}
+
+		for i < len(s) && isArraySpace(s[i]) {
+			i++
+		}
+		if i == len(s) {
+			return list, nil
+		}
+		if s[i] != ',' {
+			return nil, fmt.Errorf("malformed array literal %q: expected a delimiter", literal)
+		}
+		i++
+	}
+}
+
+func isArraySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
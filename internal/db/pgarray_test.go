@@ -0,0 +1,94 @@
+package db
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestDecodeTextArray(t *testing.T) {
+	tests := []struct {
+		literal string
+		want    []string
+	}{
+		{`{}`, []string{}},
+		{`{a,b}`, []string{"a", "b"}},
+		{`{"a,b","c"}`, []string{"a,b", "c"}},
+		{`{"",""}`, []string{"", ""}},
+		{`{"NULL",\NULL,nul}`, []string{"NULL", "NULL", "nul"}},
+		{`{"say \"hi\"","back\\slash"}`, []string{`say "hi"`, `back\slash`}},
+		{`{ a b , c }`, []string{"a b", "c"}},
+		{`{a\ ,\{x\}}`, []string{"a ", "{x}"}},
+		{`[0:1]={x,y}`, []string{"x", "y"}},
+		{`{"https://example.com/a,b.jpg?q={1}"}`, []string{"https://example.com/a,b.jpg?q={1}"}},
+	}
+	for _, tt := range tests {
+		got, err := decodeTextArray(tt.literal)
+		require.NoError(t, err, tt.literal)
+		assert.Equal(t, tt.want, got, tt.literal)
+	}
+
+	for _, literal := range []string{``, `a,b`, `{"a}`, `{a"b}`, `{{a},{b}}`, `{a,}`, `{"a" b}`, `{NULL}`, `{a, null }`} {
+		_, err := decodeTextArray(literal)
+		assert.Error(t, err, literal)
+	}
+}
+
+func TestTextArrayRoundTrip(t *testing.T) {
+	roundTrip := func(list []string) bool {
+		got, err := decodeTextArray(encodeTextArray(list))
+		return err == nil && assert.ObjectsAreEqual(append([]string{}, list...), got)
+	}
+	require.NoError(t, quick.Check(roundTrip, &quick.Config{MaxCount: 5000}))
+
+	assert.True(t, roundTrip([]string{"", "NULL", " padded ", `\`, `"`, "{}", ",", "a,b", "\t\n"}))
+}
+
+func FuzzTextArrayRoundTrip(f *testing.F) {
+	for _, seed := range []string{"", "NULL", "a,b", `"quoted"`, `back\slash`, "{braces}", " spaced "} {
+		f.Add(seed, seed+",x")
+	}
+	f.Fuzz(func(t *testing.T, a, b string) {
+		list := []string{a, b}
+		got, err := decodeTextArray(encodeTextArray(list))
+		require.NoError(t, err)
+		assert.Equal(t, list, got)
+	})
+}
+
+// TestTextArrayPostgresRoundTrip checks the encoding against a real server.
+// It needs DATABASE_DSN.
+func TestTextArrayPostgresRoundTrip(t *testing.T) {
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("DATABASE_DSN is not set")
+	}
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+
+	check := func(list []string) bool {
+		// PostgreSQL text cannot hold NUL bytes or invalid UTF-8
+		for i, s := range list {
+			list[i] = strings.ToValidUTF8(strings.ReplaceAll(s, "\x00", ""), "")
+		}
+		var literal string
+		if err := conn.Raw("SELECT (?::text[])::text", GormStringList(list)).Scan(&literal).Error; err != nil {
+			t.Log(err)
+			return false
+		}
+		var got GormStringList
+		if err := got.Scan(literal); err != nil {
+			t.Log(err)
+			return false
+		}
+		return assert.ObjectsAreEqual(append([]string{}, list...), []string(got))
+	}
+	require.NoError(t, quick.Check(check, &quick.Config{MaxCount: 500}))
+	assert.True(t, check([]string{"", "NULL", "null", " x ", `a"b`, `c\d`, "{e}", "f,g"}))
+}
@@ -0,0 +1,160 @@
+// Package gc deletes objects of the blob store that no product uses anymore
+package gc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mohammadshaad/zocket/internal/db"
+	"github.com/mohammadshaad/zocket/pkg/storage"
+	"gorm.io/gorm"
+)
+
+// Collector deletes unreferenced objects. Objects modified after Cutoff are
+// kept, so images being processed or uploaded are never collected before
+// the product that will use them is saved.
+type Collector struct {
+	Store storage.BlobStore
+	// Referenced holds the keys in use when the collection started
+	Referenced map[string]bool
+	Cutoff     time.Time
+	// DryRun only reports what would be deleted
+	DryRun bool
+	// InUse, when set, is asked again right before an object is deleted, to
+	// keep objects a product started using while the collector was running
+	InUse func(ctx context.Context, key string) (bool, error)
+	// Lock, when set, is held while an object is checked with InUse and
+	// deleted, so no image starts using it in between
+	Lock func(ctx context.Context, key string, fn func() error) error
+}
+
+// Report summarizes a collection
+type Report struct {
+	Scanned      int
+	Referenced   int
+	Recent       int
+	Deleted      int
+	DeletedBytes int64
+	// DeletedKeys lists the deleted keys, or the keys that would be deleted
+	// in a dry run
+	DeletedKeys []string
+}
+
+// Run lists the whole store and deletes every old, unreferenced object
+func (c *Collector) Run(ctx context.Context) (Report, error) {
+	var report Report
+	err := c.Store.List(ctx, "", func(object storage.ObjectInfo) error {
+		report.Scanned++
+		if c.Referenced[object.Key] {
+			report.Referenced++
+			return nil
+		}
+		if !object.LastModified.Before(c.Cutoff) {
+			report.Recent++
+			return nil
+		}
+
+		var inUse bool
+		deleteUnused := func() error {
+			if c.InUse != nil {
+				var err error
+				if inUse, err = c.InUse(ctx, object.Key); err != nil {
+					return fmt.Errorf("error checking references of %s: %w", object.Key, err)
+				}
+				if inUse {
+					return nil
+				}
+			}
+			if c.DryRun {
+				return nil
+			}
+			if err := c.Store.Delete(ctx, object.Key); err != nil {
+				return fmt.Errorf("error deleting %s: %w", object.Key, err)
+			}
+			return nil
+		}
+
+		var err error
+		if c.Lock != nil {
+			err = c.Lock(ctx, object.Key, deleteUnused)
+		} else {
+			err = deleteUnused()
+		}
+		if err != nil {
+			return err
+		}
+		if inUse {
+			report.Referenced++
+			return nil
+		}
+		report.Deleted++
+		report.DeletedBytes += object.Size
+		report.DeletedKeys = append(report.DeletedKeys, object.Key)
+		return nil
+	})
+	return report, err
+}
+
+// ReferencedKeys returns the keys of every object the products use: their
+// source images, compressed images and renditions, and the objects recorded
+// in blob_references
+func ReferencedKeys(ctx context.Context, store storage.BlobStore) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	add := func(url string) {
+		if key, ok := storage.KeyFromURL(store, url); ok {
+			referenced[key] = true
+		}
+	}
+
+	var products []db.Product
+	err := db.DB.WithContext(ctx).
+		Select("id", "product_images", "compressed_product_images", "image_renditions").
+		FindInBatches(&products, 500, func(tx *gorm.DB, batch int) error {
+			for _, product := range products {
+				for _, url := range product.ProductImages {
+					add(url)
+				}
+				for _, url := range product.CompressedProductImages {
+					add(url)
+				}
+				for _, entry := range product.ImageRenditions {
+					for _, rendition := range entry.Renditions {
+						add(rendition.URL)
+					}
+				}
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return nil, fmt.Errorf("error loading product images: %w", err)
+	}
+
+	var keys []string
+	if err := db.DB.WithContext(ctx).Model(&db.BlobReference{}).Distinct("key").Pluck("key", &keys).Error; err != nil {
+		return nil, fmt.Errorf("error loading blob references: %w", err)
+	}
+	for _, key := range keys {
+		referenced[key] = true
+	}
+
+	log.Printf("Found %d referenced objects", len(referenced))
+	return referenced, nil
+}
+
+// KeyInUse checks the database for a product using the object
+func KeyInUse(store storage.BlobStore) func(ctx context.Context, key string) (bool, error) {
+	return func(ctx context.Context, key string) (bool, error) {
+		count, err := db.CountBlobReferences(key)
+		if err != nil || count > 0 {
+			return count > 0, err
+		}
+
+		url := store.URL(key)
+		err = db.DB.WithContext(ctx).Model(&db.Product{}).
+			Where("? = ANY(product_images) OR ? = ANY(compressed_product_images)", url, url).
+			Count(&count).Error
+		return count > 0, err
+	}
+}
@@ -0,0 +1,58 @@
+package gc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mohammadshaad/zocket/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore("")
+	for _, key := range []string{"renditions/large/used.webp", "renditions/large/orphan.webp", "renditions/large/reused.webp"} {
+		_, err := store.Put(ctx, key, strings.NewReader("image"), "image/webp")
+		require.NoError(t, err)
+	}
+
+	collector := &Collector{
+		Store:      store,
+		Referenced: map[string]bool{"renditions/large/used.webp": true},
+		Cutoff:     time.Now().Add(time.Minute),
+		DryRun:     true,
+		InUse: func(ctx context.Context, key string) (bool, error) {
+			return key == "renditions/large/reused.webp", nil
+		},
+	}
+
+	// A dry run deletes nothing
+	report, err := collector.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Scanned)
+	assert.Equal(t, 2, report.Referenced)
+	assert.Equal(t, []string{"renditions/large/orphan.webp"}, report.DeletedKeys)
+	exists, _ := store.Exists(ctx, "renditions/large/orphan.webp")
+	assert.True(t, exists)
+
+	// Objects within the grace period are kept
+	collector.DryRun = false
+	collector.Cutoff = time.Now().Add(-time.Hour)
+	report, err = collector.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Recent)
+	assert.Zero(t, report.Deleted)
+
+	collector.Cutoff = time.Now().Add(time.Minute)
+	report, err = collector.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Deleted)
+	assert.Equal(t, int64(len("image")), report.DeletedBytes)
+	exists, _ = store.Exists(ctx, "renditions/large/orphan.webp")
+	assert.False(t, exists)
+	exists, _ = store.Exists(ctx, "renditions/large/used.webp")
+	assert.True(t, exists)
+}
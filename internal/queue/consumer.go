@@ -2,49 +2,268 @@ package queue
 
 import (
     "context"
+    "hash/fnv"
     "log"
     "os"
+    "sync"
     "time"
 
     "github.com/twmb/franz-go/pkg/kgo"
 )
 
+const (
+    // maxPollRecords bounds how many records are fetched by a single poll
+    maxPollRecords = 500
+    // laneBuffer bounds how many records wait for each worker, polling
+    // stops while the lane of the next record is full
+    laneBuffer     = 64
+    commitInterval = time.Second
+    commitTimeout  = 10 * time.Second
+)
+
 var consumer *kgo.Client
+var consumerWorkers = 1
+
+// offsets tracks the processed records of the assigned partitions
+var offsets = newOffsetTracker()
+
+// commitMu keeps commits of the processing loop and of revoked partitions
+// from interleaving
+var commitMu sync.Mutex
+
+// InitConsumer creates the consumer group client. Records are processed by
+// up to workers goroutines in parallel, keeping the order of records that
+// share a key.
+func InitConsumer(brokers []string, groupID string, workers int) {
+    // Retried records come back through the retry topic
+    topics := []string{os.Getenv("KAFKA_TOPIC")}
+    if retryPolicy.RetryTopic != "" {
+        topics = append(topics, retryPolicy.RetryTopic)
+    }
+
+    if workers > 0 {
+        consumerWorkers = workers
+    }
 
-func InitConsumer(brokers []string, groupID string) {
     var err error
     consumer, err = kgo.NewClient(
         kgo.SeedBrokers(brokers...),
         kgo.ConsumerGroup(groupID),
-        kgo.ConsumeTopics(os.Getenv("KAFKA_TOPIC")),
+        kgo.ConsumeTopics(topics...),
+        // Offsets are committed per partition up to the last record
+        // processed without gaps, revoked partitions are committed before
+        // they are handed over
+        kgo.DisableAutoCommit(),
+        kgo.OnPartitionsAssigned(func(ctx context.Context, _ *kgo.Client, assigned map[string][]int32) {
+            offsets.assign(ctx, assigned)
+        }),
+        kgo.OnPartitionsRevoked(func(ctx context.Context, _ *kgo.Client, revoked map[string][]int32) {
+            commitMu.Lock()
+            defer commitMu.Unlock()
+            commitRecords(offsets.revoke(revoked))
+        }),
+        kgo.OnPartitionsLost(func(ctx context.Context, _ *kgo.Client, lost map[string][]int32) {
+            offsets.revoke(lost)
+        }),
     )
     if err != nil {
         log.Fatalf("Error initializing Kafka consumer: %v", err)
     }
 }
 
-func ConsumeMessages(processFunc func(key, value []byte) error) {
-    defer consumer.Close()
+// ConsumeMessages polls and processes records until ctx is cancelled. On
+// shutdown the records in progress are cancelled and the handled ones
+// committed before the consumer leaves the group, the others are left to the
+// next owner of their partition.
+func ConsumeMessages(ctx context.Context, processFunc func(ctx context.Context, key, value []byte) error) {
+    pool := startWorkers(ctx, consumerWorkers, processFunc)
 
-    for {
-        fetches := consumer.PollFetches(context.Background())
+    // Commit in the background so a slow record never holds back the
+    // progress of the others
+    done := make(chan struct{})
+    committed := make(chan struct{})
+    go func() {
+        defer close(committed)
+        ticker := time.NewTicker(commitInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                commitProcessed()
+            case <-done:
+                return
+            }
+        }
+    }()
 
-        if fetchErrs := fetches.Errors(); len(fetchErrs) > 0 {
-            for _, err := range fetchErrs {
+    defer func() {
+        offsets.cancelAll()
+        pool.stop()
+        close(done)
+        <-committed
+        commitProcessed()
+
+        // Close leaves the consumer group so partitions are reassigned right away
+        consumer.Close()
+        log.Println("Kafka consumer stopped")
+    }()
+
+    dispatch := func(record *kgo.Record) {
+        if partition := offsets.dispatch(record); partition != nil {
+            pool.dispatch(ctx, record, partition)
+        }
+    }
+    delays := newRetryDelays(
+        func(partitions map[string][]int32) { consumer.PauseFetchPartitions(partitions) },
+        consumer.ResumeFetchPartitions,
+    )
+
+    for ctx.Err() == nil {
+        // Wake up when the next held retry is due
+        pollCtx, cancel := ctx, context.CancelFunc(func() {})
+        if next := delays.next(); !next.IsZero() {
+            pollCtx, cancel = context.WithDeadline(ctx, next)
+        }
+        fetches := consumer.PollRecords(pollCtx, maxPollRecords)
+        cancel()
+        if fetches.IsClientClosed() {
+            return
+        }
+
+        for _, err := range fetches.Errors() {
+            if pollCtx.Err() == nil {
                 log.Printf("Error consuming Kafka message: %v", err)
             }
-            continue
         }
 
-        iter := fetches.RecordIter()
-        for !iter.Done() {
-            record := iter.Next()
-            log.Printf("Received message: Key=%s, Value=%s", record.Key, record.Value)
+        now := time.Now()
+        fetches.EachRecord(func(record *kgo.Record) {
+            if !delays.hold(record, now) {
+                dispatch(record)
+            }
+        })
+        for _, record := range delays.due(time.Now()) {
+            dispatch(record)
+        }
+    }
+}
 
-            if err := processFunc(record.Key, record.Value); err != nil {
-                log.Printf("Error processing Kafka message: %v", err)
+// commitProcessed commits every partition up to its last record processed
+// without gaps
+func commitProcessed() {
+    commitMu.Lock()
+    defer commitMu.Unlock()
+    commitRecords(offsets.uncommitted())
+}
+
+func commitRecords(records []*kgo.Record) {
+    if len(records) == 0 {
+        return
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), commitTimeout)
+    defer cancel()
+    if err := consumer.CommitRecords(ctx, records...); err != nil {
+        log.Printf("Error committing Kafka offsets: %v", err)
+        return
+    }
+    offsets.committed(records)
+}
+
+// laneRecord is a record queued for a worker with the partition it belongs to
+type laneRecord struct {
+    record    *kgo.Record
+    partition *partitionOffsets
+}
+
+// workerPool processes records on a fixed number of lanes. Records with the
+// same key always land on the same lane, so they are processed in order,
+// while every lane makes progress on its own.
+type workerPool struct {
+    lanes []chan laneRecord
+    wg    sync.WaitGroup
+}
+
+func startWorkers(ctx context.Context, workers int, processFunc func(ctx context.Context, key, value []byte) error) *workerPool {
+    pool := &workerPool{lanes: make([]chan laneRecord, workers)}
+    for i := range pool.lanes {
+        lane := make(chan laneRecord, laneBuffer)
+        pool.lanes[i] = lane
+        pool.wg.Add(1)
+        go func() {
+            defer pool.wg.Done()
+            for queued := range lane {
+                // Queued records are skipped once shutting down or once
+                // their partition is revoked
+                if ctx.Err() != nil || !offsets.start(queued.partition) {
+                    continue
+                }
+                handled := processRecord(queued.partition.ctx, queued.record, processFunc)
+                offsets.finish(queued.partition, queued.record, handled)
             }
+        }()
+    }
+    return pool
+}
+
+// dispatch queues the record on its lane, waiting while the lane is full
+func (p *workerPool) dispatch(ctx context.Context, record *kgo.Record, partition *partitionOffsets) {
+    select {
+    case p.lanes[laneFor(record, len(p.lanes))] <- laneRecord{record: record, partition: partition}:
+    case <-ctx.Done():
+    }
+}
+
+// stop waits for the lanes to finish the records in progress
+func (p *workerPool) stop() {
+    for _, lane := range p.lanes {
+        close(lane)
+    }
+    p.wg.Wait()
+}
+
+// processRecord runs processFunc on a single record and routes failures to
+// the retry or dead-letter topic. It reports whether the record was handled;
+// processing and routing stop when ctx is cancelled, and the record is left
+// unhandled for the next owner of its partition.
+func processRecord(ctx context.Context, record *kgo.Record, processFunc func(ctx context.Context, key, value []byte) error) bool {
+    log.Printf("Received message: Topic=%s, Partition=%d, Offset=%d, Key=%s", record.Topic, record.Partition, record.Offset, record.Key)
+
+    err := processFunc(ctx, record.Key, record.Value)
+    if err == nil {
+        return true
+    }
+    if ctx.Err() != nil {
+        log.Printf("Stopped processing Kafka message of revoked partition: %v", err)
+        return false
+    }
+    log.Printf("Error processing Kafka message: %v", err)
+
+    for {
+        routeErr := handleFailure(record, err)
+        if routeErr == nil {
+            return true
+        }
+        // Routing only fails when Kafka itself is struggling, give it a moment
+        log.Printf("Error routing failed Kafka message: %v", routeErr)
+        timer := time.NewTimer(max(retryPolicy.BaseBackoff, 100*time.Millisecond))
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            return false
         }
-        time.Sleep(time.Second)
     }
-}
\ No newline at end of file
+}
+
+// laneFor picks the worker for a record from its key, falling back to its
+// partition for records without a key
+func laneFor(record *kgo.Record, workers int) int {
+    h := fnv.New32a()
+    if len(record.Key) > 0 {
+        h.Write(record.Key)
+    } else {
+        h.Write([]byte(record.Topic))
+        h.Write([]byte{byte(record.Partition >> 24), byte(record.Partition >> 16), byte(record.Partition >> 8), byte(record.Partition)})
+    }
+    return int(h.Sum32() % uint32(workers))
+}
@@ -0,0 +1,147 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// trackPartition replaces the tracked partitions with a single one
+func trackPartition(t *testing.T, topic string, partition int32) {
+	previous := offsets
+	offsets = newOffsetTracker()
+	offsets.assign(context.Background(), map[string][]int32{topic: {partition}})
+	t.Cleanup(func() { offsets = previous })
+}
+
+func TestWorkersKeepKeyOrder(t *testing.T) {
+	trackPartition(t, "images", 0)
+
+	var mu sync.Mutex
+	seen := map[string][]string{}
+	pool := startWorkers(context.Background(), 4, func(ctx context.Context, key, value []byte) error {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		seen[string(key)] = append(seen[string(key)], string(value))
+		return nil
+	})
+	for i := 0; i < 40; i++ {
+		record := &kgo.Record{
+			Topic:  "images",
+			Key:    []byte(fmt.Sprintf("product-%d", i%5)),
+			Value:  []byte(fmt.Sprintf("%d", i)),
+			Offset: int64(i),
+		}
+		pool.dispatch(context.Background(), record, offsets.dispatch(record))
+	}
+	pool.stop()
+
+	for k := 0; k < 5; k++ {
+		var expected []string
+		for i := k; i < 40; i += 5 {
+			expected = append(expected, fmt.Sprintf("%d", i))
+		}
+		assert.Equal(t, expected, seen[fmt.Sprintf("product-%d", k)])
+	}
+	uncommitted := offsets.uncommitted()
+	require.Len(t, uncommitted, 1)
+	assert.Equal(t, int64(39), uncommitted[0].Offset)
+}
+
+func TestSlowRecordDoesNotBlockOtherLanes(t *testing.T) {
+	trackPartition(t, "images", 0)
+
+	slow := &kgo.Record{Topic: "images", Key: []byte("slow"), Offset: 0}
+	fast := &kgo.Record{Topic: "images", Key: []byte("fast"), Offset: 1}
+	require.NotEqual(t, laneFor(slow, 2), laneFor(fast, 2))
+
+	release := make(chan struct{})
+	fastDone := make(chan struct{})
+	pool := startWorkers(context.Background(), 2, func(ctx context.Context, key, value []byte) error {
+		if string(key) == "slow" {
+			<-release
+		} else {
+			close(fastDone)
+		}
+		return nil
+	})
+	for _, record := range []*kgo.Record{slow, fast} {
+		pool.dispatch(context.Background(), record, offsets.dispatch(record))
+	}
+
+	select {
+	case <-fastDone:
+	case <-time.After(time.Second):
+		t.Fatal("fast record waited for the slow one")
+	}
+	// Nothing is committable past the slow record until it is done
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, offsets.uncommitted())
+
+	close(release)
+	pool.stop()
+	uncommitted := offsets.uncommitted()
+	require.Len(t, uncommitted, 1)
+	assert.Equal(t, int64(1), uncommitted[0].Offset)
+}
+
+func TestOffsetTrackerRevoke(t *testing.T) {
+	trackPartition(t, "images", 0)
+
+	first := &kgo.Record{Topic: "images", Offset: 10}
+	second := &kgo.Record{Topic: "images", Offset: 11}
+	p := offsets.dispatch(first)
+	require.NotNil(t, p)
+	require.NotNil(t, offsets.dispatch(second))
+	assert.Nil(t, offsets.dispatch(first), "records are dispatched once")
+	assert.Nil(t, offsets.dispatch(&kgo.Record{Topic: "images", Partition: 1}), "unassigned partitions are dropped")
+
+	require.True(t, offsets.start(p))
+	offsets.finish(p, first, true)
+
+	// Revoking commits what was processed and skips what is still queued
+	assert.Equal(t, []*kgo.Record{first}, offsets.revoke(map[string][]int32{"images": {0}}))
+	assert.False(t, offsets.start(p))
+	assert.Error(t, p.ctx.Err())
+	assert.Nil(t, offsets.dispatch(&kgo.Record{Topic: "images", Offset: 12}))
+}
+
+func TestRevokeCancelsRecordsInProgress(t *testing.T) {
+	trackPartition(t, "images", 0)
+
+	started := make(chan struct{})
+	pool := startWorkers(context.Background(), 1, func(ctx context.Context, key, value []byte) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	defer pool.stop()
+	record := &kgo.Record{Topic: "images", Offset: 5}
+	pool.dispatch(context.Background(), record, offsets.dispatch(record))
+	<-started
+
+	// The cancelled record is left to the next owner instead of failing
+	revoked := make(chan []*kgo.Record)
+	go func() { revoked <- offsets.revoke(map[string][]int32{"images": {0}}) }()
+	select {
+	case records := <-revoked:
+		assert.Empty(t, records)
+	case <-time.After(time.Second):
+		t.Fatal("revoke waited for the record instead of cancelling it")
+	}
+}
+
+func TestLaneForIsStable(t *testing.T) {
+	record := &kgo.Record{Key: []byte("42:https://example.com/a.jpg")}
+	assert.Equal(t, laneFor(record, 8), laneFor(record, 8))
+
+	unkeyed := &kgo.Record{Topic: "images", Partition: 3}
+	assert.Less(t, laneFor(unkeyed, 8), 8)
+}
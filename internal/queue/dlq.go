@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// dlqPollTimeout is how long ReplayDeadLetters waits for more records before
+// it considers the dead-letter topic drained
+const dlqPollTimeout = 10 * time.Second
+
+// ReplayDeadLetters moves records from the dead-letter topic back onto the
+// topic they were first produced to, with a fresh attempt count. It stops
+// once the topic is drained or limit records were replayed; a limit of zero
+// means no limit. Replayed offsets are committed under groupID, so records
+// are not replayed twice.
+func ReplayDeadLetters(ctx context.Context, brokers []string, groupID string, limit int) (int, error) {
+	if retryPolicy.DeadLetterTopic == "" {
+		return 0, fmt.Errorf("no dead-letter topic configured")
+	}
+
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.ConsumerGroup(groupID),
+		kgo.ConsumeTopics(retryPolicy.DeadLetterTopic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+		kgo.DisableAutoCommit(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error initializing dead-letter consumer: %w", err)
+	}
+	defer client.Close()
+
+	replayed := 0
+	for limit == 0 || replayed < limit {
+		max := 100
+		if limit > 0 && limit-replayed < max {
+			max = limit - replayed
+		}
+
+		pollCtx, cancel := context.WithTimeout(ctx, dlqPollTimeout)
+		fetches := client.PollRecords(pollCtx, max)
+		cancel()
+
+		if err := ctx.Err(); err != nil {
+			return replayed, err
+		}
+		for _, fetchErr := range fetches.Errors() {
+			if errors.Is(fetchErr.Err, context.DeadlineExceeded) {
+				return replayed, nil
+			}
+			return replayed, fmt.Errorf("error consuming dead-letter topic: %w", fetchErr.Err)
+		}
+
+		records := fetches.Records()
+		if len(records) == 0 {
+			return replayed, nil
+		}
+
+		for _, record := range records {
+			if err := PublishRecord(replayRecord(record)); err != nil {
+				return replayed, fmt.Errorf("error replaying dead-letter record at offset %d: %w", record.Offset, err)
+			}
+			replayed++
+		}
+
+		if err := client.CommitRecords(ctx, records...); err != nil {
+			return replayed, fmt.Errorf("error committing dead-letter offsets: %w", err)
+		}
+		log.Printf("Replayed %d dead-letter records", replayed)
+	}
+
+	return replayed, nil
+}
+
+// replayRecord builds the record that re-enters the pipeline for a
+// dead-lettered record, dropping the retry bookkeeping headers
+func replayRecord(record *kgo.Record) *kgo.Record {
+	topic := headerValue(record, HeaderOriginTopic)
+	if topic == "" || topic == retryPolicy.RetryTopic {
+		topic = defaultTopic
+	}
+
+	var headers []kgo.RecordHeader
+	for _, header := range record.Headers {
+		if !strings.HasPrefix(header.Key, "x-") {
+			headers = append(headers, header)
+		}
+	}
+
+	return &kgo.Record{
+		Topic:   topic,
+		Key:     record.Key,
+		Value:   record.Value,
+		Headers: headers,
+	}
+}
@@ -0,0 +1,181 @@
+package queue
+
+import (
+	"context"
+	"sync"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partitionOffsets tracks the records of one assigned partition. A new one
+// is created every time the partition is assigned, so records queued during
+// an earlier assignment are recognized once it is revoked.
+type partitionOffsets struct {
+	// ctx is cancelled when the partition is revoked
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// pending holds the dispatched records that are not committable yet, in
+	// offset order, and done the offsets of those already processed
+	pending []*kgo.Record
+	done    map[int64]bool
+	running int
+	revoked bool
+
+	// last is the last record processed without gaps, committed the last
+	// record committed
+	last      *kgo.Record
+	committed *kgo.Record
+}
+
+// offsetTracker works out how far each partition can be committed while
+// records are processed out of order across lanes
+type offsetTracker struct {
+	mu         sync.Mutex
+	idle       *sync.Cond
+	partitions map[topicPartition]*partitionOffsets
+}
+
+func newOffsetTracker() *offsetTracker {
+	t := &offsetTracker{partitions: make(map[topicPartition]*partitionOffsets)}
+	t.idle = sync.NewCond(&t.mu)
+	return t
+}
+
+// assign starts tracking newly assigned partitions
+func (t *offsetTracker) assign(ctx context.Context, assigned map[string][]int32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for topic, partitions := range assigned {
+		for _, partition := range partitions {
+			tp := topicPartition{topic, partition}
+			if _, ok := t.partitions[tp]; ok {
+				continue
+			}
+			partitionCtx, cancel := context.WithCancel(ctx)
+			t.partitions[tp] = &partitionOffsets{ctx: partitionCtx, cancel: cancel, done: make(map[int64]bool)}
+		}
+	}
+}
+
+// dispatch records that the record is queued for processing. It returns nil
+// for records of partitions no longer assigned and for records already
+// dispatched, which are then dropped.
+func (t *offsetTracker) dispatch(record *kgo.Record) *partitionOffsets {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.partitions[topicPartition{record.Topic, record.Partition}]
+	if p == nil {
+		return nil
+	}
+	if n := len(p.pending); n > 0 && record.Offset <= p.pending[n-1].Offset {
+		return nil
+	}
+	if p.last != nil && record.Offset <= p.last.Offset {
+		return nil
+	}
+	p.pending = append(p.pending, record)
+	return p
+}
+
+// start reports whether a queued record should be processed, which it
+// should not once its partition is revoked
+func (t *offsetTracker) start(p *partitionOffsets) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p.revoked {
+		return false
+	}
+	p.running++
+	return true
+}
+
+// finish records the outcome of a started record. Unhandled records keep
+// their partition from being committed past them.
+func (t *offsetTracker) finish(p *partitionOffsets, record *kgo.Record, handled bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p.running--
+	if handled {
+		p.done[record.Offset] = true
+		for len(p.pending) > 0 && p.done[p.pending[0].Offset] {
+			p.last = p.pending[0]
+			delete(p.done, p.last.Offset)
+			p.pending = p.pending[1:]
+		}
+	}
+	t.idle.Broadcast()
+}
+
+// uncommitted returns the last record processed without gaps of every
+// partition that progressed since its last commit
+func (t *offsetTracker) uncommitted() []*kgo.Record {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var records []*kgo.Record
+	for _, p := range t.partitions {
+		if p.last != nil && p.last != p.committed {
+			records = append(records, p.last)
+		}
+	}
+	return records
+}
+
+// committed records a successful commit of the records
+func (t *offsetTracker) committed(records []*kgo.Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, record := range records {
+		if p := t.partitions[topicPartition{record.Topic, record.Partition}]; p != nil {
+			if p.committed == nil || record.Offset > p.committed.Offset {
+				p.committed = record
+			}
+		}
+	}
+}
+
+// revoke stops tracking the partitions. Queued records of those partitions
+// are skipped and the records in progress are cancelled and waited for, then
+// the records to commit for them are returned.
+func (t *offsetTracker) revoke(revoked map[string][]int32) []*kgo.Record {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var stopped []*partitionOffsets
+	for topic, partitions := range revoked {
+		for _, partition := range partitions {
+			tp := topicPartition{topic, partition}
+			if p := t.partitions[tp]; p != nil {
+				p.revoked = true
+				// Records in progress give up
+				p.cancel()
+				stopped = append(stopped, p)
+				delete(t.partitions, tp)
+			}
+		}
+	}
+
+	var records []*kgo.Record
+	for _, p := range stopped {
+		for p.running > 0 {
+			t.idle.Wait()
+		}
+		if p.last != nil && p.last != p.committed {
+			records = append(records, p.last)
+		}
+	}
+	return records
+}
+
+// cancelAll makes the records in progress give up, used on shutdown
+func (t *offsetTracker) cancelAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range t.partitions {
+		p.cancel()
+	}
+}
@@ -1,65 +1,298 @@
 package queue
 
 import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
     "encoding/json"
+    "errors"
     "fmt"
     "log"
-    "path/filepath"
 
+    "github.com/mohammadshaad/zocket/internal/db"
+    "github.com/mohammadshaad/zocket/pkg/storage"
     "github.com/mohammadshaad/zocket/pkg/util"
 )
 
 type ImageMessage struct {
     ProductID int    `json:"product_id"`
     ImageURL  string `json:"image_url"`
+    // StorageKey is set for images uploaded to our own blob store, which are
+    // read from the store instead of being downloaded
+    StorageKey string `json:"storage_key,omitempty"`
 }
 
-var s3Client *util.S3Client
+// What happens to images that are exact perceptual duplicates of another
+// image in the catalog of the same seller
+const (
+    DuplicatePolicyOff    = "off"
+    DuplicatePolicyFlag   = "flag"
+    DuplicatePolicyReject = "reject"
+)
 
-func InitS3Storage(bucketName string) {
-    client, err := util.InitS3Client(bucketName)
-    if err != nil {
-        log.Fatalf("Failed to initialize S3 client: %v", err)
+// ErrDuplicateImage is returned for duplicate images when they are rejected
+var ErrDuplicateImage = errors.New("duplicate image")
+
+var blobStore storage.BlobStore
+var renditionProfiles = util.DefaultRenditionProfiles
+var colorProfilePolicy = util.ColorProfileStrip
+var imageDownloader = util.NewDownloader(util.DefaultDownloadConfig())
+var duplicatePolicy = DuplicatePolicyOff
+var reserveBlobReference = db.ReserveBlobReference
+var releaseBlobReferences = db.ReleaseBlobReferences
+
+// InitBlobStore sets the store processed images are uploaded to
+func InitBlobStore(store storage.BlobStore) {
+    blobStore = store
+}
+
+// InitRenditionProfiles sets the renditions generated for every image
+func InitRenditionProfiles(profiles []util.RenditionProfile) {
+    renditionProfiles = profiles
+}
+
+// InitColorProfilePolicy sets what happens to the ICC profiles of images
+func InitColorProfilePolicy(policy util.ColorProfilePolicy) {
+    colorProfilePolicy = policy
+}
+
+// InitDownloader sets the limits of image downloads
+func InitDownloader(cfg util.DownloadConfig) {
+    imageDownloader = util.NewDownloader(cfg)
+}
+
+// InitDuplicatePolicy sets whether duplicate images are ignored, flagged or
+// rejected
+func InitDuplicatePolicy(policy string) error {
+    switch policy {
+    case DuplicatePolicyOff, DuplicatePolicyFlag, DuplicatePolicyReject:
+        duplicatePolicy = policy
+        return nil
     }
-    s3Client = client
+    return fmt.Errorf("unknown duplicate image policy %q, expected off, flag or reject", policy)
 }
 
-func ProcessImageMessage(key, value []byte) error {
+// ProcessImageMessage processes the image of a Kafka message. It gives up
+// when ctx is cancelled, leaving the image to be processed again.
+func ProcessImageMessage(ctx context.Context, key, value []byte) error {
     // Parse the message
     var msg ImageMessage
     if err := json.Unmarshal(value, &msg); err != nil {
-        return fmt.Errorf("error unmarshaling message: %w", err)
+        return Permanent(fmt.Errorf("error unmarshaling message: %w", err))
+    }
+
+    productID := uint(msg.ProductID)
+    err := db.MarkImageProcessing(productID, msg.ImageURL)
+    if errors.Is(err, db.ErrImageGone) {
+        return Permanent(err)
+    }
+    if err != nil {
+        log.Printf("Error updating image status: %v", err)
     }
 
+    s3URL, err := processImage(ctx, msg)
+    if err != nil {
+        // The partition was revoked, the image stays in processing for its next owner
+        if ctx.Err() != nil {
+            return err
+        }
+        if statusErr := db.MarkImageFailed(productID, msg.ImageURL, err); statusErr != nil {
+            log.Printf("Error updating image status: %v", statusErr)
+        }
+        return err
+    }
+
+    if err := db.MarkImageDone(productID, msg.ImageURL, s3URL); err != nil {
+        log.Printf("Error updating image status: %v", err)
+    }
+    return nil
+}
+
+// processImage renders every rendition profile of the image, uploads them
+// and stores the resulting URLs on the product. It returns the URL of the
+// primary rendition.
+func processImage(ctx context.Context, msg ImageMessage) (string, error) {
     log.Printf("Processing image for product %d: %s", msg.ProductID, msg.ImageURL)
 
     // Download Image
-    img, err := util.DownloadImage(msg.ImageURL)
+    img, err := loadImage(ctx, msg)
     if err != nil {
-        return fmt.Errorf("error downloading image: %w", err)
+        // Rejected images fail the same way on every attempt
+        if errors.Is(err, util.ErrImageRejected) {
+            return "", Permanent(fmt.Errorf("error downloading image: %w", err))
+        }
+        return "", fmt.Errorf("error downloading image: %w", err)
     }
 
-    // Compress Image
-    compressed, err := util.CompressImage(img, 75)
-    if err != nil {
-        return fmt.Errorf("error compressing image: %w", err)
+    hash := util.PerceptualHash(img.Image)
+    if err := checkDuplicate(msg, hash); err != nil {
+        return "", err
     }
 
-    // Generate unique filename for the compressed image
-    originalFilename := filepath.Base(msg.ImageURL)
-    compressedFilename := fmt.Sprintf("compressed/%d_%s", msg.ProductID, originalFilename)
+    primary := util.PrimaryRendition(renditionProfiles)
+
+    // References reserved by this run are released unless the product is
+    // saved with them, otherwise their objects would never be collected
+    var reserved []string
+    saved := false
+    defer func() {
+        if saved {
+            return
+        }
+        if err := releaseBlobReferences(uint(msg.ProductID), msg.ImageURL, reserved); err != nil {
+            log.Printf("Error releasing blob references: %v", err)
+        }
+    }()
+
+    var primaryURL string
+    var keys []string
+    renditions := make([]db.ImageRendition, 0, len(renditionProfiles))
+    for _, profile := range renditionProfiles {
+        // Resize and compress the image in every format of the profile
+        variants, err := util.RenderRenditions(img.Image, profile, img.ICCProfile)
+        if err != nil {
+            return "", fmt.Errorf("error rendering %s rendition: %w", profile.Name, err)
+        }
+
+        for _, rendition := range variants {
+            // Upload the rendition to the blob store
+            key := renditionKey(profile, rendition)
+            url, created, err := uploadRendition(ctx, msg, key, rendition)
+            if created {
+                reserved = append(reserved, key)
+            }
+            if err != nil {
+                return "", fmt.Errorf("error uploading %s rendition to blob store: %w", profile.Name, err)
+            }
+            keys = append(keys, key)
+
+            renditions = append(renditions, db.ImageRendition{
+                Name:        profile.Name,
+                URL:         url,
+                Width:       rendition.Width,
+                Height:      rendition.Height,
+                Format:      rendition.Format,
+                ContentType: rendition.ContentType,
+            })
+
+            // The fallback format of the primary profile is listed last
+            if profile.Name == primary.Name {
+                primaryURL = url
+            }
+        }
+    }
+
+    // Update the product record with the rendition URLs
+    if err := util.UpdateProductImage(msg.ProductID, msg.ImageURL, primaryURL, renditions); err != nil {
+        // The product or image was deleted while it was processed
+        if errors.Is(err, db.ErrImageGone) {
+            // Drop every reference of the image, also those of earlier runs
+            if err := db.ReplaceBlobReferences(uint(msg.ProductID), msg.ImageURL, nil); err != nil {
+                log.Printf("Error releasing blob references: %v", err)
+            }
+            return "", Permanent(err)
+        }
+        return "", fmt.Errorf("error updating product image URL: %w", err)
+    }
+    saved = true
 
-    // Upload Compressed Image to S3
-    s3URL, err := s3Client.UploadToS3(compressedFilename, compressed)
+    // Objects are shared between images, record which ones this image uses
+    if err := db.ReplaceBlobReferences(uint(msg.ProductID), msg.ImageURL, keys); err != nil {
+        return "", fmt.Errorf("error recording blob references: %w", err)
+    }
+
+    // The hash only feeds duplicate detection, the image itself is done
+    if err := db.SaveImageHash(uint(msg.ProductID), msg.ImageURL, hash); err != nil {
+        log.Printf("Error saving image hash: %v", err)
+    }
+
+    log.Printf("Successfully processed image for product %d. Compressed URL: %s", msg.ProductID, primaryURL)
+    return primaryURL, nil
+}
+
+// checkDuplicate applies the duplicate policy to an image with the given
+// perceptual hash
+func checkDuplicate(msg ImageMessage, hash uint64) error {
+    if duplicatePolicy == DuplicatePolicyOff {
+        return nil
+    }
+
+    productID := uint(msg.ProductID)
+    duplicate, err := db.FindDuplicateImage(productID, msg.ImageURL, hash)
     if err != nil {
-        return fmt.Errorf("error uploading to S3: %w", err)
+        return fmt.Errorf("error looking up duplicate images: %w", err)
+    }
+    if duplicate == nil {
+        return nil
     }
 
-    // Update the product record with the compressed image URL
-    if err := util.UpdateProductImageURL(msg.ProductID, msg.ImageURL, s3URL); err != nil {
-        return fmt.Errorf("error updating product image URL: %w", err)
+    if duplicatePolicy == DuplicatePolicyReject {
+        return Permanent(fmt.Errorf("%w: same image as %s of product %d", ErrDuplicateImage, duplicate.ImageURL, duplicate.ProductID))
     }
 
-    log.Printf("Successfully processed image for product %d. Compressed URL: %s", msg.ProductID, s3URL)
+    log.Printf("Image %s of product %d duplicates %s of product %d", msg.ImageURL, msg.ProductID, duplicate.ImageURL, duplicate.ProductID)
+    if err := db.MarkImageDuplicate(productID, msg.ImageURL, duplicate); err != nil {
+        log.Printf("Error updating image status: %v", err)
+    }
     return nil
-}
\ No newline at end of file
+}
+
+// loadImage reads uploaded images from the blob store and downloads all
+// other images
+func loadImage(ctx context.Context, msg ImageMessage) (*util.DecodedImage, error) {
+    key := msg.StorageKey
+    if key == "" {
+        var ok bool
+        if key, ok = storage.KeyFromURL(blobStore, msg.ImageURL); !ok {
+            return imageDownloader.Download(ctx, msg.ImageURL, colorProfilePolicy)
+        }
+    }
+
+    body, err := blobStore.Get(ctx, key)
+    if errors.Is(err, storage.ErrNotFound) {
+        return nil, fmt.Errorf("%w: uploaded image %s no longer exists", util.ErrImageRejected, key)
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer body.Close()
+    return imageDownloader.Decode(body, colorProfilePolicy)
+}
+
+// renditionKey derives the storage key of a rendition from its content, so
+// identical renditions share one object and different images never
+// overwrite each other
+func renditionKey(profile util.RenditionProfile, rendition *util.Rendition) string {
+    sum := sha256.Sum256(rendition.Data)
+    return fmt.Sprintf("renditions/%s/%s.%s", profile.Name, hex.EncodeToString(sum[:]), fileExtension(rendition.Format))
+}
+
+// uploadRendition stores a rendition unless an object with the same content
+// already exists and returns its URL. The image references the object before
+// the existence check, so the garbage collector cannot delete a reused object
+// before the product is saved. It reports whether it reserved a new
+// reference, also when the upload fails.
+func uploadRendition(ctx context.Context, msg ImageMessage, key string, rendition *util.Rendition) (string, bool, error) {
+    created, err := reserveBlobReference(uint(msg.ProductID), msg.ImageURL, key)
+    if err != nil {
+        return "", false, fmt.Errorf("error reserving blob reference: %w", err)
+    }
+
+    exists, err := blobStore.Exists(ctx, key)
+    if err != nil {
+        return "", created, err
+    }
+    if exists {
+        return blobStore.URL(key), created, nil
+    }
+    url, err := blobStore.Put(ctx, key, bytes.NewReader(rendition.Data), rendition.ContentType)
+    return url, created, err
+}
+
+func fileExtension(format string) string {
+    if format == util.FormatJPEG {
+        return "jpg"
+    }
+    return format
+}
@@ -0,0 +1,142 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mohammadshaad/zocket/internal/gc"
+	"github.com/mohammadshaad/zocket/pkg/storage"
+	"github.com/mohammadshaad/zocket/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenditionKeysAreContentAddressed(t *testing.T) {
+	store := storage.NewMemoryStore("https://cdn.example.com")
+	InitBlobStore(store)
+
+	thumbnail := util.RenditionProfile{Name: "thumbnail"}
+	large := util.RenditionProfile{Name: "large"}
+	a := &util.Rendition{Data: []byte("first image"), Format: util.FormatJPEG, ContentType: "image/jpeg"}
+	b := &util.Rendition{Data: []byte("second image"), Format: util.FormatJPEG, ContentType: "image/jpeg"}
+
+	key := renditionKey(thumbnail, a)
+	assert.True(t, strings.HasPrefix(key, "renditions/thumbnail/"), key)
+	assert.True(t, strings.HasSuffix(key, ".jpg"), key)
+	assert.Equal(t, key, renditionKey(thumbnail, &util.Rendition{Data: []byte("first image"), Format: util.FormatJPEG}))
+	assert.NotEqual(t, key, renditionKey(thumbnail, b))
+	assert.NotEqual(t, key, renditionKey(large, a))
+
+	// References are reserved under the same lock the collector deletes
+	// objects with
+	var mu sync.Mutex
+	reserved := map[string]bool{}
+	collector := &gc.Collector{
+		Store:  store,
+		Cutoff: time.Now().Add(time.Minute),
+		InUse: func(ctx context.Context, key string) (bool, error) {
+			return reserved[key], nil
+		},
+		Lock: func(ctx context.Context, key string, fn func() error) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return fn()
+		},
+	}
+	var beforeReserve func()
+	defer func(f func(uint, string, string) (bool, error)) { reserveBlobReference = f }(reserveBlobReference)
+	reserveBlobReference = func(productID uint, sourceURL, key string) (bool, error) {
+		if beforeReserve != nil {
+			beforeReserve()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		created := !reserved[key]
+		reserved[key] = true
+		return created, nil
+	}
+	msg := ImageMessage{ProductID: 1, ImageURL: "https://example.com/a.jpg"}
+
+	url, created, err := uploadRendition(context.Background(), msg, key, a)
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, store.URL(key), url)
+
+	// An existing object is reused as is, a collection running before the
+	// product is saved keeps it
+	url, created, err = uploadRendition(context.Background(), msg, key, &util.Rendition{Data: []byte("ignored"), ContentType: "image/jpeg"})
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, store.URL(key), url)
+	report, err := collector.Run(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, report.Deleted)
+
+	body, err := store.Get(context.Background(), key)
+	require.NoError(t, err)
+	data, _ := io.ReadAll(body)
+	assert.Equal(t, "first image", string(data))
+
+	// An object collected right before it is reserved is uploaded again
+	delete(reserved, key)
+	beforeReserve = func() {
+		report, err := collector.Run(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Deleted)
+	}
+	url, _, err = uploadRendition(context.Background(), msg, key, a)
+	require.NoError(t, err)
+	assert.Equal(t, store.URL(key), url)
+	exists, err := store.Exists(context.Background(), key)
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+// failingStore rejects every upload
+type failingStore struct {
+	*storage.MemoryStore
+}
+
+func (s failingStore) Put(ctx context.Context, key string, body io.Reader, contentType string) (string, error) {
+	return "", errors.New("upload failed")
+}
+
+func TestProcessImageReleasesReservationsOnFailure(t *testing.T) {
+	store := failingStore{storage.NewMemoryStore("")}
+	defer InitBlobStore(blobStore)
+	InitBlobStore(store)
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 64, 48))))
+	// Only the renditions go through the failing Put
+	_, err := store.MemoryStore.Put(context.Background(), "uploads/a.png", &buf, "image/png")
+	require.NoError(t, err)
+
+	reserved := map[string]bool{"renditions/large/earlier.jpg": true}
+	defer func(f func(uint, string, string) (bool, error)) { reserveBlobReference = f }(reserveBlobReference)
+	reserveBlobReference = func(productID uint, sourceURL, key string) (bool, error) {
+		created := !reserved[key]
+		reserved[key] = true
+		return created, nil
+	}
+	defer func(f func(uint, string, []string) error) { releaseBlobReferences = f }(releaseBlobReferences)
+	releaseBlobReferences = func(productID uint, sourceURL string, keys []string) error {
+		for _, key := range keys {
+			delete(reserved, key)
+		}
+		return nil
+	}
+
+	_, err = processImage(context.Background(), ImageMessage{ProductID: 1, ImageURL: "https://example.com/a.png", StorageKey: "uploads/a.png"})
+	require.ErrorContains(t, err, "upload failed")
+	// References of earlier runs are kept
+	assert.Equal(t, map[string]bool{"renditions/large/earlier.jpg": true}, reserved)
+}
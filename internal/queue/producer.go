@@ -4,6 +4,7 @@ import (
     "context"
     "log"
     "fmt"
+    "time"
 
     "github.com/twmb/franz-go/pkg/kgo"
 )
@@ -41,8 +42,23 @@ func PublishMessage(key, value []byte) error {
     return producer.ProduceSync(context.Background(), record).FirstErr()
 }
 
+// PublishRecord produces a fully specified record, used to route messages to
+// the retry and dead-letter topics
+func PublishRecord(record *kgo.Record) error {
+    if producer == nil {
+        return fmt.Errorf("kafka producer is not initialized")
+    }
+    return producer.ProduceSync(context.Background(), record).FirstErr()
+}
+
+// CloseProducer flushes buffered records and closes the producer
 func CloseProducer() {
     if producer != nil {
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        if err := producer.Flush(ctx); err != nil {
+            log.Printf("Error flushing Kafka producer: %v", err)
+        }
         producer.Close()
     }
 }
\ No newline at end of file
@@ -0,0 +1,230 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mohammadshaad/zocket/config"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Headers attached to records that are retried or dead-lettered
+const (
+	HeaderAttempt         = "x-attempt"
+	HeaderError           = "x-error"
+	HeaderRetryAt         = "x-retry-at"
+	HeaderFailedAt        = "x-failed-at"
+	HeaderOriginTopic     = "x-original-topic"
+	HeaderOriginPartition = "x-original-partition"
+	HeaderOriginOffset    = "x-original-offset"
+)
+
+// RetryPolicy controls how failed records are retried before they are moved
+// to the dead-letter topic
+type RetryPolicy struct {
+	MaxAttempts     int
+	BaseBackoff     time.Duration
+	MaxBackoff      time.Duration
+	RetryTopic      string
+	DeadLetterTopic string
+}
+
+var retryPolicy RetryPolicy
+
+// RetryPolicyFromEnv builds the retry policy from the environment. The retry
+// and dead-letter topics default to the main topic with a .retry and .dlq
+// suffix.
+func RetryPolicyFromEnv() RetryPolicy {
+	topic := os.Getenv("KAFKA_TOPIC")
+	return RetryPolicy{
+		MaxAttempts:     config.GetEnvInt("IMAGE_MAX_ATTEMPTS", 5),
+		BaseBackoff:     config.GetEnvDuration("IMAGE_RETRY_BASE_BACKOFF", time.Second),
+		MaxBackoff:      config.GetEnvDuration("IMAGE_RETRY_MAX_BACKOFF", 5*time.Minute),
+		RetryTopic:      config.GetEnv("KAFKA_RETRY_TOPIC", topic+".retry"),
+		DeadLetterTopic: config.GetEnv("KAFKA_DLQ_TOPIC", topic+".dlq"),
+	}
+}
+
+// InitRetryPolicy sets the policy used by ConsumeMessages for failed records.
+// It must be called before InitConsumer so the retry topic is subscribed.
+func InitRetryPolicy(policy RetryPolicy) {
+	retryPolicy = policy
+}
+
+// Backoff returns the delay before the given attempt is retried, doubling
+// with every attempt up to MaxBackoff
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := p.BaseBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+// permanentError marks a failure that retrying cannot fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that the record is dead-lettered without retries
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+func headerValue(record *kgo.Record, key string) string {
+	for _, header := range record.Headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func setHeader(headers []kgo.RecordHeader, key, value string) []kgo.RecordHeader {
+	for i, header := range headers {
+		if header.Key == key {
+			headers[i].Value = []byte(value)
+			return headers
+		}
+	}
+	return append(headers, kgo.RecordHeader{Key: key, Value: []byte(value)})
+}
+
+// recordAttempt returns which processing attempt the record represents
+func recordAttempt(record *kgo.Record) int {
+	attempt, err := strconv.Atoi(headerValue(record, HeaderAttempt))
+	if err != nil || attempt < 1 {
+		return 1
+	}
+	return attempt
+}
+
+// retryAt returns when a record of the retry topic is due, the zero time
+// for records that are due right away
+func retryAt(record *kgo.Record) time.Time {
+	if record.Topic != retryPolicy.RetryTopic {
+		return time.Time{}
+	}
+	at, err := time.Parse(time.RFC3339Nano, headerValue(record, HeaderRetryAt))
+	if err != nil {
+		return time.Time{}
+	}
+	return at
+}
+
+// retryDelays holds the records of the retry topic until they are due. The
+// partition of a held record is paused meanwhile, so no worker sleeps on a
+// retry and rebalances are never blocked by one. Records behind a held one
+// are held too, keeping the partition in order.
+type retryDelays struct {
+	held   map[topicPartition][]*kgo.Record
+	pause  func(map[string][]int32)
+	resume func(map[string][]int32)
+}
+
+func newRetryDelays(pause, resume func(map[string][]int32)) *retryDelays {
+	return &retryDelays{held: make(map[topicPartition][]*kgo.Record), pause: pause, resume: resume}
+}
+
+// hold reports whether the record is held back instead of being processed
+func (d *retryDelays) hold(record *kgo.Record, now time.Time) bool {
+	tp := topicPartition{record.Topic, record.Partition}
+	if len(d.held[tp]) == 0 {
+		if !retryAt(record).After(now) {
+			return false
+		}
+		d.pause(map[string][]int32{record.Topic: {record.Partition}})
+	}
+	d.held[tp] = append(d.held[tp], record)
+	return true
+}
+
+// due releases the held records whose time has come, resuming the
+// partitions with nothing left to hold
+func (d *retryDelays) due(now time.Time) []*kgo.Record {
+	var released []*kgo.Record
+	for tp, records := range d.held {
+		for len(records) > 0 && !retryAt(records[0]).After(now) {
+			released = append(released, records[0])
+			records = records[1:]
+		}
+		if len(records) > 0 {
+			d.held[tp] = records
+			continue
+		}
+		delete(d.held, tp)
+		d.resume(map[string][]int32{tp.topic: {tp.partition}})
+	}
+	return released
+}
+
+// next returns when the next held record is due, the zero time when none
+// is held
+func (d *retryDelays) next() time.Time {
+	var next time.Time
+	for _, records := range d.held {
+		if at := retryAt(records[0]); next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next
+}
+
+// handleFailure sends a failed record to the retry topic, or to the
+// dead-letter topic once it is out of attempts
+func handleFailure(record *kgo.Record, cause error) error {
+	attempt := recordAttempt(record)
+
+	// Keep the metadata of the record that was first produced so the
+	// dead-letter topic points at the original message
+	headers := append([]kgo.RecordHeader(nil), record.Headers...)
+	if headerValue(record, HeaderOriginTopic) == "" {
+		headers = setHeader(headers, HeaderOriginTopic, record.Topic)
+		headers = setHeader(headers, HeaderOriginPartition, strconv.Itoa(int(record.Partition)))
+		headers = setHeader(headers, HeaderOriginOffset, strconv.FormatInt(record.Offset, 10))
+	}
+	headers = setHeader(headers, HeaderError, cause.Error())
+	headers = setHeader(headers, HeaderFailedAt, time.Now().UTC().Format(time.RFC3339Nano))
+
+	if !isPermanent(cause) && retryPolicy.RetryTopic != "" && attempt < retryPolicy.MaxAttempts {
+		retryAt := time.Now().Add(retryPolicy.Backoff(attempt))
+		headers = setHeader(headers, HeaderAttempt, strconv.Itoa(attempt+1))
+		headers = setHeader(headers, HeaderRetryAt, retryAt.UTC().Format(time.RFC3339Nano))
+
+		log.Printf("Retrying message (attempt %d of %d) at %s: %v", attempt+1, retryPolicy.MaxAttempts, retryAt.Format(time.RFC3339), cause)
+		return PublishRecord(&kgo.Record{
+			Topic:   retryPolicy.RetryTopic,
+			Key:     record.Key,
+			Value:   record.Value,
+			Headers: headers,
+		})
+	}
+
+	if retryPolicy.DeadLetterTopic == "" {
+		return fmt.Errorf("giving up on message after %d attempts: %w", attempt, cause)
+	}
+
+	headers = setHeader(headers, HeaderAttempt, strconv.Itoa(attempt))
+	log.Printf("Moving message to dead-letter topic after %d attempts: %v", attempt, cause)
+	return PublishRecord(&kgo.Record{
+		Topic:   retryPolicy.DeadLetterTopic,
+		Key:     record.Key,
+		Value:   record.Value,
+		Headers: headers,
+	})
+}
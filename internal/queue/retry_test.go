@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	assert.Equal(t, time.Second, policy.Backoff(1))
+	assert.Equal(t, 2*time.Second, policy.Backoff(2))
+	assert.Equal(t, 8*time.Second, policy.Backoff(4))
+	assert.Equal(t, 10*time.Second, policy.Backoff(5))
+	assert.Equal(t, 10*time.Second, policy.Backoff(50))
+}
+
+func TestRecordAttempt(t *testing.T) {
+	assert.Equal(t, 1, recordAttempt(&kgo.Record{}))
+	assert.Equal(t, 3, recordAttempt(&kgo.Record{Headers: []kgo.RecordHeader{{Key: HeaderAttempt, Value: []byte("3")}}}))
+	assert.Equal(t, 1, recordAttempt(&kgo.Record{Headers: []kgo.RecordHeader{{Key: HeaderAttempt, Value: []byte("x")}}}))
+}
+
+func TestReplayRecord(t *testing.T) {
+	defaultTopic = "images"
+	retryPolicy = RetryPolicy{RetryTopic: "images.retry", DeadLetterTopic: "images.dlq"}
+
+	record := replayRecord(&kgo.Record{
+		Topic: "images.dlq",
+		Key:   []byte("1"),
+		Value: []byte("{}"),
+		Headers: []kgo.RecordHeader{
+			{Key: "trace-id", Value: []byte("abc")},
+			{Key: HeaderAttempt, Value: []byte("5")},
+			{Key: HeaderOriginTopic, Value: []byte("images.priority")},
+		},
+	})
+
+	assert.Equal(t, "images.priority", record.Topic)
+	assert.Equal(t, []kgo.RecordHeader{{Key: "trace-id", Value: []byte("abc")}}, record.Headers)
+
+	record = replayRecord(&kgo.Record{Topic: "images.dlq"})
+	assert.Equal(t, "images", record.Topic)
+}
+
+func TestRetryDelays(t *testing.T) {
+	retryPolicy = RetryPolicy{RetryTopic: "images.retry"}
+	now := time.Now()
+	retry := func(offset int64, at time.Time) *kgo.Record {
+		return &kgo.Record{Topic: "images.retry", Offset: offset, Headers: []kgo.RecordHeader{
+			{Key: HeaderRetryAt, Value: []byte(at.UTC().Format(time.RFC3339Nano))},
+		}}
+	}
+
+	var paused, resumed []map[string][]int32
+	delays := newRetryDelays(
+		func(p map[string][]int32) { paused = append(paused, p) },
+		func(p map[string][]int32) { resumed = append(resumed, p) },
+	)
+
+	assert.False(t, delays.hold(&kgo.Record{Topic: "images"}, now))
+	assert.False(t, delays.hold(retry(0, now.Add(-time.Second)), now), "due retries are not held")
+
+	// Records behind a held retry are held too, even when due
+	late := retry(1, now.Add(time.Minute))
+	due := retry(2, now)
+	assert.True(t, delays.hold(late, now))
+	assert.True(t, delays.hold(due, now))
+	assert.Equal(t, []map[string][]int32{{"images.retry": {0}}}, paused)
+	assert.Equal(t, late.Headers[0].Value, []byte(delays.next().UTC().Format(time.RFC3339Nano)))
+
+	assert.Empty(t, delays.due(now.Add(time.Second)))
+	assert.Empty(t, resumed)
+
+	assert.Equal(t, []*kgo.Record{late, due}, delays.due(now.Add(time.Minute)))
+	assert.Equal(t, []map[string][]int32{{"images.retry": {0}}}, resumed)
+	assert.True(t, delays.next().IsZero())
+}
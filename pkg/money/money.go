@@ -0,0 +1,258 @@
+// Package money represents prices exactly, as an integer number of minor
+// units (cents) of an ISO 4217 currency
+package money
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+var (
+	// ErrUnknownCurrency is returned for codes that are not ISO 4217 currencies
+	ErrUnknownCurrency = errors.New("unknown currency")
+	// ErrInvalidAmount is returned for amounts that are not decimal numbers or
+	// are more precise than the minor units of their currency
+	ErrInvalidAmount = errors.New("invalid amount")
+)
+
+// exponents holds the number of minor unit digits of the supported ISO 4217
+// currencies
+var exponents = map[string]int{
+	"AED": 2, "ARS": 2, "AUD": 2, "BDT": 2, "BHD": 3, "BRL": 2, "CAD": 2,
+	"CHF": 2, "CLP": 0, "CNY": 2, "COP": 2, "CZK": 2, "DKK": 2, "EGP": 2,
+	"EUR": 2, "GBP": 2, "HKD": 2, "HUF": 2, "IDR": 2, "ILS": 2, "INR": 2,
+	"ISK": 0, "JOD": 3, "JPY": 0, "KES": 2, "KRW": 0, "KWD": 3, "LKR": 2,
+	"MXN": 2, "MYR": 2, "NGN": 2, "NOK": 2, "NPR": 2, "NZD": 2, "OMR": 3,
+	"PEN": 2, "PHP": 2, "PKR": 2, "PLN": 2, "QAR": 2, "RON": 2, "RUB": 2,
+	"SAR": 2, "SEK": 2, "SGD": 2, "THB": 2, "TND": 3, "TRY": 2, "TWD": 2,
+	"UAH": 2, "USD": 2, "VND": 0, "ZAR": 2,
+}
+
+var defaultCurrency = "USD"
+
+// SetDefaultCurrency sets the currency of amounts given without one
+func SetDefaultCurrency(code string) error {
+	if _, ok := exponents[code]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownCurrency, code)
+	}
+	defaultCurrency = code
+	return nil
+}
+
+// DefaultCurrency returns the currency of amounts given without one
+func DefaultCurrency() string {
+	return defaultCurrency
+}
+
+// Exponent returns the number of minor unit digits of a currency
+func Exponent(code string) (int, bool) {
+	exp, ok := exponents[code]
+	return exp, ok
+}
+
+// Money is an amount in the minor units of its currency, 6969 USD cents for
+// $69.69. It is stored in two columns and encoded in JSON as
+// {"amount": "69.69", "currency": "USD"}.
+type Money struct {
+	Amount   int64  `gorm:"column:amount;not null"`
+	Currency string `gorm:"column:currency;type:char(3);not null"`
+}
+
+// Parse reads a decimal amount such as "69.69" in the given currency. More
+// decimals than the currency has minor units are rejected, not rounded.
+func Parse(amount, currency string) (Money, error) {
+	exp, ok := exponents[currency]
+	if !ok {
+		return Money{}, fmt.Errorf("%w %q", ErrUnknownCurrency, currency)
+	}
+
+	s := amount
+	negative := strings.HasPrefix(s, "-")
+	if negative {
+		s = s[1:]
+	}
+	whole, frac, hasPoint := strings.Cut(s, ".")
+	if whole == "" || (hasPoint && frac == "") || !isDigits(whole) || !isDigits(frac) {
+		return Money{}, fmt.Errorf("%w %q", ErrInvalidAmount, amount)
+	}
+	if len(frac) > exp {
+		// Trailing zeros carry no precision
+		trimmed := strings.TrimRight(frac[exp:], "0")
+		if trimmed != "" {
+			return Money{}, fmt.Errorf("%w %q: more than %d decimals for %s", ErrInvalidAmount, amount, exp, currency)
+		}
+		frac = frac[:exp]
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	var minor big.Int
+	if _, ok := minor.SetString(whole+frac, 10); !ok || !minor.IsInt64() {
+		return Money{}, fmt.Errorf("%w %q: out of range", ErrInvalidAmount, amount)
+	}
+	m := Money{Amount: minor.Int64(), Currency: currency}
+	if negative {
+		m.Amount = -m.Amount
+	}
+	return m, nil
+}
+
+// MustParse is like Parse but panics on error, for constants and tests
+func MustParse(amount, currency string) Money {
+	m, err := Parse(amount, currency)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Decimal formats the amount in major units, "69.69" for 6969 cents
+func (m Money) Decimal() string {
+	exp := exponents[m.Currency]
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+	}
+	digits := new(big.Int).Abs(big.NewInt(amount)).String()
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// String formats the amount with its currency, "69.69 USD"
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+// Rat returns the amount in major units as an exact fraction
+func (m Money) Rat() *big.Rat {
+	exp := exponents[m.Currency]
+	return new(big.Rat).SetFrac(big.NewInt(m.Amount), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+}
+
+type moneyJSON struct {
+	Amount   json.RawMessage `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{m.Decimal(), m.Currency})
+}
+
+// UnmarshalJSON accepts {"amount": "69.69", "currency": "USD"}, with the
+// amount as a string or a number, and a bare amount in the default currency
+// for clients written before prices had a currency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	amount, currency := data, defaultCurrency
+	if len(data) > 0 && data[0] == '{' {
+		var v moneyJSON
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		amount = v.Amount
+		if v.Currency != "" {
+			currency = strings.ToUpper(v.Currency)
+		}
+	}
+
+	decimal, err := amountText(amount)
+	if err != nil {
+		return err
+	}
+	parsed, err := Parse(decimal, currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// amountText returns the decimal text of a JSON number or string. Numbers
+// are read from their literal, so 69.69 never goes through a float.
+func amountText(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", fmt.Errorf("%w: amount is required", ErrInvalidAmount)
+	}
+	if data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return "", err
+		}
+		return s, nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return "", fmt.Errorf("%w: must be a number or a decimal string", ErrInvalidAmount)
+	}
+	s := n.String()
+	// Exponent notation is expanded exactly
+	if strings.ContainsAny(s, "eE") {
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return "", fmt.Errorf("%w %s", ErrInvalidAmount, s)
+		}
+		return r.FloatString(decimalsOf(r)), nil
+	}
+	return s, nil
+}
+
+// decimalsOf returns how many decimals are needed to write r exactly, or a
+// generous bound when it has no finite expansion
+func decimalsOf(r *big.Rat) int {
+	for d := 0; d <= 18; d++ {
+		scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d)), nil)))
+		if scaled.IsInt() {
+			return d
+		}
+	}
+	return 18
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// roundHalfEven rounds r to the nearest integer, ties to even, and reports
+// whether it fits in an int64
+func roundHalfEven(r *big.Rat) (int64, bool) {
+	num, den := r.Num(), r.Denom()
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	// Compare twice the remainder with the denominator
+	twice := new(big.Int).Abs(rem)
+	twice.Lsh(twice, 1)
+	cmp := twice.Cmp(den)
+	if cmp > 0 || (cmp == 0 && q.Bit(0) == 1) {
+		if r.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	if !q.IsInt64() || q.Int64() == math.MinInt64 {
+		return 0, false
+	}
+	return q.Int64(), true
+}
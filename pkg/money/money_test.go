@@ -0,0 +1,102 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAndDecimal(t *testing.T) {
+	tests := []struct {
+		amount, currency string
+		minor            int64
+		decimal          string
+	}{
+		{"69.69", "USD", 6969, "69.69"},
+		{"69.6900", "USD", 6969, "69.69"},
+		{"0.05", "EUR", 5, "0.05"},
+		{"12", "USD", 1200, "12.00"},
+		{"1500", "JPY", 1500, "1500"},
+		{"1.005", "KWD", 1005, "1.005"},
+		{"-3.5", "USD", -350, "-3.50"},
+	}
+	for _, tt := range tests {
+		m, err := Parse(tt.amount, tt.currency)
+		require.NoError(t, err, tt.amount)
+		assert.Equal(t, tt.minor, m.Amount, tt.amount)
+		assert.Equal(t, tt.decimal, m.Decimal(), tt.amount)
+	}
+
+	for _, bad := range [][2]string{{"69.691", "USD"}, {"1.5", "JPY"}, {"abc", "USD"}, {"1.", "USD"}, {".5", "USD"}, {"1e3", "USD"}, {"1", "XXX"}, {"99999999999999999999", "USD"}} {
+		_, err := Parse(bad[0], bad[1])
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	data, err := json.Marshal(MustParse("69.69", "USD"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"amount": "69.69", "currency": "USD"}`, string(data))
+
+	for input, want := range map[string]Money{
+		`{"amount": "69.69", "currency": "usd"}`: {6969, "USD"},
+		`{"amount": 1500, "currency": "JPY"}`:    {1500, "JPY"},
+		`{"amount": 19.99}`:                      {1999, "USD"},
+		`69.69`:                                  {6969, "USD"},
+		`"0.10"`:                                 {10, "USD"},
+		`1.2e1`:                                  {1200, "USD"},
+	} {
+		var m Money
+		require.NoError(t, json.Unmarshal([]byte(input), &m), input)
+		assert.Equal(t, want, m, input)
+	}
+
+	var m Money
+	assert.Error(t, json.Unmarshal([]byte(`69.691`), &m))
+	assert.Error(t, json.Unmarshal([]byte(`{"amount": "1", "currency": "ABC"}`), &m))
+	assert.Error(t, json.Unmarshal([]byte(`true`), &m))
+}
+
+func TestRatesConvert(t *testing.T) {
+	rates, err := ParseRates("USD", "EUR=1.08, JPY=0.0067,KWD=3.25")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"EUR", "JPY", "KWD", "USD"}, rates.Currencies())
+
+	converted, err := rates.Convert(MustParse("100", "EUR"), "USD")
+	require.NoError(t, err)
+	assert.Equal(t, MustParse("108", "USD"), converted)
+
+	// 10.80 USD is 1611.94 JPY, rounded to whole yen
+	converted, err = rates.Convert(MustParse("10.80", "USD"), "JPY")
+	require.NoError(t, err)
+	assert.Equal(t, MustParse("1612", "JPY"), converted)
+
+	converted, err = rates.Convert(MustParse("1", "KWD"), "EUR")
+	require.NoError(t, err)
+	assert.Equal(t, MustParse("3.01", "EUR"), converted)
+
+	factor, err := rates.MinorUnitFactor("EUR")
+	require.NoError(t, err)
+	assert.Equal(t, "0.0108", DecimalString(factor))
+
+	_, err = rates.Convert(MustParse("1", "GBP"), "USD")
+	assert.Error(t, err)
+
+	for _, spec := range []string{"EUR", "EUR=0", "EUR=-1", "EUR=1/3", "ABC=1", "USD=2"} {
+		_, err := ParseRates("USD", spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestRoundHalfEven(t *testing.T) {
+	rates, err := ParseRates("USD", "EUR=0.5")
+	require.NoError(t, err)
+	// 0.01 EUR is 0.005 USD, a tie rounded to the even 0.00, and 0.03 EUR
+	// is 0.015 USD, rounded to 0.02
+	converted, _ := rates.Convert(MustParse("0.01", "EUR"), "USD")
+	assert.Equal(t, int64(0), converted.Amount)
+	converted, _ = rates.Convert(MustParse("0.03", "EUR"), "USD")
+	assert.Equal(t, int64(2), converted.Amount)
+}
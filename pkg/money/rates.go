@@ -0,0 +1,128 @@
+package money
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// Rates is a local exchange-rate table. Every rate is the value of one unit
+// of a currency in the base currency, so conversions are exact until the
+// result is rounded to minor units.
+type Rates struct {
+	base  string
+	rates map[string]*big.Rat
+}
+
+// NewRates creates a table holding only the base currency
+func NewRates(base string) (*Rates, error) {
+	if _, ok := exponents[base]; !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCurrency, base)
+	}
+	return &Rates{base: base, rates: map[string]*big.Rat{base: big.NewRat(1, 1)}}, nil
+}
+
+// ParseRates reads a table such as "EUR=1.08,GBP=1.27,JPY=0.0067", where
+// each rate is the value of one unit of the currency in base
+func ParseRates(base, spec string) (*Rates, error) {
+	rates, err := NewRates(base)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		code, value, ok := strings.Cut(entry, "=")
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if !ok {
+			return nil, fmt.Errorf("exchange rate %q is not CODE=rate", entry)
+		}
+		if _, known := exponents[code]; !known {
+			return nil, fmt.Errorf("%w %q", ErrUnknownCurrency, code)
+		}
+		// Only decimal rates, fractions would make the SQL factors inexact
+		value = strings.TrimSpace(value)
+		if strings.ContainsAny(value, "/eE") {
+			return nil, fmt.Errorf("exchange rate of %s must be a decimal number", code)
+		}
+		rate, ok := new(big.Rat).SetString(value)
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("exchange rate of %s must be a positive number", code)
+		}
+		if code == base && rate.Cmp(big.NewRat(1, 1)) != 0 {
+			return nil, fmt.Errorf("exchange rate of the base currency %s must be 1", base)
+		}
+		rates.rates[code] = rate
+	}
+	return rates, nil
+}
+
+// Base returns the currency every rate is expressed in
+func (r *Rates) Base() string {
+	return r.base
+}
+
+// Supports reports whether the table has a rate for the currency
+func (r *Rates) Supports(code string) bool {
+	_, ok := r.rates[code]
+	return ok
+}
+
+// Currencies returns the currencies of the table in alphabetical order
+func (r *Rates) Currencies() []string {
+	codes := make([]string, 0, len(r.rates))
+	for code := range r.rates {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// BaseValue returns the exact value of m in major units of the base currency
+func (r *Rates) BaseValue(m Money) (*big.Rat, error) {
+	rate, ok := r.rates[m.Currency]
+	if !ok {
+		return nil, fmt.Errorf("no exchange rate for %s", m.Currency)
+	}
+	return new(big.Rat).Mul(m.Rat(), rate), nil
+}
+
+// MinorUnitFactor returns the value of one minor unit of the currency in
+// the base currency. Since rates are decimals, so is the factor.
+func (r *Rates) MinorUnitFactor(code string) (*big.Rat, error) {
+	return r.BaseValue(Money{Amount: 1, Currency: code})
+}
+
+// Convert converts m to another currency, rounding half to even to its minor
+// units
+func (r *Rates) Convert(m Money, to string) (Money, error) {
+	if m.Currency == to {
+		return m, nil
+	}
+	value, err := r.BaseValue(m)
+	if err != nil {
+		return Money{}, err
+	}
+	rate, ok := r.rates[to]
+	if !ok {
+		return Money{}, fmt.Errorf("no exchange rate for %s", to)
+	}
+
+	minor := value.Quo(value, rate)
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponents[to])), nil)
+	minor.Mul(minor, new(big.Rat).SetInt(scale))
+	amount, ok := roundHalfEven(minor)
+	if !ok {
+		return Money{}, fmt.Errorf("%s is out of range in %s", m, to)
+	}
+	return Money{Amount: amount, Currency: to}, nil
+}
+
+// DecimalString writes an exact decimal fraction such as a base value or a
+// minor unit factor as a decimal literal
+func DecimalString(r *big.Rat) string {
+	return r.FloatString(decimalsOf(r))
+}
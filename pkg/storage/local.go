@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStore keeps blobs on the local disk and serves them over HTTP, for
+// running the pipeline without a cloud bucket
+type LocalStore struct {
+	dir       string
+	publicURL string
+}
+
+// NewLocalStore creates the directory if needed. publicURL is the address
+// the directory is served from, see Handler.
+func NewLocalStore(dir, publicURL string) (*LocalStore, error) {
+	if publicURL == "" {
+		return nil, fmt.Errorf("BLOB_PUBLIC_URL is required for the local blob store")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating local storage directory: %w", err)
+	}
+	return &LocalStore{dir: dir, publicURL: publicURL}, nil
+}
+
+// path maps a key to a file inside the store directory, rejecting keys that
+// would escape it
+func (s *LocalStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + filepath.FromSlash(key))
+	if clean == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, clean), nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, body io.Reader, contentType string) (string, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+
+	// Write to a temporary file first so readers never see a partial blob
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+
+	return s.URL(key), nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) URL(key string) string {
+	return joinURL(s.publicURL, key)
+}
+
+func (s *LocalStore) Exists(ctx context.Context, key string) (bool, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	return filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip directories and the temporary files of uploads in progress
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+	})
+}
+
+// Handler serves the stored blobs. Mount it so that its root matches the
+// path of the public URL.
+func (s *LocalStore) Handler() http.Handler {
+	prefix := "/"
+	if u, err := url.Parse(s.publicURL); err == nil && u.Path != "" {
+		prefix = strings.TrimRight(u.Path, "/") + "/"
+	}
+	return http.StripPrefix(strings.TrimRight(prefix, "/"), http.FileServer(http.Dir(s.dir)))
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps blobs in memory, for tests
+type MemoryStore struct {
+	mu        sync.RWMutex
+	objects   map[string]memoryObject
+	publicURL string
+}
+
+type memoryObject struct {
+	data         []byte
+	contentType  string
+	lastModified time.Time
+}
+
+// NewMemoryStore creates an empty store. publicURL defaults to memory://blobs.
+func NewMemoryStore(publicURL string) *MemoryStore {
+	if publicURL == "" {
+		publicURL = "memory://blobs"
+	}
+	return &MemoryStore{objects: make(map[string]memoryObject), publicURL: publicURL}
+}
+
+func (s *MemoryStore) Put(ctx context.Context, key string, body io.Reader, contentType string) (string, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.objects[key] = memoryObject{data: data, contentType: contentType, lastModified: time.Now()}
+	s.mu.Unlock()
+
+	return s.URL(key), nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	object, ok := s.objects[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(object.data)), nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.objects, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) URL(key string) string {
+	return joinURL(s.publicURL, key)
+}
+
+func (s *MemoryStore) Exists(ctx context.Context, key string) (bool, error) {
+	s.mu.RLock()
+	_, ok := s.objects[key]
+	s.mu.RUnlock()
+	return ok, nil
+}
+
+// ContentType returns the content type a key was stored with
+func (s *MemoryStore) ContentType(key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.objects[key].contentType
+}
+
+func (s *MemoryStore) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	s.mu.RLock()
+	objects := make([]ObjectInfo, 0, len(s.objects))
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: int64(len(object.data)), LastModified: object.lastModified})
+		}
+	}
+	s.mu.RUnlock()
+
+	// Match the key order of S3 listings
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	for _, object := range objects {
+		if err := fn(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// S3Store stores blobs in AWS S3 or an S3-compatible service such as MinIO
+type S3Store struct {
+	client    *s3.Client
+	uploader  *manager.Uploader
+	presigner *s3.PresignClient
+	bucket    string
+	publicURL string
+}
+
+// NewS3Store creates an S3 store using the default AWS credential chain
+func NewS3Store(ctx context.Context, cfg Config) (*S3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is required for the %s blob store", cfg.Backend)
+	}
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		log.Printf("Error loading AWS configuration: %v", err)
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.UsePathStyle
+	})
+
+	publicURL := cfg.PublicURL
+	switch {
+	case publicURL != "":
+	case cfg.Endpoint != "" && cfg.UsePathStyle:
+		publicURL = joinURL(cfg.Endpoint, cfg.Bucket)
+	case cfg.Endpoint != "":
+		endpoint, err := url.Parse(cfg.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3_ENDPOINT: %w", err)
+		}
+		publicURL = fmt.Sprintf("%s://%s.%s", endpoint.Scheme, cfg.Bucket, endpoint.Host)
+	default:
+		publicURL = fmt.Sprintf("https://%s.s3.amazonaws.com", cfg.Bucket)
+	}
+
+	return &S3Store{
+		client:    client,
+		uploader:  manager.NewUploader(client),
+		presigner: s3.NewPresignClient(client),
+		bucket:    cfg.Bucket,
+		publicURL: publicURL,
+	}, nil
+}
+
+// Put uploads body to the bucket. Bodies are streamed in parts, so bodies
+// that cannot seek are never held in memory whole.
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, contentType string) (string, error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		log.Printf("Error uploading to S3: %v", err)
+		return "", err
+	}
+
+	url := s.URL(key)
+	log.Printf("File uploaded to S3: %s", url)
+	return url, nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *S3Store) URL(key string) string {
+	return joinURL(s.publicURL, key)
+}
+
+func (s *S3Store) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			info := ObjectInfo{Key: aws.ToString(object.Key), Size: aws.ToInt64(object.Size)}
+			if object.LastModified != nil {
+				info.LastModified = *object.LastModified
+			}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PresignPut signs a PUT request. The content type and length are part of
+// the signature, so the client cannot upload anything else.
+func (s *S3Store) PresignPut(ctx context.Context, key, contentType string, contentLength int64, expires time.Duration) (string, error) {
+	req, err := s.presigner.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(contentLength),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// isS3NotFound recognises missing keys. HEAD responses carry no body, so
+// they only surface as a generic NotFound code.
+func isS3NotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return true
+	}
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound"
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mohammadshaad/zocket/config"
+)
+
+// ErrNotFound is returned when a key does not exist in the store
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore stores processed images and exposes them under public URLs
+type BlobStore interface {
+	// Put stores the content of body under key and returns its public URL
+	Put(ctx context.Context, key string, body io.Reader, contentType string) (string, error)
+	// Get opens the object stored under key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key, deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// URL returns the public URL of key without checking that it exists
+	URL(key string) string
+	// Exists reports whether an object is stored under key
+	Exists(ctx context.Context, key string) (bool, error)
+	// List calls fn for every object whose key starts with prefix, stopping
+	// at the first error fn returns
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Presigner is implemented by stores that let clients upload directly
+type Presigner interface {
+	// PresignPut returns a URL accepting a single PUT of exactly
+	// contentLength bytes with the given content type
+	PresignPut(ctx context.Context, key, contentType string, contentLength int64, expires time.Duration) (string, error)
+}
+
+// Supported blob store backends
+const (
+	BackendS3     = "s3"
+	BackendMinIO  = "minio"
+	BackendLocal  = "local"
+	BackendMemory = "memory"
+)
+
+// Config selects and configures a blob store backend
+type Config struct {
+	Backend string
+
+	// S3 and S3-compatible backends
+	Bucket       string
+	Region       string
+	Endpoint     string
+	UsePathStyle bool
+
+	// PublicURL is the base URL objects are served from. It defaults to the
+	// bucket URL for S3 and is required for the local backend.
+	PublicURL string
+
+	// LocalDir is the directory of the local backend
+	LocalDir string
+}
+
+// ConfigFromEnv reads the blob store configuration from the environment
+func ConfigFromEnv() Config {
+	return Config{
+		Backend:      config.GetEnv("BLOB_STORE", BackendS3),
+		Bucket:       config.GetEnv("S3_BUCKET", ""),
+		Region:       config.GetEnv("AWS_REGION", ""),
+		Endpoint:     config.GetEnv("S3_ENDPOINT", ""),
+		UsePathStyle: config.GetEnv("S3_USE_PATH_STYLE", "false") == "true",
+		PublicURL:    config.GetEnv("BLOB_PUBLIC_URL", ""),
+		LocalDir:     config.GetEnv("LOCAL_STORAGE_DIR", "./data/blobs"),
+	}
+}
+
+// New creates the blob store selected by cfg.Backend
+func New(ctx context.Context, cfg Config) (BlobStore, error) {
+	switch cfg.Backend {
+	case BackendS3:
+		return NewS3Store(ctx, cfg)
+	case BackendMinIO:
+		// MinIO needs an explicit endpoint and path-style addressing
+		if cfg.Endpoint == "" {
+			return nil, fmt.Errorf("S3_ENDPOINT is required for the minio blob store")
+		}
+		cfg.UsePathStyle = true
+		return NewS3Store(ctx, cfg)
+	case BackendLocal:
+		return NewLocalStore(cfg.LocalDir, cfg.PublicURL)
+	case BackendMemory:
+		return NewMemoryStore(cfg.PublicURL), nil
+	default:
+		return nil, fmt.Errorf("unknown blob store backend %q", cfg.Backend)
+	}
+}
+
+// joinURL appends the key to a base URL, escaping every path segment
+func joinURL(base, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.TrimRight(base, "/") + "/" + strings.Join(segments, "/")
+}
+
+// KeyFromURL returns the key of a URL served by the store, if it is one
+func KeyFromURL(store BlobStore, rawURL string) (string, bool) {
+	prefix := store.URL("")
+	if !strings.HasPrefix(rawURL, prefix) || len(rawURL) == len(prefix) {
+		return "", false
+	}
+
+	segments := strings.Split(strings.TrimPrefix(rawURL, prefix), "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", false
+		}
+		segments[i] = unescaped
+	}
+	return strings.Join(segments, "/"), true
+}
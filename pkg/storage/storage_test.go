@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBlobStore runs the behaviour every backend must share
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	key := "compressed/1_image one.jpg"
+
+	exists, err := store.Exists(ctx, key)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	_, err = store.Get(ctx, key)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	url, err := store.Put(ctx, key, strings.NewReader("jpeg bytes"), "image/jpeg")
+	require.NoError(t, err)
+	assert.Equal(t, store.URL(key), url)
+	assert.True(t, strings.HasSuffix(url, "/compressed/1_image%20one.jpg"), url)
+
+	exists, err = store.Exists(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	body, err := store.Get(ctx, key)
+	require.NoError(t, err)
+	data, _ := io.ReadAll(body)
+	body.Close()
+	assert.Equal(t, "jpeg bytes", string(data))
+
+	_, err = store.Put(ctx, "renditions/large/abc.webp", strings.NewReader("webp"), "image/webp")
+	require.NoError(t, err)
+	var listed []ObjectInfo
+	require.NoError(t, store.List(ctx, "compressed/", func(object ObjectInfo) error {
+		listed = append(listed, object)
+		return nil
+	}))
+	require.Len(t, listed, 1)
+	assert.Equal(t, key, listed[0].Key)
+	assert.Equal(t, int64(len("jpeg bytes")), listed[0].Size)
+	assert.WithinDuration(t, time.Now(), listed[0].LastModified, time.Minute)
+
+	require.NoError(t, store.Delete(ctx, key))
+	require.NoError(t, store.Delete(ctx, key))
+
+	exists, err = store.Exists(ctx, key)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testBlobStore(t, NewMemoryStore(""))
+}
+
+func TestLocalStore(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), "http://localhost:8081/blobs")
+	require.NoError(t, err)
+	testBlobStore(t, store)
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalStore(dir+"/blobs", "http://localhost:8081")
+	require.NoError(t, err)
+
+	_, err = store.Put(context.Background(), "../outside.jpg", strings.NewReader("x"), "image/jpeg")
+	require.NoError(t, err)
+
+	// The key is confined to the store directory
+	exists, err := store.Exists(context.Background(), "outside.jpg")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestLocalStoreHandler(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), "http://localhost:8081/blobs")
+	require.NoError(t, err)
+
+	_, err = store.Put(context.Background(), "compressed/a.jpg", strings.NewReader("jpeg bytes"), "image/jpeg")
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	store.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/blobs/compressed/a.jpg", nil))
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "jpeg bytes", w.Body.String())
+}
+
+func TestNewRejectsUnknownBackend(t *testing.T) {
+	_, err := New(context.Background(), Config{Backend: "ftp"})
+	assert.Error(t, err)
+
+	_, err = New(context.Background(), Config{Backend: BackendMinIO, Bucket: "images"})
+	assert.Error(t, err)
+}
+
+func TestS3StoreURL(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := New(ctx, Config{Backend: BackendS3, Bucket: "images", Region: "eu-north-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://images.s3.amazonaws.com/compressed/a.jpg", store.URL("compressed/a.jpg"))
+
+	store, err = New(ctx, Config{Backend: BackendMinIO, Bucket: "images", Region: "us-east-1", Endpoint: "http://localhost:9000"})
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:9000/images/compressed/a.jpg", store.URL("compressed/a.jpg"))
+
+	store, err = New(ctx, Config{Backend: BackendS3, Bucket: "images", Region: "us-east-1", PublicURL: "https://cdn.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://cdn.example.com/compressed/a.jpg", store.URL("compressed/a.jpg"))
+}
+
+func TestKeyFromURL(t *testing.T) {
+	store := NewMemoryStore("https://cdn.example.com/images")
+
+	key, ok := KeyFromURL(store, store.URL("uploads/1/a b.jpg"))
+	assert.True(t, ok)
+	assert.Equal(t, "uploads/1/a b.jpg", key)
+
+	for _, url := range []string{"https://example.com/a.jpg", "https://cdn.example.com/images/", "https://cdn.example.com/imagesx/a.jpg"} {
+		_, ok := KeyFromURL(store, url)
+		assert.False(t, ok, url)
+	}
+}
+
+func TestS3StorePresignPut(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	store, err := New(context.Background(), Config{Backend: BackendMinIO, Bucket: "images", Region: "us-east-1", Endpoint: "http://localhost:9000"})
+	require.NoError(t, err)
+
+	presigner, ok := store.(Presigner)
+	require.True(t, ok)
+	url, err := presigner.PresignPut(context.Background(), "uploads/1/a.jpg", "image/jpeg", 1234, 15*time.Minute)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(url, "http://localhost:9000/images/uploads/1/a.jpg?"), url)
+	assert.Contains(t, url, "X-Amz-Expires=900")
+	assert.Contains(t, url, "content-length")
+}
@@ -0,0 +1,92 @@
+//go:build avif && cgo
+
+package util
+
+/*
+#cgo pkg-config: libavif
+#include <avif/avif.h>
+
+static avifResult encodeAVIF(uint8_t *pixels, uint32_t width, uint32_t height, uint32_t stride, int quality, const uint8_t *icc, size_t iccSize, avifRWData *out) {
+	avifImage *image = avifImageCreate(width, height, 8, AVIF_PIXEL_FORMAT_YUV420);
+	if (image == NULL) {
+		return AVIF_RESULT_OUT_OF_MEMORY;
+	}
+
+	if (iccSize > 0) {
+		avifResult result = avifImageSetProfileICC(image, icc, iccSize);
+		if (result != AVIF_RESULT_OK) {
+			avifImageDestroy(image);
+			return result;
+		}
+	}
+
+	avifRGBImage rgb;
+	avifRGBImageSetDefaults(&rgb, image);
+	rgb.format = AVIF_RGB_FORMAT_RGBA;
+	rgb.pixels = pixels;
+	rgb.rowBytes = stride;
+
+	avifResult result = avifImageRGBToYUV(image, &rgb);
+	if (result != AVIF_RESULT_OK) {
+		avifImageDestroy(image);
+		return result;
+	}
+
+	avifEncoder *encoder = avifEncoderCreate();
+	if (encoder == NULL) {
+		avifImageDestroy(image);
+		return AVIF_RESULT_OUT_OF_MEMORY;
+	}
+	encoder->quality = quality;
+	encoder->qualityAlpha = quality;
+	encoder->speed = 6;
+
+	result = avifEncoderWrite(encoder, image, out);
+	avifEncoderDestroy(encoder);
+	avifImageDestroy(image);
+	return result;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"unsafe"
+
+	"golang.org/x/image/draw"
+)
+
+// AVIF encoding uses libavif, so it is only compiled into builds with the
+// avif tag: go build -tags avif
+func init() {
+	RegisterEncoder(FormatAVIF, Encoder{Type: "avif", ContentType: "image/avif", Encode: encodeAVIF})
+}
+
+func encodeAVIF(w io.Writer, img image.Image, opts EncodeOptions) error {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return fmt.Errorf("avif: empty image")
+	}
+
+	// libavif expects tightly packed, non-premultiplied RGBA
+	rgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+
+	var icc *C.uint8_t
+	if len(opts.ICCProfile) > 0 {
+		icc = (*C.uint8_t)(unsafe.Pointer(&opts.ICCProfile[0]))
+	}
+
+	var out C.avifRWData
+	result := C.encodeAVIF((*C.uint8_t)(unsafe.Pointer(&rgba.Pix[0])), C.uint32_t(bounds.Dx()), C.uint32_t(bounds.Dy()), C.uint32_t(rgba.Stride), C.int(opts.Quality),
+		icc, C.size_t(len(opts.ICCProfile)), &out)
+	if result != C.AVIF_RESULT_OK {
+		return fmt.Errorf("avif: %s", C.GoString(C.avifResultToString(result)))
+	}
+	defer C.avifRWDataFree(&out)
+
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(out.data), C.int(out.size)))
+	return err
+}
@@ -0,0 +1,170 @@
+package util
+
+import (
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+)
+
+// hasAlpha reports whether any pixel of the image is not fully opaque. Only
+// palette images and images with an alpha channel are scanned.
+func hasAlpha(img image.Image) bool {
+	bounds := img.Bounds()
+	switch m := img.(type) {
+	case *image.YCbCr, *image.Gray, *image.Gray16, *image.CMYK:
+		return false
+	case *image.NRGBA:
+		return scanAlpha(m.Pix, m.Stride, bounds.Dx()*4, 4, 3)
+	case *image.RGBA:
+		return scanAlpha(m.Pix, m.Stride, bounds.Dx()*4, 4, 3)
+	case *image.NRGBA64:
+		return scanAlpha16(m.Pix, m.Stride, bounds.Dx()*8, 8, 6)
+	case *image.RGBA64:
+		return scanAlpha16(m.Pix, m.Stride, bounds.Dx()*8, 8, 6)
+	case *image.Paletted:
+		used := usedPaletteIndices(m)
+		for i, c := range m.Palette {
+			if _, _, _, a := c.RGBA(); used[i] && a != 0xffff {
+				return true
+			}
+		}
+		return false
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scanAlpha checks the 8-bit alpha samples at offset in every pixel
+func scanAlpha(pix []byte, stride, rowLen, pixelLen, offset int) bool {
+	for row := 0; row+rowLen <= len(pix); row += stride {
+		for i := row + offset; i < row+rowLen; i += pixelLen {
+			if pix[i] != 0xff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scanAlpha16 checks the big-endian 16-bit alpha samples at offset in every
+// pixel
+func scanAlpha16(pix []byte, stride, rowLen, pixelLen, offset int) bool {
+	for row := 0; row+rowLen <= len(pix); row += stride {
+		for i := row + offset; i < row+rowLen; i += pixelLen {
+			if pix[i] != 0xff || pix[i+1] != 0xff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isGray reports whether the image only carries a luma channel
+func isGray(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// outputFormat picks the format an image is compressed to: palette images
+// and images with transparency stay PNG, everything else becomes JPEG
+func outputFormat(img image.Image) string {
+	if _, ok := img.(*image.Paletted); ok || hasAlpha(img) {
+		return FormatPNG
+	}
+	return FormatJPEG
+}
+
+// toEncodable converts images the encoders handle poorly: 16-bit images are
+// reduced to 8 bits, grayscale is kept as image.Gray and CMYK is converted
+// to sRGB
+func toEncodable(img image.Image) image.Image {
+	bounds := img.Bounds()
+	var dst draw.Image
+	switch img.(type) {
+	case *image.Gray16:
+		dst = image.NewGray(bounds)
+	case *image.CMYK:
+		dst = image.NewRGBA(bounds)
+	case *image.RGBA64, *image.NRGBA64:
+		dst = image.NewNRGBA(bounds)
+	default:
+		return img
+	}
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	return dst
+}
+
+func usedPaletteIndices(m *image.Paletted) []bool {
+	used := make([]bool, len(m.Palette))
+	bounds := m.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+bounds.Dx()]
+		for _, index := range row {
+			if int(index) < len(used) {
+				used[index] = true
+			}
+		}
+	}
+	return used
+}
+
+// optimizePalette drops unused and duplicate palette entries so the PNG
+// encoder can pick the smallest bit depth
+func optimizePalette(m *image.Paletted) *image.Paletted {
+	used := usedPaletteIndices(m)
+
+	var palette color.Palette
+	remap := make([]uint8, len(m.Palette))
+	seen := make(map[color.NRGBA]uint8)
+	for i, c := range m.Palette {
+		if !used[i] {
+			continue
+		}
+		key := color.NRGBAModel.Convert(c).(color.NRGBA)
+		index, ok := seen[key]
+		if !ok {
+			index = uint8(len(palette))
+			seen[key] = index
+			palette = append(palette, c)
+		}
+		remap[i] = index
+	}
+
+	if len(palette) == 0 {
+		return m
+	}
+
+	bounds := m.Bounds()
+	out := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), palette)
+	for y := 0; y < bounds.Dy(); y++ {
+		row := m.Pix[y*m.Stride : y*m.Stride+bounds.Dx()]
+		for x, index := range row {
+			if int(index) < len(remap) {
+				out.Pix[y*out.Stride+x] = remap[index]
+			}
+		}
+	}
+	return out
+}
+
+// toNRGBA returns the image as NRGBA, converting it when needed
+func toNRGBA(img image.Image) *image.NRGBA {
+	if m, ok := img.(*image.NRGBA); ok {
+		return m
+	}
+	bounds := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	return dst
+}
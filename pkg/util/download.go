@@ -0,0 +1,242 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/mohammadshaad/zocket/config"
+)
+
+// ErrImageRejected marks downloads that will never succeed, such as blocked
+// addresses, oversized bodies or files that are not images. They should not
+// be retried.
+var ErrImageRejected = errors.New("image rejected")
+
+// DownloadConfig limits what the image downloader fetches
+type DownloadConfig struct {
+	// ConnectTimeout bounds establishing the connection, Timeout the whole
+	// request including reading the body
+	ConnectTimeout time.Duration
+	Timeout        time.Duration
+	MaxBytes       int64
+	MaxPixels      int64
+	MaxRedirects   int
+	// AllowPrivateNetworks disables the address checks, for development
+	// setups serving images from localhost or a private network
+	AllowPrivateNetworks bool
+}
+
+// DefaultDownloadConfig returns the limits used when nothing is configured
+func DefaultDownloadConfig() DownloadConfig {
+	return DownloadConfig{
+		ConnectTimeout: 5 * time.Second,
+		Timeout:        30 * time.Second,
+		MaxBytes:       20 << 20,
+		MaxPixels:      50_000_000,
+		MaxRedirects:   3,
+	}
+}
+
+// DownloadConfigFromEnv reads the downloader limits from the environment
+func DownloadConfigFromEnv() DownloadConfig {
+	defaults := DefaultDownloadConfig()
+	return DownloadConfig{
+		ConnectTimeout:       config.GetEnvDuration("IMAGE_DOWNLOAD_CONNECT_TIMEOUT", defaults.ConnectTimeout),
+		Timeout:              config.GetEnvDuration("IMAGE_DOWNLOAD_TIMEOUT", defaults.Timeout),
+		MaxBytes:             int64(config.GetEnvInt("IMAGE_MAX_BYTES", int(defaults.MaxBytes))),
+		MaxPixels:            int64(config.GetEnvInt("IMAGE_MAX_PIXELS", int(defaults.MaxPixels))),
+		MaxRedirects:         config.GetEnvInt("IMAGE_MAX_REDIRECTS", defaults.MaxRedirects),
+		AllowPrivateNetworks: config.GetEnv("IMAGE_ALLOW_PRIVATE_NETWORKS", "false") == "true",
+	}
+}
+
+// Downloader fetches product images from untrusted URLs
+type Downloader struct {
+	client *http.Client
+	config DownloadConfig
+}
+
+// NewDownloader creates a downloader with its own HTTP client. Addresses
+// are checked when connecting, so DNS answers cannot point it at internal
+// services either.
+func NewDownloader(cfg DownloadConfig) *Downloader {
+	dialer := &net.Dialer{Timeout: cfg.ConnectTimeout}
+	if !cfg.AllowPrivateNetworks {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if isBlockedAddr(addr) {
+				return fmt.Errorf("%w: address %s is not public", ErrImageRejected, addr)
+			}
+			return nil
+		}
+	}
+
+	transport := &http.Transport{
+		// A proxy would connect on our behalf and bypass the address check
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.Timeout,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.MaxRedirects {
+				return fmt.Errorf("%w: more than %d redirects", ErrImageRejected, cfg.MaxRedirects)
+			}
+			return checkScheme(req.URL)
+		},
+	}
+
+	return &Downloader{client: client, config: cfg}
+}
+
+var defaultDownloader = NewDownloader(DefaultDownloadConfig())
+
+// Download fetches and decodes an image, see DecodeImage
+func (d *Downloader) Download(ctx context.Context, rawURL string, policy ColorProfilePolicy) (*DecodedImage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid URL: %v", ErrImageRejected, err)
+	}
+	if err := checkScheme(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrImageRejected, err)
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected HTTP status %s", resp.Status)
+		// Client errors will not go away on retry, except for throttling
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			err = fmt.Errorf("%w: %v", ErrImageRejected, err)
+		}
+		return nil, err
+	}
+	if resp.ContentLength > d.config.MaxBytes {
+		return nil, fmt.Errorf("%w: image is %d bytes, the limit is %d", ErrImageRejected, resp.ContentLength, d.config.MaxBytes)
+	}
+
+	return d.Decode(resp.Body, policy)
+}
+
+// Decode reads an image from r with the same limits as a download, for
+// images that are already in our own storage
+func (d *Downloader) Decode(r io.Reader, policy ColorProfilePolicy) (*DecodedImage, error) {
+	data, err := io.ReadAll(io.LimitReader(r, d.config.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > d.config.MaxBytes {
+		return nil, fmt.Errorf("%w: image is larger than %d bytes", ErrImageRejected, d.config.MaxBytes)
+	}
+
+	if err := CheckImage(data, d.config.MaxPixels); err != nil {
+		return nil, err
+	}
+	img, err := DecodeImage(data, policy)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrImageRejected, err)
+	}
+	return img, nil
+}
+
+// supportedImageTypes maps the sniffed content types that can be decoded to
+// their file extension
+var supportedImageTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// ImageExtension returns the file extension of a supported image content
+// type
+func ImageExtension(contentType string) (string, bool) {
+	ext, ok := supportedImageTypes[contentType]
+	return ext, ok
+}
+
+// CheckImage sniffs the content type of data and reads the image dimensions
+// without decoding the pixels, rejecting files that are not supported images
+// and images with more than maxPixels pixels
+func CheckImage(data []byte, maxPixels int64) error {
+	contentType := http.DetectContentType(data)
+	if _, ok := supportedImageTypes[contentType]; !ok {
+		return fmt.Errorf("%w: unsupported content type %s", ErrImageRejected, contentType)
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrImageRejected, err)
+	}
+	if pixels := int64(cfg.Width) * int64(cfg.Height); pixels > maxPixels {
+		return fmt.Errorf("%w: image is %dx%d, the limit is %d pixels", ErrImageRejected, cfg.Width, cfg.Height, maxPixels)
+	}
+	return nil
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: unsupported URL scheme %q", ErrImageRejected, u.Scheme)
+	}
+	return nil
+}
+
+// blockedPrefixes are special purpose ranges not covered by the netip
+// predicates
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// isBlockedAddr reports whether addr is a loopback, private, link-local or
+// otherwise non-public address
+func isBlockedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pngBytes(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))))
+	return buf.Bytes()
+}
+
+func TestDownloaderLimits(t *testing.T) {
+	small := pngBytes(t, 4, 4)
+	large := pngBytes(t, 100, 100)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/small.png", func(w http.ResponseWriter, r *http.Request) { w.Write(small) })
+	mux.HandleFunc("/large.png", func(w http.ResponseWriter, r *http.Request) { w.Write(large) })
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("<html><body>not an image</body></html>"))
+	})
+	mux.HandleFunc("/missing.png", http.NotFound)
+	mux.HandleFunc("/unavailable.png", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/small.png", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/metadata", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	mux.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Write(small)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cfg := DefaultDownloadConfig()
+	cfg.AllowPrivateNetworks = true
+	cfg.MaxBytes = int64(len(large)) - 1
+	cfg.MaxPixels = 1000
+	cfg.Timeout = 200 * time.Millisecond
+	downloader := NewDownloader(cfg)
+
+	img, err := downloader.Download(context.Background(), server.URL+"/small.png", ColorProfileStrip)
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 4, 4), img.Image.Bounds())
+
+	_, err = downloader.Download(context.Background(), server.URL+"/redirect/", ColorProfileStrip)
+	assert.NoError(t, err)
+
+	for _, path := range []string{"/large.png", "/page.html", "/missing.png", "/loop", "/metadata"} {
+		_, err := downloader.Download(context.Background(), server.URL+path, ColorProfileStrip)
+		assert.ErrorIs(t, err, ErrImageRejected, path)
+	}
+
+	// Server errors and timeouts are worth retrying
+	for _, path := range []string{"/unavailable.png", "/slow.png"} {
+		_, err := downloader.Download(context.Background(), server.URL+path, ColorProfileStrip)
+		require.Error(t, err, path)
+		assert.NotErrorIs(t, err, ErrImageRejected, path)
+	}
+
+	// Decompression bombs are rejected before decoding
+	cfg.MaxBytes = 1 << 20
+	_, err = NewDownloader(cfg).Download(context.Background(), server.URL+"/large.png", ColorProfileStrip)
+	assert.ErrorIs(t, err, ErrImageRejected)
+	assert.ErrorContains(t, err, "100x100")
+
+	_, err = downloader.Download(context.Background(), "ftp://example.com/image.png", ColorProfileStrip)
+	assert.ErrorIs(t, err, ErrImageRejected)
+}
+
+func TestDownloaderBlocksPrivateNetworks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached a loopback server")
+	}))
+	defer server.Close()
+
+	_, err := NewDownloader(DefaultDownloadConfig()).Download(context.Background(), server.URL+"/image.png", ColorProfileStrip)
+	assert.ErrorIs(t, err, ErrImageRejected)
+}
+
+func TestIsBlockedAddr(t *testing.T) {
+	for _, addr := range []string{
+		"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1",
+		"0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1", "::ffff:169.254.169.254", "224.0.0.1",
+	} {
+		assert.True(t, isBlockedAddr(netip.MustParseAddr(addr)), addr)
+	}
+	for _, addr := range []string{"93.184.216.34", "8.8.8.8", "2606:4700::6810:85e5"} {
+		assert.False(t, isBlockedAddr(netip.MustParseAddr(addr)), addr)
+	}
+}
@@ -0,0 +1,225 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// xyzD50ToSRGB converts D50 adapted XYZ, the ICC connection space, to
+// linear sRGB (Bradford adaptation to D65)
+var xyzD50ToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// matrixProfile is an RGB ICC profile described by colorant primaries and
+// tone curves, the kind cameras and phones embed (Display P3, Adobe RGB...)
+type matrixProfile struct {
+	toXYZ  [3][3]float64
+	curves [3][256]float64
+}
+
+// convertToSRGB converts the pixels of an image from the colour space of the
+// ICC profile to sRGB. Only RGB matrix/TRC profiles are supported.
+func convertToSRGB(img image.Image, profile []byte) (image.Image, error) {
+	p, err := parseMatrixProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Combine the profile matrix with the XYZ to sRGB matrix
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += xyzD50ToSRGB[i][k] * p.toXYZ[k][j]
+			}
+		}
+	}
+
+	convert := func(r, g, b uint8) (uint8, uint8, uint8) {
+		lr, lg, lb := p.curves[0][r], p.curves[1][g], p.curves[2][b]
+		return encodeSRGB(m[0][0]*lr + m[0][1]*lg + m[0][2]*lb),
+			encodeSRGB(m[1][0]*lr + m[1][1]*lg + m[1][2]*lb),
+			encodeSRGB(m[2][0]*lr + m[2][1]*lg + m[2][2]*lb)
+	}
+
+	// Palette images only need their palette converted
+	if paletted, ok := img.(*image.Paletted); ok {
+		palette := make(color.Palette, len(paletted.Palette))
+		for i, c := range paletted.Palette {
+			n := color.NRGBAModel.Convert(c).(color.NRGBA)
+			n.R, n.G, n.B = convert(n.R, n.G, n.B)
+			palette[i] = n
+		}
+		out := *paletted
+		out.Palette = palette
+		return &out, nil
+	}
+	if isGray(img) {
+		return nil, fmt.Errorf("cannot apply an RGB colour profile to a grayscale image")
+	}
+
+	src := toNRGBA(img)
+	bounds := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		srcRow := src.Pix[y*src.Stride : y*src.Stride+bounds.Dx()*4]
+		dstRow := dst.Pix[y*dst.Stride : y*dst.Stride+bounds.Dx()*4]
+		for i := 0; i < len(srcRow); i += 4 {
+			dstRow[i], dstRow[i+1], dstRow[i+2] = convert(srcRow[i], srcRow[i+1], srcRow[i+2])
+			dstRow[i+3] = srcRow[i+3]
+		}
+	}
+	return dst, nil
+}
+
+// encodeSRGB applies the sRGB transfer function to a linear value
+func encodeSRGB(v float64) uint8 {
+	v = min(max(v, 0), 1)
+	if v <= 0.0031308 {
+		v *= 12.92
+	} else {
+		v = 1.055*math.Pow(v, 1/2.4) - 0.055
+	}
+	return uint8(v*255 + 0.5)
+}
+
+func parseMatrixProfile(profile []byte) (*matrixProfile, error) {
+	if len(profile) < 132 {
+		return nil, fmt.Errorf("ICC profile is truncated")
+	}
+	if space := string(profile[16:20]); space != "RGB " {
+		return nil, fmt.Errorf("unsupported ICC colour space %q", space)
+	}
+	if pcs := string(profile[20:24]); pcs != "XYZ " {
+		return nil, fmt.Errorf("unsupported ICC connection space %q", pcs)
+	}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(profile) {
+			return nil, fmt.Errorf("ICC tag table is truncated")
+		}
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, fmt.Errorf("ICC tag is out of bounds")
+		}
+		tags[string(profile[entry:entry+4])] = profile[offset : offset+size]
+	}
+
+	p := &matrixProfile{}
+	for channel, names := range [3][2]string{{"rXYZ", "rTRC"}, {"gXYZ", "gTRC"}, {"bXYZ", "bTRC"}} {
+		xyz, ok := tags[names[0]]
+		if !ok || len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, fmt.Errorf("ICC profile has no %s colorant, only matrix profiles are supported", names[0])
+		}
+		for i := 0; i < 3; i++ {
+			p.toXYZ[i][channel] = s15Fixed16(xyz[8+i*4:])
+		}
+
+		trc, ok := tags[names[1]]
+		if !ok {
+			return nil, fmt.Errorf("ICC profile has no %s curve", names[1])
+		}
+		curve, err := parseToneCurve(trc)
+		if err != nil {
+			return nil, err
+		}
+		for i := range p.curves[channel] {
+			p.curves[channel][i] = curve(float64(i) / 255)
+		}
+	}
+	return p, nil
+}
+
+// parseToneCurve parses a curv or para tag into a function mapping encoded
+// values in [0, 1] to linear light
+func parseToneCurve(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, fmt.Errorf("ICC tone curve is truncated")
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+2*n {
+			return nil, fmt.Errorf("ICC tone curve is truncated")
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := min(int(pos), n-2)
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, nil
+
+	case "para":
+		kind := binary.BigEndian.Uint16(tag[8:])
+		counts := []int{1, 3, 4, 5, 7}
+		if int(kind) >= len(counts) || len(tag) < 12+4*counts[kind] {
+			return nil, fmt.Errorf("unsupported ICC parametric curve")
+		}
+		// Parameters are g, a, b, c, d, e, f; unused ones stay neutral
+		params := []float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < counts[kind]; i++ {
+			params[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := params[0], params[1], params[2], params[3], params[4], params[5], params[6]
+		pow := func(x float64) float64 { return math.Pow(max(a*x+b, 0), g) }
+
+		switch kind {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }, nil
+		case 1:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return pow(x)
+				}
+				return 0
+			}, nil
+		case 2:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return pow(x) + c
+				}
+				return c
+			}, nil
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return pow(x)
+				}
+				return c * x
+			}, nil
+		default:
+			return func(x float64) float64 {
+				if x >= d {
+					return pow(x) + e
+				}
+				return c*x + f
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported ICC tone curve type %q", tag[:4])
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
@@ -3,106 +3,61 @@ package util
 import (
     "bytes"
     "context"
+    "errors"
     "image"
+    _ "image/gif"
     "image/jpeg"
     "image/png"
-    "image/color"
     "log"
-    "mime"
-    "net/http"
-    "path/filepath"
     "fmt"
     "strconv"
     "os"
 
-    "github.com/aws/aws-sdk-go-v2/aws"
-    "github.com/aws/aws-sdk-go-v2/config"
-    "github.com/aws/aws-sdk-go-v2/service/s3"
+    _ "golang.org/x/image/webp"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
 
     "github.com/mohammadshaad/zocket/internal/db"
     "github.com/mohammadshaad/zocket/internal/cache"
 )
 
-// S3Client wraps the AWS S3 client
-type S3Client struct {
-    client     *s3.Client
-    bucketName string
-}
-
-// InitS3Client initializes the S3 client with the specified bucket name
-func InitS3Client(bucketName string) (*S3Client, error) {
-    cfg, err := config.LoadDefaultConfig(context.TODO())
-    if err != nil {
-        log.Printf("Error loading AWS configuration: %v", err)
-        return nil, err
-    }
-
-    client := s3.NewFromConfig(cfg)
-    return &S3Client{client: client, bucketName: bucketName}, nil
-}
-
-// UploadToS3 uploads a file to the S3 bucket and returns the URL
-func (s *S3Client) UploadToS3(fileName string, fileData []byte) (string, error) {
-    contentType := mime.TypeByExtension(filepath.Ext(fileName))
-    if contentType == "" {
-        contentType = "application/octet-stream"
-    }
-
-    input := &s3.PutObjectInput{
-        Bucket:      aws.String(s.bucketName),
-        Key:         aws.String(fileName),
-        Body:        bytes.NewReader(fileData),
-        ContentType: aws.String(contentType),
-    }
-
-    _, err := s.client.PutObject(context.TODO(), input)
-    if err != nil {
-        log.Printf("Error uploading to S3: %v", err)
-        return "", err
-    }
-
-    url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.bucketName, fileName)
-    log.Printf("File uploaded to S3: %s", url)
-    return url, nil
-}
-
-// DownloadImage downloads an image from a given URL
-func DownloadImage(url string) (image.Image, error) {
-    resp, err := http.Get(url)
+// DownloadImage downloads an image from a given URL with the default limits
+// and decodes it in display orientation, handling its colour profile
+// according to policy
+func DownloadImage(url string, policy ColorProfilePolicy) (*DecodedImage, error) {
+    img, err := defaultDownloader.Download(context.Background(), url, policy)
     if err != nil {
         log.Printf("Error downloading image: %v", err)
         return nil, err
     }
-    defer resp.Body.Close()
-
-    img, _, err := image.Decode(resp.Body)
-    if err != nil {
-        log.Printf("Error decoding image: %v", err)
-        return nil, err
-    }
 
     return img, nil
 }
 
-// CompressImage compresses an image and returns a byte array
+// CompressImage compresses an image and returns a byte array. Palette images
+// and images with transparent pixels are stored as PNG, everything else as
+// JPEG.
 func CompressImage(img image.Image, quality int) ([]byte, error) {
     var buf bytes.Buffer
-    switch img.ColorModel() {
-    case color.YCbCrModel:
+    img = toEncodable(img)
+
+    switch outputFormat(img) {
+    case FormatJPEG:
         err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
         if err != nil {
             log.Printf("Error compressing JPEG image: %v", err)
             return nil, err
         }
-    case color.RGBAModel, color.NRGBAModel:
-        err := png.Encode(&buf, img)
+    default:
+        if paletted, ok := img.(*image.Paletted); ok {
+            img = optimizePalette(paletted)
+        }
+        encoder := png.Encoder{CompressionLevel: png.BestCompression}
+        err := encoder.Encode(&buf, img)
         if err != nil {
             log.Printf("Error compressing PNG image: %v", err)
             return nil, err
         }
-    default:
-        log.Printf("Unsupported image format: %T", img)
-        return nil, fmt.Errorf("unsupported image format: %T", img)
     }
 
     return buf.Bytes(), nil
@@ -126,42 +81,61 @@ func SaveImageToFile(imgData []byte, filePath string) error {
     return nil
 }
 
-// UpdateProductImageURL updates the product record with the new compressed image URL
-func UpdateProductImageURL(productID int, originalURL, compressedURL string) error {
+// UpdateProductImage stores the primary compressed URL and the renditions of
+// a processed image on the product record
+func UpdateProductImage(productID int, originalURL, compressedURL string, renditions []db.ImageRendition) error {
     if db.DB == nil {
         return fmt.Errorf("database connection not initialized")
     }
 
-    var product db.Product
-    if err := db.DB.First(&product, productID).Error; err != nil {
-        log.Printf("Error finding product %d: %v", productID, err)
-        return err
-    }
-
-    // Find the original image URL in the ProductImages array and get its index
-    originalIndex := -1
-    for i, url := range product.ProductImages {
-        if url == originalURL {
-            originalIndex = i
-            break
+    err := db.DB.Transaction(func(tx *gorm.DB) error {
+        // Lock the row so a concurrent product update cannot be overwritten
+        var product db.Product
+        err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&product, productID).Error
+        if errors.Is(err, gorm.ErrRecordNotFound) {
+            return fmt.Errorf("%w: product %d was deleted", db.ErrImageGone, productID)
+        }
+        if err != nil {
+            log.Printf("Error finding product %d: %v", productID, err)
+            return err
         }
-    }
 
-    if originalIndex == -1 {
-        return fmt.Errorf("original image URL not found in product images")
-    }
+        // Find the original image URL in the ProductImages array and get its index
+        originalIndex := -1
+        for i, url := range product.ProductImages {
+            if url == originalURL {
+                originalIndex = i
+                break
+            }
+        }
 
-    // Ensure CompressedProductImages array is initialized and has the same length
-    for len(product.CompressedProductImages) < len(product.ProductImages) {
-        product.CompressedProductImages = append(product.CompressedProductImages, "")
-    }
+        if originalIndex == -1 {
+            return fmt.Errorf("%w: %s was removed from product %d", db.ErrImageGone, originalURL, productID)
+        }
 
-    // Update the compressed image URL at the corresponding index
-    product.CompressedProductImages[originalIndex] = compressedURL
+        // Ensure CompressedProductImages array is initialized and has the same length
+        for len(product.CompressedProductImages) < len(product.ProductImages) {
+            product.CompressedProductImages = append(product.CompressedProductImages, "")
+        }
 
-    // Save the updated product
-    if err := db.DB.Save(&product).Error; err != nil {
-        log.Printf("Error saving product with compressed image URL: %v", err)
+        // Update the compressed image URL at the corresponding index
+        product.CompressedProductImages[originalIndex] = compressedURL
+        product.ImageRenditions = product.ImageRenditions.Set(db.ImageRenditions{
+            SourceURL:  originalURL,
+            Renditions: renditions,
+        })
+
+        // Only write the processed image columns, the rest of the row may be edited through the API
+        if err := tx.Model(&product).Updates(map[string]interface{}{
+            "compressed_product_images": product.CompressedProductImages,
+            "image_renditions":          product.ImageRenditions,
+        }).Error; err != nil {
+            log.Printf("Error saving product with compressed image URL: %v", err)
+            return err
+        }
+        return nil
+    })
+    if err != nil {
         return err
     }
 
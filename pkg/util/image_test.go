@@ -0,0 +1,144 @@
+package util
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fill(img interface {
+	image.Image
+	Set(x, y int, c color.Color)
+}, c color.Color) {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.Set(x, y, c)
+		}
+	}
+}
+
+func TestCompressImageColorModels(t *testing.T) {
+	rect := image.Rect(0, 0, 16, 8)
+
+	opaqueRGBA := image.NewRGBA(rect)
+	fill(opaqueRGBA, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+	transparentRGBA := image.NewRGBA(rect)
+	fill(transparentRGBA, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+	transparentRGBA.Set(3, 3, color.RGBA{})
+
+	gray := image.NewGray(rect)
+	fill(gray, color.Gray{Y: 128})
+	gray16 := image.NewGray16(rect)
+	fill(gray16, color.Gray16{Y: 40000})
+
+	cmyk := image.NewCMYK(rect)
+	fill(cmyk, color.CMYK{C: 0, M: 255, Y: 255, K: 0})
+
+	opaque64 := image.NewRGBA64(rect)
+	fill(opaque64, color.RGBA64{R: 0xffff, G: 0x8000, B: 0, A: 0xffff})
+	transparent64 := image.NewNRGBA64(rect)
+	fill(transparent64, color.NRGBA64{R: 0xffff, A: 0x8000})
+
+	tests := []struct {
+		name   string
+		img    image.Image
+		format string
+		model  color.Model
+	}{
+		{"opaque RGBA", opaqueRGBA, "jpeg", color.YCbCrModel},
+		{"transparent RGBA", transparentRGBA, "png", color.NRGBAModel},
+		{"gray", gray, "jpeg", color.GrayModel},
+		{"gray16", gray16, "jpeg", color.GrayModel},
+		{"CMYK", cmyk, "jpeg", color.YCbCrModel},
+		{"opaque RGBA64", opaque64, "jpeg", color.YCbCrModel},
+		{"transparent NRGBA64", transparent64, "png", color.NRGBAModel},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := CompressImage(tt.img, 80)
+			require.NoError(t, err)
+
+			decoded, format, err := image.Decode(bytes.NewReader(data))
+			require.NoError(t, err)
+			assert.Equal(t, tt.format, format)
+			assert.Equal(t, tt.model, decoded.ColorModel())
+			assert.Equal(t, rect, decoded.Bounds())
+		})
+	}
+
+	// CMYK is converted to sRGB
+	data, err := CompressImage(cmyk, 95)
+	require.NoError(t, err)
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	r, g, b, _ := decoded.At(4, 4).RGBA()
+	assert.InDelta(t, 0xffff, r, 0x1000)
+	assert.InDelta(t, 0, g, 0x1000)
+	assert.InDelta(t, 0, b, 0x1000)
+}
+
+func TestCompressImagePaletted(t *testing.T) {
+	palette := color.Palette{color.Black, color.White, color.Transparent}
+	for i := 0; i < 200; i++ {
+		palette = append(palette, color.RGBA{R: uint8(i), A: 255})
+	}
+	img := image.NewPaletted(image.Rect(0, 0, 10, 10), palette)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % 2)
+	}
+
+	data, err := CompressImage(img, 80)
+	require.NoError(t, err)
+
+	decoded, err := png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	paletted, ok := decoded.(*image.Paletted)
+	require.True(t, ok, "expected a palette PNG, got %T", decoded)
+	assert.Len(t, paletted.Palette, 2)
+	assert.Equal(t, color.RGBAModel.Convert(color.White), color.RGBAModel.Convert(paletted.At(1, 0)))
+
+	// Unused transparent entries do not count as transparency
+	assert.False(t, hasAlpha(img))
+	img.Pix[0] = 2
+	assert.True(t, hasAlpha(img))
+}
+
+func TestPerceptualHash(t *testing.T) {
+	// A horizontal gradient with a dark square
+	src := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			v := uint8(x * 255 / 400)
+			if x > 100 && x < 200 && y > 100 && y < 200 {
+				v = 20
+			}
+			src.Set(x, y, color.RGBA{R: v, G: v, B: 255 - v, A: 255})
+		}
+	}
+	hash := PerceptualHash(src)
+
+	// Resized and recompressed copies stay close
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, resizeImage(src, RenditionProfile{MaxWidth: 120, MaxHeight: 90, Mode: ModeFit}), &jpeg.Options{Quality: 40}))
+	copied, err := jpeg.Decode(&buf)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, HammingDistance(hash, PerceptualHash(copied)), 4)
+
+	// A different image is far away
+	other := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			v := uint8(255 - x*255/400)
+			other.Set(x, y, color.RGBA{R: v, G: uint8(y), B: v, A: 255})
+		}
+	}
+	assert.Greater(t, HammingDistance(hash, PerceptualHash(other)), 20)
+}
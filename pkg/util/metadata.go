@@ -0,0 +1,347 @@
+package util
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"log"
+	"sort"
+)
+
+// ColorProfilePolicy decides what happens to embedded ICC colour profiles.
+// Every other piece of metadata (EXIF, GPS, XMP, comments) is always
+// dropped, since images are decoded and re-encoded from pixels.
+type ColorProfilePolicy string
+
+const (
+	// ColorProfileStrip drops the profile, like every other metadata
+	ColorProfileStrip ColorProfilePolicy = "strip"
+	// ColorProfileKeep embeds the source profile in every output
+	ColorProfileKeep ColorProfilePolicy = "keep"
+	// ColorProfileSRGB converts the pixels to sRGB and drops the profile
+	ColorProfileSRGB ColorProfilePolicy = "srgb"
+)
+
+// ParseColorProfilePolicy validates an IMAGE_ICC_PROFILE value
+func ParseColorProfilePolicy(value string) (ColorProfilePolicy, error) {
+	switch policy := ColorProfilePolicy(value); policy {
+	case ColorProfileStrip, ColorProfileKeep, ColorProfileSRGB:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid colour profile policy %q, expected strip, keep or srgb", value)
+}
+
+// DecodedImage is a decoded image, already in display orientation
+type DecodedImage struct {
+	Image  image.Image
+	Format string
+	// ICCProfile is the profile to embed in outputs, only set with
+	// ColorProfileKeep
+	ICCProfile []byte
+}
+
+// imageMetadata is the metadata read from an encoded image
+type imageMetadata struct {
+	orientation int
+	iccProfile  []byte
+}
+
+// DecodeImage decodes an image, applies its EXIF orientation and handles its
+// colour profile according to policy
+func DecodeImage(data []byte, policy ColorProfilePolicy) (*DecodedImage, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	meta := readMetadata(data)
+	decoded := &DecodedImage{Image: orient(img, meta.orientation), Format: format}
+	if meta.iccProfile == nil {
+		return decoded, nil
+	}
+
+	switch policy {
+	case ColorProfileKeep:
+		if profileMatches(meta.iccProfile, decoded.Image) {
+			decoded.ICCProfile = meta.iccProfile
+		} else {
+			log.Printf("Dropping ICC profile that does not match the %T image", decoded.Image)
+		}
+	case ColorProfileSRGB:
+		converted, err := convertToSRGB(decoded.Image, meta.iccProfile)
+		if err != nil {
+			log.Printf("Keeping colours unconverted: %v", err)
+		} else {
+			decoded.Image = converted
+		}
+	}
+	return decoded, nil
+}
+
+// readMetadata extracts the orientation and colour profile of JPEG and PNG
+// images. Malformed metadata is ignored.
+func readMetadata(data []byte) imageMetadata {
+	meta := imageMetadata{orientation: 1}
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		readJPEGMetadata(data, &meta)
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		readPNGMetadata(data, &meta)
+	}
+	return meta
+}
+
+const (
+	pngSignature     = "\x89PNG\r\n\x1a\n"
+	jpegExifPrefix   = "Exif\x00\x00"
+	jpegICCPrefix    = "ICC_PROFILE\x00"
+	maxICCProfileLen = 4 << 20
+)
+
+func readJPEGMetadata(data []byte, meta *imageMetadata) {
+	type iccChunk struct {
+		seq  byte
+		data []byte
+	}
+	var chunks []iccChunk
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			break
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			i++
+			continue
+		}
+		// Start of scan and end of image end the header segments
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(segment, []byte(jpegExifPrefix)):
+			meta.orientation = exifOrientation(segment[len(jpegExifPrefix):])
+		case marker == 0xe2 && bytes.HasPrefix(segment, []byte(jpegICCPrefix)) && len(segment) > len(jpegICCPrefix)+2:
+			chunks = append(chunks, iccChunk{seq: segment[len(jpegICCPrefix)], data: segment[len(jpegICCPrefix)+2:]})
+		}
+		i += 2 + length
+	}
+
+	// Profiles larger than a segment are split over numbered APP2 segments
+	sort.Slice(chunks, func(a, b int) bool { return chunks[a].seq < chunks[b].seq })
+	var profile []byte
+	for _, chunk := range chunks {
+		profile = append(profile, chunk.data...)
+	}
+	meta.iccProfile = profile
+}
+
+func readPNGMetadata(data []byte, meta *imageMetadata) {
+	for i := len(pngSignature); i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		if length < 0 || i+12+length > len(data) {
+			break
+		}
+		chunkType := string(data[i+4 : i+8])
+		chunk := data[i+8 : i+8+length]
+
+		switch chunkType {
+		case "eXIf":
+			meta.orientation = exifOrientation(chunk)
+		case "iCCP":
+			// Profile name, a NUL, the compression method and zlib data
+			if end := bytes.IndexByte(chunk, 0); end >= 0 && end+2 <= len(chunk) {
+				if profile, err := inflate(chunk[end+2:]); err == nil {
+					meta.iccProfile = profile
+				}
+			}
+		case "IEND":
+			return
+		}
+		i += 12 + length
+	}
+}
+
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, maxICCProfileLen))
+}
+
+// exifOrientation reads the orientation tag of the first IFD of an EXIF TIFF
+// structure, returning 1 (no transform) when it is missing
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		// Orientation is a single SHORT stored inline
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			if value := int(order.Uint16(tiff[entry+8:])); value >= 1 && value <= 8 {
+				return value
+			}
+		}
+	}
+	return 1
+}
+
+// orient transforms an image stored with the given EXIF orientation into
+// display orientation. Palette and grayscale images keep their pixel type.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dstRect := image.Rect(0, 0, dstW, dstH)
+
+	var srcPix, dstPix []byte
+	var srcStride, dstStride, size int
+	var dst image.Image
+	switch m := img.(type) {
+	case *image.Paletted:
+		out := image.NewPaletted(dstRect, m.Palette)
+		srcPix, srcStride, dstPix, dstStride, size, dst = m.Pix, m.Stride, out.Pix, out.Stride, 1, out
+	case *image.Gray:
+		out := image.NewGray(dstRect)
+		srcPix, srcStride, dstPix, dstStride, size, dst = m.Pix, m.Stride, out.Pix, out.Stride, 1, out
+	case *image.Gray16:
+		out := image.NewGray16(dstRect)
+		srcPix, srcStride, dstPix, dstStride, size, dst = m.Pix, m.Stride, out.Pix, out.Stride, 2, out
+	default:
+		src := toNRGBA(img)
+		out := image.NewNRGBA(dstRect)
+		srcPix, srcStride, dstPix, dstStride, size, dst = src.Pix, src.Stride, out.Pix, out.Stride, 4, out
+	}
+
+	for dy := 0; dy < dstH; dy++ {
+		for dx := 0; dx < dstW; dx++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-dx, dy
+			case 3: // rotated 180
+				sx, sy = w-1-dx, h-1-dy
+			case 4: // mirrored vertically
+				sx, sy = dx, h-1-dy
+			case 5: // transposed
+				sx, sy = dy, dx
+			case 6: // rotated 90 clockwise for display
+				sx, sy = dy, h-1-dx
+			case 7: // transversed
+				sx, sy = w-1-dy, h-1-dx
+			case 8: // rotated 90 counter-clockwise for display
+				sx, sy = w-1-dy, dx
+			}
+			copy(dstPix[dy*dstStride+dx*size:dy*dstStride+(dx+1)*size], srcPix[sy*srcStride+sx*size:])
+		}
+	}
+	return dst
+}
+
+// embedICCJPEG inserts APP2 segments carrying the profile after the SOI
+// marker of an encoded JPEG
+func embedICCJPEG(data, profile []byte) []byte {
+	const maxChunk = 0xffff - 2 - len(jpegICCPrefix) - 2
+	count := (len(profile) + maxChunk - 1) / maxChunk
+	if len(profile) == 0 || count > 255 || !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return data
+	}
+
+	out := make([]byte, 0, len(data)+len(profile)+count*18)
+	out = append(out, data[:2]...)
+	for seq := 1; seq <= count; seq++ {
+		chunk := profile[(seq-1)*maxChunk : min(len(profile), seq*maxChunk)]
+		out = append(out, 0xff, 0xe2)
+		out = binary.BigEndian.AppendUint16(out, uint16(2+len(jpegICCPrefix)+2+len(chunk)))
+		out = append(out, jpegICCPrefix...)
+		out = append(out, byte(seq), byte(count))
+		out = append(out, chunk...)
+	}
+	return append(out, data[2:]...)
+}
+
+// embedICCPNG inserts an iCCP chunk after the IHDR chunk of an encoded PNG
+func embedICCPNG(data, profile []byte) ([]byte, error) {
+	const ihdrEnd = len(pngSignature) + 12 + 13
+	if len(profile) == 0 || len(data) < ihdrEnd || !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return data, nil
+	}
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(profile); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	chunk := append([]byte("iCCP"+"ICC Profile\x00\x00"), compressed.Bytes()...)
+	out := make([]byte, 0, len(data)+len(chunk)+8)
+	out = append(out, data[:ihdrEnd]...)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(chunk)-4))
+	out = append(out, chunk...)
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(chunk))
+	return append(out, data[ihdrEnd:]...), nil
+}
+
+// profileMatches reports whether the colour space of the profile fits the
+// image it would be embedded with
+func profileMatches(profile []byte, img image.Image) bool {
+	if len(profile) < 20 {
+		return false
+	}
+	space := string(profile[16:20])
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		return space == "GRAY"
+	case *image.CMYK:
+		return false
+	}
+	return space == "RGB "
+}
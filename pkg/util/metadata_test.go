@@ -0,0 +1,199 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exifSegment builds an APP1 segment holding only an orientation tag
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+
+	payload := append([]byte(jpegExifPrefix), tiff...)
+	segment := []byte{0xff, 0xe1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// matrixICCProfile builds an RGB profile with the sRGB colorants and either
+// the sRGB tone curve or a linear one
+func matrixICCProfile(linear bool) []byte {
+	fixed := func(b []byte, v float64) []byte {
+		return binary.BigEndian.AppendUint32(b, uint32(int32(v*65536+0.5)))
+	}
+	xyz := func(x, y, z float64) []byte {
+		return fixed(fixed(fixed([]byte("XYZ \x00\x00\x00\x00"), x), y), z)
+	}
+	curve := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, v := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		curve = fixed(curve, v)
+	}
+	if linear {
+		curve = []byte("curv\x00\x00\x00\x00\x00\x00\x00\x00")
+	}
+
+	tags := []struct {
+		name string
+		data []byte
+	}{
+		{"rXYZ", xyz(0.4361, 0.2225, 0.0139)},
+		{"gXYZ", xyz(0.3851, 0.7169, 0.0971)},
+		{"bXYZ", xyz(0.1431, 0.0606, 0.7141)},
+		{"rTRC", curve},
+		{"gTRC", curve},
+		{"bTRC", curve},
+	}
+
+	header := make([]byte, 128)
+	copy(header[16:], "RGB XYZ ")
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	var data []byte
+	offset := 128 + 4 + 12*len(tags)
+	for _, tag := range tags {
+		table = append(table, tag.name...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset+len(data)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(tag.data)))
+		data = append(data, tag.data...)
+	}
+	profile := append(append(header, table...), data...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+func TestDecodeImageAppliesOrientation(t *testing.T) {
+	// A 2x1 image with a red left and a blue right pixel
+	src := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 8 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, src, &jpeg.Options{Quality: 100}))
+	plain := buf.Bytes()
+
+	tests := []struct {
+		orientation uint16
+		size        image.Point
+		// corner where the red half ends up
+		red image.Point
+	}{
+		{1, image.Pt(16, 8), image.Pt(0, 0)},
+		{2, image.Pt(16, 8), image.Pt(15, 0)},
+		{3, image.Pt(16, 8), image.Pt(15, 7)},
+		{6, image.Pt(8, 16), image.Pt(0, 0)},
+		{8, image.Pt(8, 16), image.Pt(0, 15)},
+	}
+	for _, tt := range tests {
+		data := append(append([]byte{0xff, 0xd8}, exifSegment(tt.orientation)...), plain[2:]...)
+
+		decoded, err := DecodeImage(data, ColorProfileStrip)
+		require.NoError(t, err)
+		assert.Equal(t, "jpeg", decoded.Format)
+		assert.Equal(t, tt.size, decoded.Image.Bounds().Size(), "orientation %d", tt.orientation)
+
+		r, _, b, _ := decoded.Image.At(tt.red.X, tt.red.Y).RGBA()
+		assert.Greater(t, r, b, "orientation %d", tt.orientation)
+	}
+}
+
+func TestOrientKeepsPixelType(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 3, 2))
+	copy(gray.Pix, []byte{1, 2, 3, 4, 5, 6})
+
+	rotated := orient(gray, 6).(*image.Gray)
+	assert.Equal(t, image.Rect(0, 0, 2, 3), rotated.Bounds())
+	assert.Equal(t, []byte{4, 1, 5, 2, 6, 3}, rotated.Pix)
+
+	transposed := orient(gray, 5).(*image.Gray)
+	assert.Equal(t, []byte{1, 4, 2, 5, 3, 6}, transposed.Pix)
+
+	paletted := image.NewPaletted(image.Rect(0, 0, 2, 1), color.Palette{color.Black, color.White})
+	paletted.Pix[1] = 1
+	mirrored := orient(paletted, 2).(*image.Paletted)
+	assert.Equal(t, []byte{1, 0}, mirrored.Pix)
+}
+
+func TestColorProfilePolicies(t *testing.T) {
+	profile := matrixICCProfile(false)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []byte{128, 64, 200, 255})
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	data, err := embedICCPNG(buf.Bytes(), profile)
+	require.NoError(t, err)
+	assert.Equal(t, profile, readMetadata(data).iccProfile)
+
+	// Strip drops the profile
+	decoded, err := DecodeImage(data, ColorProfileStrip)
+	require.NoError(t, err)
+	assert.Nil(t, decoded.ICCProfile)
+
+	// Keep embeds it in every output format
+	decoded, err = DecodeImage(data, ColorProfileKeep)
+	require.NoError(t, err)
+	assert.Equal(t, profile, decoded.ICCProfile)
+
+	renditions, err := RenderRenditions(decoded.Image, RenditionProfile{Name: "large", MaxWidth: 100, MaxHeight: 100, Mode: ModeFit, Quality: 90, Format: "png|jpeg"}, decoded.ICCProfile)
+	require.NoError(t, err)
+	for _, rendition := range renditions {
+		_, _, err := image.Decode(bytes.NewReader(rendition.Data))
+		require.NoError(t, err, rendition.Format)
+		assert.Equal(t, profile, readMetadata(rendition.Data).iccProfile, rendition.Format)
+	}
+
+	// Converting an sRGB profile leaves the colours alone
+	decoded, err = DecodeImage(data, ColorProfileSRGB)
+	require.NoError(t, err)
+	assert.Nil(t, decoded.ICCProfile)
+	c := color.NRGBAModel.Convert(decoded.Image.At(0, 0)).(color.NRGBA)
+	assert.InDelta(t, 128, c.R, 1)
+	assert.InDelta(t, 64, c.G, 1)
+	assert.InDelta(t, 200, c.B, 1)
+
+	// A linear profile brightens the encoded values
+	converted, err := convertToSRGB(img, matrixICCProfile(true))
+	require.NoError(t, err)
+	c = color.NRGBAModel.Convert(converted.At(0, 0)).(color.NRGBA)
+	assert.InDelta(t, 188, c.R, 1)
+	assert.Equal(t, uint8(255), c.A)
+}
+
+func TestOutputsCarryNoMetadata(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, src, nil))
+	data := append(append([]byte{0xff, 0xd8}, exifSegment(6)...), buf.Bytes()[2:]...)
+
+	decoded, err := DecodeImage(data, ColorProfileKeep)
+	require.NoError(t, err)
+
+	renditions, err := RenderRenditions(decoded.Image, RenditionProfile{Name: "large", MaxWidth: 100, MaxHeight: 100, Mode: ModeFit, Quality: 90, Format: "png|jpeg"}, decoded.ICCProfile)
+	require.NoError(t, err)
+	for _, rendition := range renditions {
+		assert.NotContains(t, string(rendition.Data), "Exif", rendition.Format)
+		assert.Equal(t, 1, readMetadata(rendition.Data).orientation)
+		assert.Nil(t, readMetadata(rendition.Data).iccProfile)
+	}
+}
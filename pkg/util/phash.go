@@ -0,0 +1,38 @@
+package util
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+
+	"golang.org/x/image/draw"
+)
+
+// PerceptualHash computes the 64-bit difference hash (dHash) of an image.
+// The image is shrunk to 9x8 grayscale pixels and every bit records whether
+// a pixel is brighter than its right neighbour, so re-encoded, resized or
+// slightly edited copies of an image get hashes within a small Hamming
+// distance of each other.
+func PerceptualHash(img image.Image) uint64 {
+	// Transparent pixels are compared as if shown on a white page
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.Draw(small, small.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.BiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Over, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		row := small.Pix[y*small.Stride : y*small.Stride+9]
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if row[x] > row[x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HammingDistance returns the number of bits that differ between two hashes
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
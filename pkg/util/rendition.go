@@ -0,0 +1,315 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Resize modes of a rendition profile
+const (
+	// ModeFit scales the image down to fit inside the box, keeping its aspect ratio
+	ModeFit = "fit"
+	// ModeFill scales the image to cover the box and crops the overflow
+	ModeFill = "fill"
+)
+
+// Output formats of a rendition profile
+const (
+	// FormatAuto picks JPEG or PNG from the source image, like CompressImage
+	FormatAuto = "auto"
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	// FormatWebP is lossy WebP, FormatWebPLossless is exact. Both are only
+	// available in builds with the webp tag, see webp.go
+	FormatWebP         = "webp"
+	FormatWebPLossless = "webp-lossless"
+	// FormatAVIF is only available in builds with the avif tag, see avif.go
+	FormatAVIF = "avif"
+)
+
+// EncodeOptions are passed to every encoder
+type EncodeOptions struct {
+	Quality int
+	// ICCProfile is embedded in the output when set
+	ICCProfile []byte
+}
+
+// Encoder writes images in one output format
+type Encoder struct {
+	// Type is the file type produced, shared by the WebP variants
+	Type        string
+	ContentType string
+	Encode      func(w io.Writer, img image.Image, opts EncodeOptions) error
+}
+
+var encoders = map[string]Encoder{
+	FormatJPEG: {Type: "jpeg", ContentType: "image/jpeg", Encode: func(w io.Writer, img image.Image, opts EncodeOptions) error {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, flatten(img), &jpeg.Options{Quality: opts.Quality}); err != nil {
+			return err
+		}
+		_, err := w.Write(embedICCJPEG(buf.Bytes(), opts.ICCProfile))
+		return err
+	}},
+	FormatPNG: {Type: "png", ContentType: "image/png", Encode: func(w io.Writer, img image.Image, opts EncodeOptions) error {
+		if paletted, ok := img.(*image.Paletted); ok {
+			img = optimizePalette(paletted)
+		}
+		var buf bytes.Buffer
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := encoder.Encode(&buf, img); err != nil {
+			return err
+		}
+		data, err := embedICCPNG(buf.Bytes(), opts.ICCProfile)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}},
+}
+
+// RegisterEncoder makes an output format available to rendition profiles.
+// It must be called before the profiles are parsed, typically from init.
+func RegisterEncoder(format string, encoder Encoder) {
+	encoders[format] = encoder
+}
+
+// RenditionProfile describes one size the processor generates for every
+// product image
+type RenditionProfile struct {
+	Name      string
+	MaxWidth  int
+	MaxHeight int
+	Mode      string
+	Quality   int
+	// Format lists the formats to encode, separated by |, in order of
+	// preference. The last one is the fallback for clients that accept none
+	// of the others.
+	Format string
+}
+
+// Formats returns the formats of the profile in order of preference
+func (p RenditionProfile) Formats() []string {
+	return strings.Split(p.Format, "|")
+}
+
+// Rendition is an encoded rendition of an image
+type Rendition struct {
+	Profile     RenditionProfile
+	Data        []byte
+	Width       int
+	Height      int
+	Format      string
+	ContentType string
+}
+
+// DefaultRenditionProfiles are used when IMAGE_RENDITIONS is not set. Builds
+// with the webp tag add WebP in front of the fallback.
+var DefaultRenditionProfiles = []RenditionProfile{
+	{Name: "thumbnail", MaxWidth: 150, MaxHeight: 150, Mode: ModeFill, Quality: 75, Format: FormatAuto},
+	{Name: "medium", MaxWidth: 800, MaxHeight: 800, Mode: ModeFit, Quality: 75, Format: FormatAuto},
+	{Name: "large", MaxWidth: 1600, MaxHeight: 1600, Mode: ModeFit, Quality: 80, Format: FormatAuto},
+}
+
+// ParseRenditionProfiles parses a comma separated list of profiles written as
+// name:WIDTHxHEIGHT:mode:quality:formats, for example
+// "thumbnail:150x150:fill:75:jpeg,large:1600x1600:fit:80:avif|webp|auto"
+func ParseRenditionProfiles(spec string) ([]RenditionProfile, error) {
+	var profiles []RenditionProfile
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) != 5 {
+			return nil, fmt.Errorf("rendition %q must be name:WIDTHxHEIGHT:mode:quality:formats", entry)
+		}
+
+		profile := RenditionProfile{
+			Name:   parts[0],
+			Mode:   parts[2],
+			Format: parts[4],
+		}
+		if profile.Name == "" || strings.ContainsAny(profile.Name, "/ ") {
+			return nil, fmt.Errorf("rendition %q has an invalid name", entry)
+		}
+		if seen[profile.Name] {
+			return nil, fmt.Errorf("rendition %q is defined twice", profile.Name)
+		}
+		seen[profile.Name] = true
+
+		width, height, ok := strings.Cut(parts[1], "x")
+		var err error
+		if profile.MaxWidth, err = strconv.Atoi(width); !ok || err != nil || profile.MaxWidth < 1 {
+			return nil, fmt.Errorf("rendition %q has an invalid size %q", profile.Name, parts[1])
+		}
+		if profile.MaxHeight, err = strconv.Atoi(height); err != nil || profile.MaxHeight < 1 {
+			return nil, fmt.Errorf("rendition %q has an invalid size %q", profile.Name, parts[1])
+		}
+		if profile.Mode != ModeFit && profile.Mode != ModeFill {
+			return nil, fmt.Errorf("rendition %q has an invalid mode %q, expected fit or fill", profile.Name, profile.Mode)
+		}
+		if profile.Quality, err = strconv.Atoi(parts[3]); err != nil || profile.Quality < 1 || profile.Quality > 100 {
+			return nil, fmt.Errorf("rendition %q has an invalid quality %q", profile.Name, parts[3])
+		}
+		if err := checkFormats(profile.Formats()); err != nil {
+			return nil, fmt.Errorf("rendition %q: %w", profile.Name, err)
+		}
+
+		profiles = append(profiles, profile)
+	}
+
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("no rendition profiles defined")
+	}
+	return profiles, nil
+}
+
+// checkFormats rejects unknown formats and formats producing the same file
+// type, which would be uploaded under the same key
+func checkFormats(formats []string) error {
+	types := make(map[string]bool)
+	for _, format := range formats {
+		var produced []string
+		switch encoder, ok := encoders[format]; {
+		case format == FormatAuto:
+			produced = []string{FormatJPEG, FormatPNG}
+		case ok:
+			produced = []string{encoder.Type}
+		case format == FormatAVIF:
+			return fmt.Errorf("format avif requires a build with the avif tag")
+		case format == FormatWebP || format == FormatWebPLossless:
+			return fmt.Errorf("format %s requires a build with the webp tag", format)
+		default:
+			return fmt.Errorf("unsupported format %q", format)
+		}
+
+		for _, fileType := range produced {
+			if types[fileType] {
+				return fmt.Errorf("format %q produces %s files twice", format, fileType)
+			}
+			types[fileType] = true
+		}
+	}
+	return nil
+}
+
+// PrimaryRendition returns the profile with the largest box, whose output is
+// stored in the flat CompressedProductImages list
+func PrimaryRendition(profiles []RenditionProfile) RenditionProfile {
+	primary := profiles[0]
+	for _, profile := range profiles[1:] {
+		if profile.MaxWidth*profile.MaxHeight > primary.MaxWidth*primary.MaxHeight {
+			primary = profile
+		}
+	}
+	return primary
+}
+
+// RenderRenditions resizes the image according to the profile and encodes
+// it in every format of the profile, in order of preference. The ICC
+// profile, if any, is embedded in every output.
+func RenderRenditions(img image.Image, profile RenditionProfile, iccProfile []byte) ([]*Rendition, error) {
+	img = toEncodable(img)
+	resized := resizeImage(img, profile)
+	bounds := resized.Bounds()
+
+	renditions := make([]*Rendition, 0, len(profile.Formats()))
+	for _, format := range profile.Formats() {
+		// Resizing loses the palette, so pick the automatic format from the source
+		if format == FormatAuto {
+			format = outputFormat(img)
+		}
+		encoder, ok := encoders[format]
+		if !ok {
+			return nil, fmt.Errorf("no encoder for format %q", format)
+		}
+
+		var buf bytes.Buffer
+		if err := encoder.Encode(&buf, resized, EncodeOptions{Quality: profile.Quality, ICCProfile: iccProfile}); err != nil {
+			return nil, fmt.Errorf("error encoding %s rendition: %w", format, err)
+		}
+
+		renditions = append(renditions, &Rendition{
+			Profile:     profile,
+			Data:        buf.Bytes(),
+			Width:       bounds.Dx(),
+			Height:      bounds.Dy(),
+			Format:      encoder.Type,
+			ContentType: encoder.ContentType,
+		})
+	}
+	return renditions, nil
+}
+
+// resizeImage scales the image into the profile box. Images are never
+// scaled up; a fill rendition of a small image is only cropped.
+func resizeImage(img image.Image, profile RenditionProfile) image.Image {
+	src := img.Bounds()
+	srcW, srcH := src.Dx(), src.Dy()
+	if srcW == 0 || srcH == 0 {
+		return img
+	}
+
+	var scale float64
+	if profile.Mode == ModeFill {
+		scale = max(float64(profile.MaxWidth)/float64(srcW), float64(profile.MaxHeight)/float64(srcH))
+	} else {
+		scale = min(float64(profile.MaxWidth)/float64(srcW), float64(profile.MaxHeight)/float64(srcH))
+	}
+	scale = min(scale, 1)
+
+	dstW := max(1, int(float64(srcW)*scale+0.5))
+	dstH := max(1, int(float64(srcH)*scale+0.5))
+
+	// Crop the part of the source that ends up inside the box
+	crop := src
+	if profile.Mode == ModeFill {
+		cropW := min(srcW, int(float64(profile.MaxWidth)/scale+0.5))
+		cropH := min(srcH, int(float64(profile.MaxHeight)/scale+0.5))
+		x := src.Min.X + (srcW-cropW)/2
+		y := src.Min.Y + (srcH-cropH)/2
+		crop = image.Rect(x, y, x+cropW, y+cropH)
+		dstW = min(dstW, profile.MaxWidth)
+		dstH = min(dstH, profile.MaxHeight)
+	}
+
+	if scale == 1 && crop == src {
+		return img
+	}
+
+	// Grayscale images stay grayscale, everything else is resized as NRGBA
+	var dst draw.Image = image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	if isGray(img) {
+		dst = image.NewGray(image.Rect(0, 0, dstW, dstH))
+	}
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, crop, draw.Src, nil)
+	return dst
+}
+
+// flatten composites the image onto white, since JPEG has no alpha channel.
+// Opaque images are returned as is.
+func flatten(img image.Image) image.Image {
+	if !hasAlpha(img) {
+		return img
+	}
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+	return dst
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRenditionProfiles(t *testing.T) {
+	profiles, err := ParseRenditionProfiles("thumbnail:150x150:fill:75:jpeg, large:1600x1200:fit:85:jpeg|png")
+	require.NoError(t, err)
+	assert.Equal(t, []RenditionProfile{
+		{Name: "thumbnail", MaxWidth: 150, MaxHeight: 150, Mode: ModeFill, Quality: 75, Format: FormatJPEG},
+		{Name: "large", MaxWidth: 1600, MaxHeight: 1200, Mode: ModeFit, Quality: 85, Format: "jpeg|png"},
+	}, profiles)
+	assert.Equal(t, "large", PrimaryRendition(profiles).Name)
+	assert.Equal(t, []string{FormatJPEG, FormatPNG}, profiles[1].Formats())
+
+	for _, spec := range []string{
+		"",
+		"thumbnail:150:fill:75:jpeg",
+		"thumbnail:150x150:stretch:75:jpeg",
+		"thumbnail:150x150:fill:0:jpeg",
+		"thumbnail:150x150:fill:75:bmp",
+		"a:1x1:fit:75:png,a:2x2:fit:75:png",
+		"a/b:1x1:fit:75:png",
+		"a:1x1:fit:75:png|auto",
+		"a:1x1:fit:75:auto|jpeg",
+		"a:1x1:fit:75:jpeg|",
+	} {
+		_, err := ParseRenditionProfiles(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestRenderRenditionFit(t *testing.T) {
+	img := image.NewYCbCr(image.Rect(0, 0, 2000, 1000), image.YCbCrSubsampleRatio420)
+
+	renditions, err := RenderRenditions(img, RenditionProfile{Name: "medium", MaxWidth: 800, MaxHeight: 800, Mode: ModeFit, Quality: 75, Format: FormatAuto}, nil)
+	require.NoError(t, err)
+	require.Len(t, renditions, 1)
+	rendition := renditions[0]
+	assert.Equal(t, 800, rendition.Width)
+	assert.Equal(t, 400, rendition.Height)
+	assert.Equal(t, FormatJPEG, rendition.Format)
+	assert.Equal(t, "image/jpeg", rendition.ContentType)
+
+	decoded, format, err := image.Decode(bytes.NewReader(rendition.Data))
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+	assert.Equal(t, image.Rect(0, 0, 800, 400), decoded.Bounds())
+}
+
+func TestRenderRenditionFill(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 600, 300))
+	img.Set(0, 0, color.NRGBA{A: 0})
+
+	renditions, err := RenderRenditions(img, RenditionProfile{Name: "thumbnail", MaxWidth: 150, MaxHeight: 150, Mode: ModeFill, Quality: 75, Format: FormatAuto}, nil)
+	require.NoError(t, err)
+	require.Len(t, renditions, 1)
+	rendition := renditions[0]
+	assert.Equal(t, 150, rendition.Width)
+	assert.Equal(t, 150, rendition.Height)
+	assert.Equal(t, FormatPNG, rendition.Format)
+}
+
+func TestRenderRenditionNeverUpscales(t *testing.T) {
+	img := image.NewYCbCr(image.Rect(0, 0, 100, 50), image.YCbCrSubsampleRatio420)
+
+	renditions, err := RenderRenditions(img, RenditionProfile{Name: "large", MaxWidth: 1600, MaxHeight: 1600, Mode: ModeFit, Quality: 80, Format: FormatPNG}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 100, renditions[0].Width)
+	assert.Equal(t, 50, renditions[0].Height)
+
+	renditions, err = RenderRenditions(img, RenditionProfile{Name: "thumbnail", MaxWidth: 80, MaxHeight: 80, Mode: ModeFill, Quality: 80, Format: FormatJPEG}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 80, renditions[0].Width)
+	assert.Equal(t, 50, renditions[0].Height)
+}
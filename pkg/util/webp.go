@@ -0,0 +1,129 @@
+//go:build webp && cgo
+
+package util
+
+/*
+#cgo pkg-config: libwebp libwebpmux
+#include <stdlib.h>
+#include <webp/encode.h>
+#include <webp/mux.h>
+
+static const char *encodeWebP(const uint8_t *pixels, int width, int height, int stride, float quality, int lossless, const uint8_t *icc, size_t iccSize, WebPData *out) {
+	WebPConfig config;
+	if (!WebPConfigPreset(&config, WEBP_PRESET_DEFAULT, quality)) {
+		return "incompatible libwebp version";
+	}
+	// For lossless output quality is the compression effort, and the colour
+	// of fully transparent pixels is kept
+	config.lossless = lossless;
+	config.exact = lossless;
+
+	WebPPicture picture;
+	if (!WebPPictureInit(&picture)) {
+		return "incompatible libwebp version";
+	}
+	picture.use_argb = lossless;
+	picture.width = width;
+	picture.height = height;
+	if (!WebPPictureImportRGBA(&picture, pixels, stride)) {
+		WebPPictureFree(&picture);
+		return "out of memory";
+	}
+
+	WebPMemoryWriter writer;
+	WebPMemoryWriterInit(&writer);
+	picture.writer = WebPMemoryWrite;
+	picture.custom_ptr = &writer;
+	int ok = WebPEncode(&config, &picture);
+	WebPEncodingError encodeErr = picture.error_code;
+	WebPPictureFree(&picture);
+	if (!ok) {
+		WebPMemoryWriterClear(&writer);
+		switch (encodeErr) {
+		case VP8_ENC_ERROR_OUT_OF_MEMORY:
+		case VP8_ENC_ERROR_BITSTREAM_OUT_OF_MEMORY:
+			return "out of memory";
+		case VP8_ENC_ERROR_BAD_DIMENSION:
+			return "invalid image size";
+		default:
+			return "encoding failed";
+		}
+	}
+
+	WebPData image = {writer.mem, writer.size};
+	if (iccSize == 0) {
+		*out = image;
+		return NULL;
+	}
+
+	// The ICC profile turns the file into an extended one
+	const char *muxErr = NULL;
+	WebPMux *mux = WebPMuxCreate(&image, 0);
+	if (mux == NULL) {
+		WebPMemoryWriterClear(&writer);
+		return "out of memory";
+	}
+	WebPData profile = {icc, iccSize};
+	if (WebPMuxSetChunk(mux, "ICCP", &profile, 0) != WEBP_MUX_OK || WebPMuxAssemble(mux, out) != WEBP_MUX_OK) {
+		muxErr = "error embedding ICC profile";
+	}
+	WebPMuxDelete(mux);
+	WebPMemoryWriterClear(&writer);
+	return muxErr;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"unsafe"
+
+	"golang.org/x/image/draw"
+)
+
+// WebP encoding uses libwebp, so it is only compiled into builds with the
+// webp tag: go build -tags webp. Those builds serve WebP by default.
+func init() {
+	RegisterEncoder(FormatWebP, Encoder{Type: "webp", ContentType: "image/webp", Encode: func(w io.Writer, img image.Image, opts EncodeOptions) error {
+		return encodeWebP(w, img, opts, false)
+	}})
+	RegisterEncoder(FormatWebPLossless, Encoder{Type: "webp", ContentType: "image/webp", Encode: func(w io.Writer, img image.Image, opts EncodeOptions) error {
+		return encodeWebP(w, img, opts, true)
+	}})
+
+	for i := range DefaultRenditionProfiles {
+		DefaultRenditionProfiles[i].Format = FormatWebP + "|" + FormatAuto
+	}
+}
+
+func encodeWebP(w io.Writer, img image.Image, opts EncodeOptions, lossless bool) error {
+	bounds := img.Bounds()
+	if bounds.Empty() || bounds.Dx() > C.WEBP_MAX_DIMENSION || bounds.Dy() > C.WEBP_MAX_DIMENSION {
+		return fmt.Errorf("webp: invalid image size %dx%d", bounds.Dx(), bounds.Dy())
+	}
+
+	// libwebp expects non-premultiplied RGBA
+	rgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+
+	var icc *C.uint8_t
+	if len(opts.ICCProfile) > 0 {
+		icc = (*C.uint8_t)(unsafe.Pointer(&opts.ICCProfile[0]))
+	}
+
+	var out C.WebPData
+	losslessFlag := C.int(0)
+	if lossless {
+		losslessFlag = 1
+	}
+	if msg := C.encodeWebP((*C.uint8_t)(unsafe.Pointer(&rgba.Pix[0])), C.int(bounds.Dx()), C.int(bounds.Dy()), C.int(rgba.Stride), C.float(opts.Quality),
+		losslessFlag, icc, C.size_t(len(opts.ICCProfile)), &out); msg != nil {
+		return fmt.Errorf("webp: %s", C.GoString(msg))
+	}
+	defer C.WebPDataClear(&out)
+
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(out.bytes), C.int(out.size)))
+	return err
+}
@@ -0,0 +1,92 @@
+//go:build webp && cgo
+
+package util
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebPProfiles(t *testing.T) {
+	profiles, err := ParseRenditionProfiles("large:1600x1200:fit:85:webp|auto")
+	require.NoError(t, err)
+	assert.Equal(t, []string{FormatWebP, FormatAuto}, profiles[0].Formats())
+	assert.Equal(t, FormatWebP+"|"+FormatAuto, DefaultRenditionProfiles[0].Format)
+
+	_, err = ParseRenditionProfiles("a:1x1:fit:75:webp|webp-lossless")
+	assert.Error(t, err)
+}
+
+func TestRenderRenditionsWebP(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+			if x > 100 && x < 300 && y > 50 && y < 250 {
+				img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 40, A: uint8(128 + x%64)})
+			}
+		}
+	}
+
+	renditions, err := RenderRenditions(img, RenditionProfile{Name: "large", MaxWidth: 1600, MaxHeight: 1600, Mode: ModeFit, Quality: 50, Format: "webp-lossless|webp|png"}, nil)
+	require.NoError(t, err)
+	require.Len(t, renditions, 3)
+
+	lossless, lossy, fallback := renditions[0], renditions[1], renditions[2]
+	assert.Equal(t, "webp", lossless.Format)
+	assert.Equal(t, "image/webp", lossless.ContentType)
+	assert.Equal(t, "webp", lossy.Format)
+	assert.Equal(t, "png", fallback.Format)
+	assert.Less(t, len(lossless.Data), len(fallback.Data))
+	assert.Less(t, len(lossy.Data), len(lossless.Data))
+
+	// Lossless output decodes to the exact pixels
+	decoded, format, err := image.Decode(bytes.NewReader(lossless.Data))
+	require.NoError(t, err)
+	assert.Equal(t, "webp", format)
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			require.Equal(t, img.NRGBAAt(x, y), color.NRGBAModel.Convert(decoded.At(x, y)), "pixel %d,%d", x, y)
+		}
+	}
+
+	// Lossy output stays close to the source on average
+	decoded, _, err = image.Decode(bytes.NewReader(lossy.Data))
+	require.NoError(t, err)
+	assert.Equal(t, img.Bounds(), decoded.Bounds())
+	var diff int
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			want, got := img.NRGBAAt(x, y), color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+			diff += absDiff(want.R, got.R) + absDiff(want.G, got.G) + absDiff(want.B, got.B) + absDiff(want.A, got.A)
+		}
+	}
+	assert.Less(t, diff/(400*300*4), 8)
+}
+
+func TestWebPEmbedsICCProfile(t *testing.T) {
+	profile := matrixICCProfile(false)
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+
+	for _, format := range []string{FormatWebP, FormatWebPLossless} {
+		renditions, err := RenderRenditions(img, RenditionProfile{Name: "large", MaxWidth: 100, MaxHeight: 100, Mode: ModeFit, Quality: 90, Format: format}, profile)
+		require.NoError(t, err)
+		data := renditions[0].Data
+		_, _, err = image.Decode(bytes.NewReader(data))
+		require.NoError(t, err, format)
+		assert.Contains(t, string(data), "VP8X", format)
+		assert.Contains(t, string(data), "ICCP", format)
+	}
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
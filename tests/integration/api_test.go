@@ -9,7 +9,9 @@ import (
 
     "encoding/json"
     "github.com/stretchr/testify/assert"
+    "github.com/mohammadshaad/zocket/internal/api"
     "github.com/mohammadshaad/zocket/internal/db"
+    "github.com/mohammadshaad/zocket/pkg/money"
     "github.com/mohammadshaad/zocket/tests/testutils"
     "github.com/mohammadshaad/zocket/config"
     "github.com/mohammadshaad/zocket/internal/cache"
@@ -22,7 +24,7 @@ func setup() {
     loadEnv()
     config.LoadConfig()
     db.InitDatabase()
-    initSchema()
+    testutils.InitTestSchema()
     initCache()
 }
 
@@ -49,20 +51,6 @@ func printEnvVariables() {
     log.Printf("AWS_SECRET_ACCESS_KEY: %s", os.Getenv("AWS_SECRET_ACCESS_KEY"))
 }
 
-func initSchema() {
-    // Create the products table
-    db.DB.Exec(`CREATE TABLE IF NOT EXISTS products (
-        id SERIAL PRIMARY KEY,
-        user_id INT,
-        product_name TEXT,
-        product_description TEXT,
-        product_images TEXT[],
-        compressed_product_images TEXT[],
-        product_price FLOAT,
-        created_at TIMESTAMP
-    )`)
-}
-
 func initCache() {
     REDIS_ADDR := os.Getenv("REDIS_ADDR")
     REDIS_PASSWORD := os.Getenv("REDIS_PASSWORD")
@@ -103,7 +91,7 @@ func TestGetAllProducts(t *testing.T) {
         {
             UserID:      1,
             ProductName: "Test Product 2",
-            ProductPrice: 199.99,
+            ProductPrice: money.MustParse("199.99", "USD"),
         },
     }
     
@@ -117,8 +105,50 @@ func TestGetAllProducts(t *testing.T) {
     
     assert.Equal(t, http.StatusOK, w.Code)
     
-    var response []db.Product
+    var response api.ProductPage
     err := json.Unmarshal(w.Body.Bytes(), &response)
     assert.NoError(t, err)
-    assert.GreaterOrEqual(t, len(response), 2)
+    assert.GreaterOrEqual(t, len(response.Items), 2)
+    assert.Positive(t, response.TotalEstimate)
+}
+
+func TestGetAllProductsPagination(t *testing.T) {
+    setup()
+    router := testutils.SetupTestRouter()
+
+    // A seller of its own keeps rows left by other tests out of the pages
+    seller := db.User{Name: "Pagination Seller", Email: "pagination-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "@example.com"}
+    assert.NoError(t, db.DB.Create(&seller).Error)
+    for i := 0; i < 3; i++ {
+        p := testutils.TestProduct
+        p.ID = 0
+        p.UserID = seller.ID
+        assert.NoError(t, db.DB.Create(&p).Error)
+    }
+
+    seen := map[uint]bool{}
+    cursor := ""
+    for page := 0; page < 3; page++ {
+        w := httptest.NewRecorder()
+        req, _ := http.NewRequest("GET", "/api/v1/products?limit=1&sort=price&order=asc&user_id="+strconv.FormatUint(uint64(seller.ID), 10)+"&cursor="+cursor, nil)
+        router.ServeHTTP(w, req)
+
+        assert.Equal(t, http.StatusOK, w.Code)
+
+        var response api.ProductPage
+        err := json.Unmarshal(w.Body.Bytes(), &response)
+        assert.NoError(t, err)
+        assert.Len(t, response.Items, 1)
+        assert.False(t, seen[response.Items[0].ID], "pages should not overlap")
+        seen[response.Items[0].ID] = true
+
+        // The last page has no cursor
+        if page < 2 {
+            assert.NotEmpty(t, response.NextCursor)
+        } else {
+            assert.Empty(t, response.NextCursor)
+        }
+        cursor = response.NextCursor
+    }
+    assert.Len(t, seen, 3)
 }
\ No newline at end of file
@@ -28,7 +28,7 @@ func setup() {
     loadEnv()
     config.LoadConfig()
     db.InitDatabase()
-    initSchema()
+    testutils.InitTestSchema()
     initCache()
 }
 
@@ -55,20 +55,6 @@ func printEnvVariables() {
     log.Printf("AWS_SECRET_ACCESS_KEY: %s", os.Getenv("AWS_SECRET_ACCESS_KEY"))
 }
 
-func initSchema() {
-    // Create the products table
-    db.DB.Exec(`CREATE TABLE IF NOT EXISTS products (
-        id SERIAL PRIMARY KEY,
-        user_id INT,
-        product_name TEXT,
-        product_description TEXT,
-        product_images TEXT[],
-        compressed_product_images TEXT[],
-        product_price FLOAT,
-        created_at TIMESTAMP
-    )`)
-}
-
 func initCache() {
     REDIS_ADDR := os.Getenv("REDIS_ADDR")
     REDIS_PASSWORD := os.Getenv("REDIS_PASSWORD")
@@ -1,24 +1,105 @@
 package testutils
 
 import (
+    "bytes"
+    "encoding/json"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "testing"
+    "time"
+
     "github.com/gin-gonic/gin"
+    "github.com/golang-jwt/jwt/v5"
     "github.com/mohammadshaad/zocket/internal/api"
+    "github.com/mohammadshaad/zocket/internal/auth"
     "github.com/mohammadshaad/zocket/internal/db"
+    "github.com/mohammadshaad/zocket/pkg/money"
+    "gorm.io/gorm/clause"
 )
 
+// TestJWTSecret is the HS256 key tokens are signed with in tests
+const TestJWTSecret = "test-secret-test-secret-test-secret"
+
 // TestProduct is a mock product for testing
 var TestProduct = db.Product{
     UserID:             1,
     ProductName:        "Test Product",
     ProductDescription: "Test Description",
     ProductImages:      []string{"https://shaad-my-product-images-bucket.s3.eu-north-1.amazonaws.com/shaad-image.jpeg"},
-    ProductPrice:       69.69,
+    ProductPrice:       money.MustParse("69.69", "USD"),
+}
+
+// TestUser is the seller of TestProduct
+var TestUser = db.User{ID: 1, Name: "Test Seller", Email: "seller@example.com"}
+
+// SeedTestUser creates TestUser unless it exists, since products need an
+// existing seller
+func SeedTestUser() {
+    if err := db.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&TestUser).Error; err != nil {
+        log.Fatalf("Error creating test user: %v", err)
+    }
+    // The explicit ID bypasses the sequence, move it past the seeded row
+    if err := db.DB.Exec("SELECT setval(pg_get_serial_sequence('users', 'id'), GREATEST((SELECT max(id) FROM users), 1))").Error; err != nil {
+        log.Fatalf("Error resetting users sequence: %v", err)
+    }
+}
+
+// InitTestSchema migrates the test database to the production schema and
+// seeds TestUser
+func InitTestSchema() {
+    if _, err := db.MigrateUp(); err != nil {
+        log.Fatalf("Error migrating test database: %v", err)
+    }
+    SeedTestUser()
 }
 
 // SetupTestRouter initializes a test router
 func SetupTestRouter() *gin.Engine {
     gin.SetMode(gin.TestMode)
+    verifier, err := auth.NewVerifier(auth.Config{Algorithm: auth.AlgorithmHS256, Secret: TestJWTSecret, AdminRole: "admin"})
+    if err != nil {
+        panic(err)
+    }
+    api.InitAuth(verifier)
+
     router := gin.New()
     api.SetupRoutes(router)
     return router
-}
\ No newline at end of file
+}
+
+// AuthHeader returns an Authorization header value for the user, valid for
+// the routers of SetupTestRouter
+func AuthHeader(userID uint, roles ...string) string {
+    token := jwt.NewWithClaims(jwt.SigningMethodHS256, auth.Claims{
+        RegisteredClaims: jwt.RegisteredClaims{
+            Subject:   strconv.FormatUint(uint64(userID), 10),
+            ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+        },
+        Roles: roles,
+    })
+    signed, err := token.SignedString([]byte(TestJWTSecret))
+    if err != nil {
+        panic(err)
+    }
+    return "Bearer " + signed
+}
+
+// DoRequest sends body as JSON to the router and records the response. An
+// empty authorization sends no Authorization header.
+func DoRequest(t testing.TB, router http.Handler, method, path, authorization string, body interface{}) *httptest.ResponseRecorder {
+    t.Helper()
+    jsonData, err := json.Marshal(body)
+    if err != nil {
+        t.Fatalf("Error encoding request body: %v", err)
+    }
+    w := httptest.NewRecorder()
+    req := httptest.NewRequest(method, path, bytes.NewReader(jsonData))
+    req.Header.Set("Content-Type", "application/json")
+    if authorization != "" {
+        req.Header.Set("Authorization", authorization)
+    }
+    router.ServeHTTP(w, req)
+    return w
+}